@@ -0,0 +1,79 @@
+package claudecode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrInvalidAgent is returned when an AgentDefinition is incomplete.
+var ErrInvalidAgent = errors.New("claude code: invalid agent")
+
+// AgentDefinition 描述一个经 --agents 注册的自定义 subagent，
+// 等价于 .claude/agents 下的 Markdown 定义，但无需写入文件。
+type AgentDefinition struct {
+	// Description 说明何时使用该 subagent，主 agent 据此决定是否委派。
+	Description string `json:"description"`
+	// Prompt 为 subagent 的系统提示词。
+	Prompt string `json:"prompt"`
+	// Tools 为 subagent 可用的工具，为空时继承主 agent 的全部工具。
+	Tools []string `json:"tools,omitempty"`
+	// Model 为 subagent 使用的模型（如 "sonnet"、"opus"、"haiku"），为空时继承主 agent。
+	Model string `json:"model,omitempty"`
+}
+
+// subagentTools 为启动 subagent 的内置工具名（新版 CLI 将 Task 更名为 Agent）。
+var subagentTools = map[string]bool{"Task": true, "Agent": true}
+
+// validateAgents checks agent names and required fields.
+// 参数：agents 为 Options.Agents。
+// 返回：第一个无效定义对应的错误（包装 ErrInvalidAgent）。
+func validateAgents(agents map[string]AgentDefinition) error {
+	names := make([]string, 0, len(agents))
+	for name := range agents {
+		names = append(names, name)
+	}
+	// 按名称排序，保证报告的错误稳定。
+	sort.Strings(names)
+	for _, name := range names {
+		agent := agents[name]
+		switch {
+		case !mcpToolNamePattern.MatchString(name):
+			return fmt.Errorf("%w: %q: name must match %s", ErrInvalidAgent, name, mcpToolNamePattern)
+		case agent.Description == "":
+			return fmt.Errorf("%w: %q: Description is required", ErrInvalidAgent, name)
+		case agent.Prompt == "":
+			return fmt.Errorf("%w: %q: Prompt is required", ErrInvalidAgent, name)
+		}
+	}
+	return nil
+}
+
+// encodeAgents serializes Options.Agents for --agents.
+// 参数：agents 为 subagent 定义。
+// 返回：JSON 文本（为空时返回空字符串）与错误。
+func encodeAgents(agents map[string]AgentDefinition) (string, error) {
+	if len(agents) == 0 {
+		return "", nil
+	}
+	if err := validateAgents(agents); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(agents)
+	if err != nil {
+		return "", fmt.Errorf("claude code: encode agents: %w", err)
+	}
+	return string(data), nil
+}
+
+// subagentType returns the subagent requested by a Task tool_use.
+// 参数：event 为 tool_use 事件。
+// 返回：subagent_type，非 Task 调用时为空。
+func subagentType(event ToolEvent) string {
+	if !subagentTools[event.ToolName] {
+		return ""
+	}
+	name, _ := event.Input["subagent_type"].(string)
+	return name
+}
@@ -0,0 +1,73 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestWithAgentsAttributesSubagentTools(t *testing.T) {
+	fake := claudetest.New(t).Replay(
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_task","name":"Task","input":{"subagent_type":"security-reviewer","prompt":"审查 diff"}}]},"parent_tool_use_id":null}`,
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_grep","name":"Grep","input":{"pattern":"password"}}]},"parent_tool_use_id":"toolu_task"}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_grep","content":"config.go:12"}]},"parent_tool_use_id":"toolu_task"}`,
+		`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_task","content":"发现硬编码密码"}]},"parent_tool_use_id":null}`,
+		`{"type":"result","subtype":"success","result":"发现 1 个问题"}`,
+	)
+	var events []ToolEvent
+	llm, err := New(
+		WithCLIPath(fake.Path),
+		WithAgents(map[string]AgentDefinition{
+			"security-reviewer": {
+				Description: "Reviews diffs for security issues",
+				Prompt:      "You are a security reviewer.",
+				Tools:       []string{"Read", "Grep"},
+				Model:       "opus",
+			},
+		}),
+		WithToolEventHook(func(event ToolEvent) { events = append(events, event) }),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := llm.GenerateContent(context.Background(), []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "review")}); err != nil {
+		t.Fatalf("GenerateContent: %v", err)
+	}
+
+	want := `{"security-reviewer":{"description":"Reviews diffs for security issues","prompt":"You are a security reviewer.","tools":["Read","Grep"],"model":"opus"}}`
+	if got := fake.LastInvocation().Flag("--agents"); got != want {
+		t.Fatalf("unexpected --agents: %s", got)
+	}
+
+	if len(events) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(events))
+	}
+	task, grep, grepResult, taskResult := events[0], events[1], events[2], events[3]
+	if task.ParentToolUseID != "" || task.Agent != "" {
+		t.Fatalf("main agent event attributed to subagent: %+v", task)
+	}
+	for _, event := range []ToolEvent{grep, grepResult} {
+		if event.ParentToolUseID != "toolu_task" || event.Agent != "security-reviewer" {
+			t.Fatalf("subagent event not attributed: %+v", event)
+		}
+	}
+	if grepResult.ToolName != "Grep" || taskResult.Agent != "" || taskResult.Output != "发现硬编码密码" {
+		t.Fatalf("unexpected results: %+v %+v", grepResult, taskResult)
+	}
+}
+
+func TestValidateAgents(t *testing.T) {
+	invalid := []map[string]AgentDefinition{
+		{"bad name": {Description: "d", Prompt: "p"}},
+		{"reviewer": {Prompt: "p"}},
+		{"reviewer": {Description: "d"}},
+	}
+	for _, agents := range invalid {
+		if _, err := New(WithCLIPath("claude"), WithAgents(agents)); !errors.Is(err, ErrInvalidAgent) {
+			t.Errorf("%v: expected ErrInvalidAgent, got %v", agents, err)
+		}
+	}
+}
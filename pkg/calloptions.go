@@ -0,0 +1,75 @@
+package claudecode
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// callOptionsMetadataKey 为 CallOptions.Metadata 中保存单次调用 Option 的键。
+const callOptionsMetadataKey = "claudecode.options"
+
+// maxOutputTokensEnv 为 CLI 读取的单次响应最大输出 token 环境变量。
+const maxOutputTokensEnv = "CLAUDE_CODE_MAX_OUTPUT_TOKENS"
+
+// jsonModeInstruction 在 JSONMode 下追加到系统提示词，CLI 没有对应参数。
+const jsonModeInstruction = "Respond with a single valid JSON value only, without Markdown code fences or any other text."
+
+// WithCallOptions applies adapter options to a single GenerateContent call.
+// 参数：opts 为本次调用生效的 Option（如 WithSessionID、WithCwd、WithAllowedTools），
+// 在 New 时的配置之上覆盖，不影响其它调用。
+// 返回：llms.CallOption，经 CallOptions.Metadata 传递，需在 llms.WithMetadata 之后使用。
+func WithCallOptions(opts ...Option) llms.CallOption {
+	return func(o *llms.CallOptions) {
+		metadata := make(map[string]any, len(o.Metadata)+1)
+		maps.Copy(metadata, o.Metadata)
+		existing, _ := metadata[callOptionsMetadataKey].([]Option)
+		metadata[callOptionsMetadataKey] = append(append([]Option{}, existing...), opts...)
+		o.Metadata = metadata
+	}
+}
+
+// withCallOptions resolves the options for one call.
+// 标准 CallOptions 中可映射到 CLI 的字段：Model 对应 --model，MaxTokens 对应
+// CLAUDE_CODE_MAX_OUTPUT_TOKENS，JSONMode / ResponseMIMEType=application/json 追加系统提示词；
+// Temperature、TopP 等采样参数 CLI 不支持，会被忽略。
+// 参数：callOpts 为本次调用参数。
+// 返回：本次调用使用的 *LLM（无覆盖时返回自身）；覆盖后的 ToolPolicy、MCPServers 或
+// Agents 无效时返回与 New 相同的校验错误。
+func (l *LLM) withCallOptions(callOpts llms.CallOptions) (*LLM, error) {
+	overrides, _ := callOpts.Metadata[callOptionsMetadataKey].([]Option)
+	jsonMode := callOpts.JSONMode || callOpts.ResponseMIMEType == "application/json"
+	if len(overrides) == 0 && callOpts.Model == "" && callOpts.MaxTokens <= 0 && !jsonMode {
+		return l, nil
+	}
+
+	resolved := &LLM{cliPath: l.cliPath, opts: l.opts, history: l.history, sessions: l.sessions, replays: l.replays}
+	for _, opt := range overrides {
+		opt(&resolved.opts)
+	}
+	if len(overrides) > 0 {
+		// 单次调用的策略同样需要校验，否则无效规则会被静默忽略。
+		if err := validateOptions(&resolved.opts); err != nil {
+			return nil, err
+		}
+	}
+	if path := strings.TrimSpace(resolved.opts.CLIPath); path != "" && path != l.opts.CLIPath {
+		resolved.cliPath = path
+	}
+	if callOpts.Model != "" {
+		resolved.opts.Model = callOpts.Model
+	}
+	if callOpts.MaxTokens > 0 {
+		// 复制后再写入，避免修改 New 时的 Env。
+		env := make(map[string]string, len(resolved.opts.Env)+1)
+		maps.Copy(env, resolved.opts.Env)
+		env[maxOutputTokensEnv] = strconv.Itoa(callOpts.MaxTokens)
+		resolved.opts.Env = env
+	}
+	if jsonMode {
+		resolved.opts.SystemPrompt = strings.TrimSpace(resolved.opts.SystemPrompt + "\n\n" + jsonModeInstruction)
+	}
+	return resolved, nil
+}
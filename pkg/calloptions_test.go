@@ -0,0 +1,57 @@
+package claudecode
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestCallOptionsOverridePerCall(t *testing.T) {
+	t.Setenv(maxOutputTokensEnv, "")
+	fake := claudetest.New(t)
+	workDir := t.TempDir()
+	llm, err := New(WithCLIPath(fake.Path), WithModel("sonnet"), WithSessionID("sess-default"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	_, err = llm.Call(context.Background(), "你好",
+		llms.WithModel("opus"),
+		llms.WithMaxTokens(256),
+		llms.WithJSONMode(),
+		WithCallOptions(WithSessionID("sess-call"), WithCwd(workDir), WithAllowedTools("Read")),
+	)
+	if err != nil {
+		t.Fatalf("Call with overrides: %v", err)
+	}
+	inv := fake.LastInvocation()
+	if inv.Flag("--model") != "opus" || inv.Flag("--session-id") != "sess-call" || inv.Flag("--allowedTools") != "Read" {
+		t.Fatalf("overrides missing from args: %q", inv.Args)
+	}
+	if got := systemPrompt(inv); got != jsonModeInstruction {
+		t.Fatalf("unexpected system prompt: %q", got)
+	}
+	if got := inv.Env[maxOutputTokensEnv]; got != "256" {
+		t.Fatalf("unexpected max tokens env: %q", got)
+	}
+	if inv.Dir != workDir {
+		t.Fatalf("unexpected cwd: %q", inv.Dir)
+	}
+
+	// 覆盖项只作用于单次调用。
+	if _, err := llm.Call(context.Background(), "你好"); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	inv = fake.LastInvocation()
+	if inv.Flag("--model") != "sonnet" || inv.Flag("--session-id") != "sess-default" {
+		t.Fatalf("overrides leaked into next call: %q", inv.Args)
+	}
+	if inv.HasFlag("--allowedTools") || systemPrompt(inv) != "" {
+		t.Fatalf("overrides leaked into next call: %q", inv.Args)
+	}
+	if got := inv.Env[maxOutputTokensEnv]; got != "" {
+		t.Fatalf("max tokens leaked into next call: %q", got)
+	}
+}
@@ -0,0 +1,319 @@
+// Package claudetest provides a scriptable fake Claude Code CLI for hermetic
+// tests of code built on the claudecode adapter.
+//
+// The fake is a small Go program (testdata/fakeclaude) compiled on first use
+// with the local Go toolchain. Point the adapter at it with
+// claudecode.WithCLIPath(fake.Path):
+//
+//	fake := claudetest.New(t)
+//	fake.Replay(
+//		`{"type":"assistant","message":{"content":[{"type":"text","text":"hi"}]}}`,
+//		`{"type":"result","subtype":"success","result":"hi"}`,
+//	)
+//	llm, _ := claudecode.New(claudecode.WithCLIPath(fake.Path))
+//	...
+//	inv := fake.LastInvocation()
+//	inv.Flag("--model")
+package claudetest
+
+import (
+	"bufio"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//go:embed testdata/fakeclaude/main.go
+var fakeSource []byte
+
+// config 为写入 "<Path>.json" 的回放配置，字段与 testdata/fakeclaude 对应。
+type config struct {
+	Lines      []string   `json:"lines"`
+	Sequence   [][]string `json:"sequence,omitempty"`
+	Turns      [][]string `json:"turns,omitempty"`
+	Stderr     string     `json:"stderr,omitempty"`
+	ExitCode   int        `json:"exit_code,omitempty"`
+	DelayMS    int        `json:"delay_ms,omitempty"`
+	HangAfter  int        `json:"hang_after"`
+	SpawnChild bool       `json:"spawn_child,omitempty"`
+}
+
+// File 为调用时参数引用的文件快照（适配器会在调用结束后删除这些临时文件）。
+type File struct {
+	Content string      `json:"content"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// Invocation 为 fake CLI 收到的一次调用。
+type Invocation struct {
+	Args  []string          `json:"args"`
+	Env   map[string]string `json:"env"`
+	Dir   string            `json:"dir"`
+	Stdin string            `json:"stdin"`
+	// Files 按参数名记录 --mcp-config、--system-prompt-file 等文件参数的内容与权限。
+	Files map[string]File `json:"files,omitempty"`
+	// ChildPID 为 SpawnChild 启动的子进程 PID。
+	ChildPID int `json:"child_pid,omitempty"`
+	// Signal 为终止 fake 的信号（如 "interrupt"），正常退出时为空。
+	Signal string `json:"signal,omitempty"`
+	// StartedAt 与 ExitedAt 为进程启动与退出时间，被 SIGKILL 时 ExitedAt 为零值。
+	StartedAt time.Time `json:"started_at"`
+	ExitedAt  time.Time `json:"exited_at"`
+}
+
+// Flag returns the value following flag in Args, or "" when absent.
+func (i Invocation) Flag(flag string) string {
+	idx := slices.Index(i.Args, flag)
+	if idx < 0 || idx+1 >= len(i.Args) {
+		return ""
+	}
+	return i.Args[idx+1]
+}
+
+// HasFlag reports whether flag appears in Args.
+func (i Invocation) HasFlag(flag string) bool {
+	return slices.Contains(i.Args, flag)
+}
+
+// Prompt returns the prompt passed after "--", or Stdin when it was piped.
+func (i Invocation) Prompt() string {
+	if idx := slices.Index(i.Args, "--"); idx >= 0 && idx+1 < len(i.Args) {
+		return i.Args[idx+1]
+	}
+	return i.Stdin
+}
+
+// File returns the snapshot of the file passed to flag, e.g. "--mcp-config".
+func (i Invocation) File(flag string) (File, bool) {
+	file, ok := i.Files[flag]
+	return file, ok
+}
+
+// StdinLines returns the non-empty stdin lines (stream-json input mode).
+func (i Invocation) StdinLines() []string {
+	var lines []string
+	for _, line := range strings.Split(i.Stdin, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Fake 为一个可编排的 fake claude 可执行文件。配置方法需在启动被测调用前设置。
+type Fake struct {
+	// Path 为 fake CLI 的路径，传给 claudecode.WithCLIPath。
+	Path string
+
+	t   testing.TB
+	mu  sync.Mutex
+	cfg config
+}
+
+// New builds the fake CLI into a per-test temp directory.
+// 参数：t 为测试上下文，构建失败时 t.Fatal。
+// 返回：默认回放一条成功 result 的 *Fake。
+func New(t testing.TB) *Fake {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "claude")
+	build(t, path)
+
+	f := &Fake{Path: path, t: t, cfg: config{HangAfter: -1}}
+	f.Replay(`{"type":"result","subtype":"success","is_error":false,"result":""}`)
+	return f
+}
+
+// Replay sets the stream-json lines written to stdout for every invocation.
+func (f *Fake) Replay(lines ...string) *Fake {
+	return f.update(func(c *config) { c.Lines = append([]string{}, lines...) })
+}
+
+// ReplaySequence sets per-invocation output: the n-th invocation (in start
+// order) replays outputs[n-1]. Invocations beyond the sequence fail with exit
+// code 2, like a CLI that cannot produce a response.
+func (f *Fake) ReplaySequence(outputs ...[]string) *Fake {
+	return f.update(func(c *config) { c.Sequence = outputs })
+}
+
+// ReplayFile replays a recorded stream-json transcript (one JSON object per line).
+func (f *Fake) ReplayFile(path string) *Fake {
+	f.t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		f.t.Fatalf("claudetest: open transcript: %v", err)
+	}
+	defer file.Close()
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.t.Fatalf("claudetest: read transcript: %v", err)
+	}
+	return f.Replay(lines...)
+}
+
+// ReplayTurns sets per-turn output for --input-format stream-json sessions:
+// the n-th stdin line is answered with turns[n].
+func (f *Fake) ReplayTurns(turns ...[]string) *Fake {
+	return f.update(func(c *config) { c.Turns = turns })
+}
+
+// Stderr sets text written to stderr before exiting.
+func (f *Fake) Stderr(text string) *Fake {
+	return f.update(func(c *config) { c.Stderr = text })
+}
+
+// ExitCode sets the process exit code.
+func (f *Fake) ExitCode(code int) *Fake {
+	return f.update(func(c *config) { c.ExitCode = code })
+}
+
+// Delay sleeps before each output line to simulate slow output.
+func (f *Fake) Delay(d time.Duration) *Fake {
+	return f.update(func(c *config) { c.DelayMS = int(d / time.Millisecond) })
+}
+
+// HangAfter blocks forever after n output lines, until the process is killed.
+func (f *Fake) HangAfter(n int) *Fake {
+	return f.update(func(c *config) { c.HangAfter = n })
+}
+
+// SpawnChild makes every invocation start a long-running child process in the
+// fake's process group, like a background job left behind by a Bash tool. Its
+// PID is recorded in Invocation.ChildPID; the test must make sure it is killed.
+func (f *Fake) SpawnChild() *Fake {
+	return f.update(func(c *config) { c.SpawnChild = true })
+}
+
+// Invocations returns all recorded invocations in start order.
+func (f *Fake) Invocations() []Invocation {
+	f.t.Helper()
+	dir := f.Path + ".calls"
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		f.t.Fatalf("claudetest: read invocations: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	invocations := make([]Invocation, 0, len(names))
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			f.t.Fatalf("claudetest: read invocation: %v", err)
+		}
+		var inv Invocation
+		if err := json.Unmarshal(data, &inv); err != nil {
+			f.t.Fatalf("claudetest: decode invocation %s: %v", name, err)
+		}
+		invocations = append(invocations, inv)
+	}
+	return invocations
+}
+
+// LastInvocation returns the most recent invocation, failing the test when none exist.
+func (f *Fake) LastInvocation() Invocation {
+	f.t.Helper()
+	invocations := f.Invocations()
+	if len(invocations) == 0 {
+		f.t.Fatalf("claudetest: fake claude was not invoked")
+	}
+	return invocations[len(invocations)-1]
+}
+
+// update applies a config change and rewrites "<Path>.json".
+func (f *Fake) update(apply func(*config)) *Fake {
+	f.t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	apply(&f.cfg)
+	data, err := json.Marshal(f.cfg)
+	if err != nil {
+		f.t.Fatalf("claudetest: encode config: %v", err)
+	}
+	if err := os.WriteFile(f.Path+".json", data, 0o644); err != nil {
+		f.t.Fatalf("claudetest: write config: %v", err)
+	}
+	return f
+}
+
+var (
+	buildOnce sync.Once
+	buildPath string
+	buildErr  error
+	buildOut  []byte
+)
+
+// build compiles the fake once and copies it to path. The binary is cached in
+// the user cache directory, keyed by the fake's source and target platform.
+func build(t testing.TB, path string) {
+	t.Helper()
+	buildOnce.Do(func() {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			cacheDir = os.TempDir()
+		}
+		sum := sha256.Sum256(append(fakeSource, runtime.GOOS+"/"+runtime.GOARCH...))
+		dir := filepath.Join(cacheDir, "claudetest", hex.EncodeToString(sum[:8]))
+		buildPath = filepath.Join(dir, "fakeclaude")
+		if _, err := os.Stat(buildPath); err == nil {
+			return
+		}
+		if buildErr = os.MkdirAll(dir, 0o755); buildErr != nil {
+			return
+		}
+		work, err := os.MkdirTemp(dir, "build-")
+		if err != nil {
+			buildErr = err
+			return
+		}
+		defer os.RemoveAll(work)
+		src := filepath.Join(work, "main.go")
+		if buildErr = os.WriteFile(src, fakeSource, 0o644); buildErr != nil {
+			return
+		}
+		out := filepath.Join(work, "fakeclaude")
+		cmd := exec.Command("go", "build", "-o", out, src)
+		cmd.Dir = work
+		cmd.Env = append(os.Environ(), "GOWORK=off", "GOFLAGS=", "CGO_ENABLED=0")
+		if buildOut, buildErr = cmd.CombinedOutput(); buildErr != nil {
+			return
+		}
+		// 并发的测试进程可能同时构建，rename 保证缓存文件完整。
+		buildErr = os.Rename(out, buildPath)
+	})
+	if buildErr != nil {
+		t.Fatalf("claudetest: build fake claude: %v\n%s", buildErr, buildOut)
+	}
+	data, err := os.ReadFile(buildPath)
+	if err != nil {
+		t.Fatalf("claudetest: read fake claude: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatalf("claudetest: install fake claude: %v", err)
+	}
+}
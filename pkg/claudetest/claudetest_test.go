@@ -0,0 +1,140 @@
+package claudetest_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	claudecode "github.com/IMBotPlatform/LLMClaudeCode/pkg"
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestFakeReplaysTranscriptAndRecordsInvocation(t *testing.T) {
+	fake := claudetest.New(t).ReplayFile("testdata/tool_use.jsonl")
+	var tools []claudecode.ToolEvent
+	llm, err := claudecode.New(
+		claudecode.WithCLIPath(fake.Path),
+		claudecode.WithModel("sonnet"),
+		claudecode.WithEnv(map[string]string{"ANTHROPIC_BASE_URL": "http://fake"}),
+		claudecode.WithToolEventHook(func(e claudecode.ToolEvent) { tools = append(tools, e) }),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	reply, err := llm.Call(context.Background(), "README 的标题是什么？", claudecode.WithCallOptions(claudecode.WithPromptInput(claudecode.PromptInputStdin)))
+	if err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	if reply != "README 的标题是 LLMClaudeCode。" {
+		t.Fatalf("unexpected reply: %q", reply)
+	}
+	if len(tools) != 2 || tools[1].Output != "# LLMClaudeCode" {
+		t.Fatalf("unexpected tool events: %+v", tools)
+	}
+
+	inv := fake.LastInvocation()
+	if inv.Flag("--model") != "sonnet" || !inv.HasFlag("--print") || inv.HasFlag("--") {
+		t.Fatalf("unexpected args: %q", inv.Args)
+	}
+	if inv.Stdin != "User: README 的标题是什么？" || inv.Prompt() != inv.Stdin {
+		t.Fatalf("unexpected stdin: %q", inv.Stdin)
+	}
+	if inv.Env["ANTHROPIC_BASE_URL"] != "http://fake" {
+		t.Fatalf("env not passed through: %q", inv.Env["ANTHROPIC_BASE_URL"])
+	}
+}
+
+func TestFakeSimulatesFailureAndHang(t *testing.T) {
+	fake := claudetest.New(t).Replay().Stderr("Invalid API key · Please run /login\n").ExitCode(1)
+	llm, err := claudecode.New(claudecode.WithCLIPath(fake.Path), claudecode.WithCancelGracePeriod(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := llm.Call(context.Background(), "你好"); !errors.Is(err, claudecode.ErrAuth) {
+		t.Fatalf("expected ErrAuth, got %v", err)
+	}
+
+	fake.Stderr("").ExitCode(0).Replay(`{"type":"system","subtype":"init","session_id":"sess-1"}`).HangAfter(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := llm.Call(ctx, "你好"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if n := len(fake.Invocations()); n != 2 {
+		t.Fatalf("expected 2 invocations, got %d", n)
+	}
+}
+
+func TestFakeReplaysSessionTurns(t *testing.T) {
+	fake := claudetest.New(t).Delay(time.Millisecond).ReplayTurns(
+		[]string{`{"type":"result","subtype":"success","session_id":"sess-1","result":"第一轮"}`},
+		[]string{`{"type":"result","subtype":"success","session_id":"sess-1","result":"第二轮"}`},
+	)
+	llm, err := claudecode.New(claudecode.WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session, err := llm.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	for _, want := range []string{"第一轮", "第二轮"} {
+		resp, err := session.GenerateContent(context.Background(), []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "继续")})
+		if err != nil {
+			t.Fatalf("GenerateContent: %v", err)
+		}
+		if got := resp.Choices[0].GenerationInfo["Result"]; got != want {
+			t.Fatalf("got %v, want %s", got, want)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if lines := fake.LastInvocation().StdinLines(); len(lines) != 2 {
+		t.Fatalf("unexpected stdin lines: %q", lines)
+	}
+}
+
+func TestFakeReplaysSequenceAndCapturesFiles(t *testing.T) {
+	fake := claudetest.New(t).ReplaySequence(
+		[]string{`{"type":"result","subtype":"success","result":"第一次"}`},
+		[]string{`{"type":"result","subtype":"success","result":"第二次"}`},
+	)
+	llm, err := claudecode.New(
+		claudecode.WithCLIPath(fake.Path),
+		claudecode.WithSystemPrompt("你是助手"),
+		claudecode.WithMCPServers(claudecode.MCPServer{Name: "docs", URL: "http://127.0.0.1:9/mcp"}),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, want := range []string{"第一次", "第二次"} {
+		resp, err := llm.GenerateContent(context.Background(), []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "你好")})
+		if err != nil {
+			t.Fatalf("GenerateContent: %v", err)
+		}
+		if got := resp.Choices[0].GenerationInfo["Result"]; got != want {
+			t.Fatalf("got %v, want %s", got, want)
+		}
+	}
+	if _, err := llm.Call(context.Background(), "你好"); err == nil {
+		t.Fatalf("expected an error once the sequence is exhausted")
+	}
+
+	inv := fake.Invocations()[0]
+	if file, ok := inv.File("--system-prompt-file"); !ok || file.Content != "你是助手" {
+		t.Fatalf("system prompt file not captured: %+v", inv.Files)
+	}
+	if file, ok := inv.File("--mcp-config"); !ok || file.Mode != 0o600 || !strings.Contains(file.Content, `"docs"`) {
+		t.Fatalf("mcp config not captured: %+v", inv.Files)
+	}
+	if inv.StartedAt.IsZero() || inv.ExitedAt.Before(inv.StartedAt) {
+		t.Fatalf("unexpected timestamps: %v %v", inv.StartedAt, inv.ExitedAt)
+	}
+}
@@ -0,0 +1,263 @@
+// Command fakeclaude imitates the Claude Code CLI for hermetic tests.
+//
+// It reads its behavior from "<executable>.json" (written by claudetest.Fake),
+// records each invocation as "<executable>.calls/<n>.json", and replays the
+// configured stream-json lines on stdout.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// childEnv marks the long-running child started by SpawnChild.
+const childEnv = "FAKECLAUDE_CHILD"
+
+// fileFlags are the flags whose file arguments are captured, since the adapter
+// removes those files once the call returns.
+var fileFlags = []string{"--mcp-config", "--system-prompt-file", "--append-system-prompt-file", "--settings"}
+
+// config mirrors claudetest.config.
+type config struct {
+	Lines      []string   `json:"lines"`
+	Sequence   [][]string `json:"sequence"`
+	Turns      [][]string `json:"turns"`
+	Stderr     string     `json:"stderr"`
+	ExitCode   int        `json:"exit_code"`
+	DelayMS    int        `json:"delay_ms"`
+	HangAfter  int        `json:"hang_after"`
+	SpawnChild bool       `json:"spawn_child"`
+}
+
+// file mirrors claudetest.File.
+type file struct {
+	Content string      `json:"content"`
+	Mode    os.FileMode `json:"mode"`
+}
+
+// invocation mirrors claudetest.Invocation.
+type invocation struct {
+	Args      []string          `json:"args"`
+	Env       map[string]string `json:"env"`
+	Dir       string            `json:"dir"`
+	Stdin     string            `json:"stdin"`
+	Files     map[string]file   `json:"files,omitempty"`
+	ChildPID  int               `json:"child_pid,omitempty"`
+	Signal    string            `json:"signal,omitempty"`
+	StartedAt time.Time         `json:"started_at"`
+	ExitedAt  time.Time         `json:"exited_at"`
+}
+
+func main() {
+	if os.Getenv(childEnv) == "1" {
+		// SpawnChild 启动的子进程：模拟 Bash 工具留下的后台任务。
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		fail(err)
+	}
+	data, err := os.ReadFile(exe + ".json")
+	if err != nil {
+		fail(err)
+	}
+	cfg := config{HangAfter: -1}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		fail(err)
+	}
+
+	rec := &recorder{dir: exe + ".calls"}
+	rec.inv.Args = os.Args[1:]
+	rec.inv.Dir, _ = os.Getwd()
+	rec.inv.StartedAt = time.Now()
+	rec.inv.Env = make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			rec.inv.Env[k] = v
+		}
+	}
+	rec.inv.Files = captureFiles(os.Args[1:])
+	n, err := rec.create()
+	if err != nil {
+		fail(err)
+	}
+
+	// 记录终止信号后以 130 退出，便于断言取消时先收到 SIGINT。
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		rec.update(func(inv *invocation) {
+			inv.Signal = sig.String()
+			inv.ExitedAt = time.Now()
+		})
+		os.Exit(130)
+	}()
+
+	if cfg.SpawnChild {
+		child := exec.Command(exe)
+		child.Env = append(os.Environ(), childEnv+"=1")
+		if err := child.Start(); err != nil {
+			fail(err)
+		}
+		rec.update(func(inv *invocation) { inv.ChildPID = child.Process.Pid })
+	}
+
+	lines := cfg.Lines
+	if len(cfg.Sequence) > 0 {
+		if n > len(cfg.Sequence) {
+			rec.update(func(inv *invocation) { inv.ExitedAt = time.Now() })
+			fail(fmt.Errorf("no output configured for invocation %d", n))
+		}
+		lines = cfg.Sequence[n-1]
+	}
+
+	out := &output{cfg: cfg}
+	if len(cfg.Turns) > 0 && streamInput(os.Args[1:]) {
+		// 长会话模式：每读到一行用户消息回放一轮。
+		scanner := bufio.NewScanner(os.Stdin)
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		turn := 0
+		for scanner.Scan() {
+			line := scanner.Text()
+			rec.update(func(inv *invocation) { inv.Stdin += line + "\n" })
+			if turn < len(cfg.Turns) {
+				out.write(cfg.Turns[turn])
+			}
+			turn++
+		}
+	} else {
+		stdin, _ := io.ReadAll(os.Stdin)
+		rec.update(func(inv *invocation) { inv.Stdin = string(stdin) })
+		out.write(lines)
+	}
+
+	if cfg.Stderr != "" {
+		fmt.Fprint(os.Stderr, cfg.Stderr)
+	}
+	out.hang()
+	rec.update(func(inv *invocation) { inv.ExitedAt = time.Now() })
+	os.Exit(cfg.ExitCode)
+}
+
+// captureFiles snapshots the files named by fileFlags.
+func captureFiles(args []string) map[string]file {
+	files := make(map[string]file)
+	for i, arg := range args[:max(len(args)-1, 0)] {
+		if !slices.Contains(fileFlags, arg) {
+			continue
+		}
+		path := args[i+1]
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		files[arg] = file{Content: string(data), Mode: info.Mode().Perm()}
+	}
+	return files
+}
+
+// streamInput reports whether --input-format stream-json was passed.
+func streamInput(args []string) bool {
+	i := slices.Index(args, "--input-format")
+	return i >= 0 && i+1 < len(args) && args[i+1] == "stream-json"
+}
+
+// output writes lines with the configured delay and hang point.
+type output struct {
+	cfg     config
+	written int
+}
+
+func (o *output) write(lines []string) {
+	for _, line := range lines {
+		if o.cfg.HangAfter >= 0 && o.written >= o.cfg.HangAfter {
+			o.hang()
+		}
+		if o.cfg.DelayMS > 0 {
+			time.Sleep(time.Duration(o.cfg.DelayMS) * time.Millisecond)
+		}
+		fmt.Println(line)
+		o.written++
+	}
+}
+
+// hang blocks until the process is killed when the hang point was reached.
+func (o *output) hang() {
+	if o.cfg.HangAfter >= 0 && o.written >= o.cfg.HangAfter {
+		for {
+			time.Sleep(time.Hour)
+		}
+	}
+}
+
+// recorder stores the invocation under a unique sequence number.
+type recorder struct {
+	dir  string
+	path string
+	mu   sync.Mutex
+	inv  invocation
+}
+
+// create reserves the next sequence number, starting at 1.
+func (r *recorder) create() (int, error) {
+	if err := os.MkdirAll(r.dir, 0o755); err != nil {
+		return 0, err
+	}
+	for n := 1; ; n++ {
+		path := filepath.Join(r.dir, fmt.Sprintf("%06d.json", n))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		_ = file.Close()
+		r.path = path
+		return n, r.save()
+	}
+}
+
+// update applies change and saves the invocation.
+func (r *recorder) update(change func(*invocation)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	change(&r.inv)
+	_ = r.save()
+}
+
+func (r *recorder) save() error {
+	data, err := json.Marshal(r.inv)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.path)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "fakeclaude:", err)
+	os.Exit(2)
+}
@@ -0,0 +1,208 @@
+package claudecode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
+)
+
+var (
+	// ErrMaxTurns is returned when the CLI stops after reaching --max-turns.
+	ErrMaxTurns = errors.New("claude code: max turns reached")
+	// ErrMaxBudget is returned when the CLI stops after reaching its spending limit.
+	ErrMaxBudget = errors.New("claude code: max budget reached")
+	// ErrExecution is returned when the CLI reports an error during execution.
+	ErrExecution = errors.New("claude code: error during execution")
+	// ErrAuth is returned when the API rejects the credentials.
+	ErrAuth = errors.New("claude code: authentication failed")
+	// ErrBilling is returned when the account has no remaining credit or quota.
+	ErrBilling = errors.New("claude code: billing error")
+	// ErrRateLimited is returned when the API rate limit is hit.
+	ErrRateLimited = errors.New("claude code: rate limited")
+	// ErrOverloaded is returned when the API is temporarily overloaded.
+	ErrOverloaded = errors.New("claude code: api overloaded")
+	// ErrServer is returned when the API fails with an internal server error.
+	ErrServer = errors.New("claude code: api server error")
+	// ErrInvalidRequest is returned when the API rejects the request.
+	ErrInvalidRequest = errors.New("claude code: invalid request")
+	// ErrCLIFailed is returned when the CLI fails for an unrecognized reason.
+	ErrCLIFailed = errors.New("claude code: cli failed")
+)
+
+// CLIError 描述一次失败的 CLI 调用，可通过 errors.Is 匹配 Kind，
+// 通过 errors.As 获取 result subtype、错误信息与 stderr。
+type CLIError struct {
+	// Kind 为错误分类，即本包导出的 Err* 之一。
+	Kind error
+	// Subtype 为 result 消息的 subtype（如 error_max_turns），非 result 错误时为空。
+	Subtype string
+	// Message 为 CLI 或 API 返回的错误信息。
+	Message string
+	// Stderr 为 CLI 的标准错误输出。
+	Stderr string
+	// Err 为底层错误（如进程退出错误）。
+	Err error
+}
+
+// Error implements error.
+func (e *CLIError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Kind.Error())
+	if e.Subtype != "" {
+		fmt.Fprintf(&b, " (%s)", e.Subtype)
+	}
+	if e.Err != nil {
+		fmt.Fprintf(&b, ": %v", e.Err)
+	}
+	if e.Message != "" {
+		fmt.Fprintf(&b, ": %s", e.Message)
+	}
+	if e.Stderr != "" && e.Stderr != e.Message {
+		fmt.Fprintf(&b, ": %s", e.Stderr)
+	}
+	return b.String()
+}
+
+// Unwrap exposes both the error kind and the underlying error to errors.Is/As.
+func (e *CLIError) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// resultErrorKinds maps result subtypes to error kinds.
+var resultErrorKinds = map[string]error{
+	"error_max_turns":                     ErrMaxTurns,
+	"error_max_budget_usd":                ErrMaxBudget,
+	"error_during_execution":              ErrExecution,
+	"error_max_structured_output_retries": ErrExecution,
+}
+
+// assistantErrorKinds maps the assistant message "error" field to error kinds.
+var assistantErrorKinds = map[string]error{
+	"authentication_failed": ErrAuth,
+	"billing_error":         ErrBilling,
+	"rate_limit":            ErrRateLimited,
+	"invalid_request":       ErrInvalidRequest,
+	"server_error":          ErrServer,
+}
+
+// apiErrorKinds maps Anthropic API error types (error.type in API error bodies) to error kinds.
+var apiErrorKinds = map[string]error{
+	"authentication_error":  ErrAuth,
+	"billing_error":         ErrBilling,
+	"rate_limit_error":      ErrRateLimited,
+	"overloaded_error":      ErrOverloaded,
+	"api_error":             ErrServer,
+	"invalid_request_error": ErrInvalidRequest,
+}
+
+// messageErrorPatterns 按顺序匹配错误文本（API 错误信息或 stderr），
+// 均取自 CLI 与 API 的实际错误信息，避免普通文本中的 "/login"、"quota" 等词误判。
+var messageErrorPatterns = []struct {
+	kind     error
+	patterns []string
+}{
+	{ErrAuth, []string{"invalid api key", "authentication_error", "authentication failed", "oauth token has expired", "please run /login", "api error: 401"}},
+	{ErrBilling, []string{"credit balance is too low", "billing_error", "exceeded your current quota", "insufficient balance", "usage limit reached", "api error: 402"}},
+	{ErrRateLimited, []string{"rate_limit", "rate limit", "api error: 429"}},
+	{ErrOverloaded, []string{"overloaded", "api error: 529", "api error: 503"}},
+	{ErrServer, []string{"internal server error", "api error: 500", "api error: 502"}},
+	{ErrInvalidRequest, []string{"invalid_request", "prompt is too long", "api error: 400"}},
+}
+
+// classifyMessage guesses an error kind from free-form error text.
+// 文本中嵌有 API 错误 JSON 时优先使用其 type / error 字段，否则按 messageErrorPatterns 匹配。
+// 参数：text 为错误文本。
+// 返回：匹配到的错误分类，未匹配时为 nil。
+func classifyMessage(text string) error {
+	if kind := structuredErrorKind(text); kind != nil {
+		return kind
+	}
+	lower := strings.ToLower(text)
+	for _, entry := range messageErrorPatterns {
+		for _, pattern := range entry.patterns {
+			if strings.Contains(lower, pattern) {
+				return entry.kind
+			}
+		}
+	}
+	return nil
+}
+
+// structuredErrorKind classifies the first JSON object embedded in text,
+// e.g. `API Error: 401 {"type":"error","error":{"type":"authentication_error",...}}`.
+// 返回：无法解析或类型未知时为 nil。
+func structuredErrorKind(text string) error {
+	start := strings.IndexByte(text, '{')
+	if start < 0 {
+		return nil
+	}
+	var body struct {
+		Type  string          `json:"type"`
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.NewDecoder(strings.NewReader(text[start:])).Decode(&body); err != nil {
+		return nil
+	}
+	var nested struct {
+		Type string `json:"type"`
+	}
+	var code string
+	switch {
+	case json.Unmarshal(body.Error, &nested) == nil && nested.Type != "":
+		return apiErrorKinds[nested.Type]
+	case json.Unmarshal(body.Error, &code) == nil && code != "":
+		// 与 assistant 消息的 error 字段取值相同。
+		return assistantErrorKinds[code]
+	default:
+		return apiErrorKinds[body.Type]
+	}
+}
+
+// resultError builds a CLIError from a failed result message.
+// 参数：result 为 result 消息，apiErr 为本轮 assistant 消息上报的 API 错误分类（可为空）。
+// 返回：失败时的 *CLIError，成功时为 nil。
+func resultError(result *stream.ResultEvent, apiErr error) *CLIError {
+	if !result.IsError && !strings.HasPrefix(result.Subtype, "error") {
+		return nil
+	}
+
+	message := result.Result
+	var texts []string
+	for _, e := range result.Errors {
+		if e != "" {
+			texts = append(texts, e)
+		}
+	}
+	if len(texts) > 0 {
+		message = strings.Join(texts, "; ")
+	}
+
+	kind := resultErrorKinds[result.Subtype]
+	if kind == nil {
+		kind = apiErr
+	}
+	if kind == nil {
+		kind = classifyMessage(message)
+	}
+	if kind == nil {
+		kind = ErrExecution
+	}
+	return &CLIError{Kind: kind, Subtype: result.Subtype, Message: message}
+}
+
+// processError builds a CLIError for a CLI that exited without a usable result.
+// 参数：err 为进程退出错误，stderr 为标准错误输出。
+// 返回：*CLIError。
+func processError(err error, stderr string) *CLIError {
+	kind := classifyMessage(stderr)
+	if kind == nil {
+		kind = ErrCLIFailed
+	}
+	return &CLIError{Kind: kind, Stderr: stderr, Err: err}
+}
@@ -0,0 +1,110 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+)
+
+func TestReadStreamResultErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		stream  string
+		kind    error
+		subtype string
+	}{
+		{
+			name:    "max turns",
+			stream:  `{"type":"result","subtype":"error_max_turns","is_error":true,"num_turns":3}`,
+			kind:    ErrMaxTurns,
+			subtype: "error_max_turns",
+		},
+		{
+			name:    "execution",
+			stream:  `{"type":"result","subtype":"error_during_execution","is_error":true,"errors":["tool crashed"]}`,
+			kind:    ErrExecution,
+			subtype: "error_during_execution",
+		},
+		{
+			name: "assistant api error",
+			stream: `{"type":"assistant","error":"rate_limit","message":{"content":[{"type":"text","text":"API Error: 429"}]}}` + "\n" +
+				`{"type":"result","subtype":"success","is_error":true,"result":"API Error: 429"}`,
+			kind:    ErrRateLimited,
+			subtype: "success",
+		},
+		{
+			name: "assistant server error",
+			stream: `{"type":"assistant","error":"server_error","message":{"content":[{"type":"text","text":"API Error: 500"}]}}` + "\n" +
+				`{"type":"result","subtype":"success","is_error":true,"result":"API Error: 500"}`,
+			kind:    ErrServer,
+			subtype: "success",
+		},
+		{
+			name:    "result text",
+			stream:  `{"type":"result","subtype":"success","is_error":true,"result":"Invalid API key · Please run /login"}`,
+			kind:    ErrAuth,
+			subtype: "success",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			llm := &LLM{}
+			_, _, err := llm.readStream(context.Background(), strings.NewReader(tc.stream+"\n"), nil)
+			if !errors.Is(err, tc.kind) {
+				t.Fatalf("expected %v, got %v", tc.kind, err)
+			}
+			var cliErr *CLIError
+			if !errors.As(err, &cliErr) || cliErr.Subtype != tc.subtype {
+				t.Fatalf("unexpected CLIError: %#v", err)
+			}
+		})
+	}
+
+	llm := &LLM{}
+	if _, _, err := llm.readStream(context.Background(), strings.NewReader(`{"type":"result","subtype":"success","result":"ok"}`+"\n"), nil); err != nil {
+		t.Fatalf("unexpected error for success result: %v", err)
+	}
+}
+
+func TestClassifyMessage(t *testing.T) {
+	cases := []struct {
+		text string
+		kind error
+	}{
+		{"Invalid API key · Please run /login", ErrAuth},
+		{"OAuth token has expired. Please obtain a new token or refresh your existing token.", ErrAuth},
+		{`API Error: 401 {"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`, ErrAuth},
+		{"Credit balance is too low", ErrBilling},
+		{`API Error: 400 {"type":"error","error":{"type":"invalid_request_error","message":"Your credit balance is too low"}}`, ErrInvalidRequest},
+		{`{"error":"rate_limit"}`, ErrRateLimited},
+		{`API Error: 529 {"type":"overloaded_error"}`, ErrOverloaded},
+		{"Claude AI usage limit reached|1760000000", ErrBilling},
+		// 普通文本中出现的斜杠命令或 quota 一词不应被归为认证或计费错误。
+		{"Tool failed: /login route returned 404 while testing the quota page", nil},
+		{"error: disk quota exceeded", nil},
+	}
+	for _, tc := range cases {
+		if got := classifyMessage(tc.text); got != tc.kind {
+			t.Errorf("classifyMessage(%q) = %v, want %v", tc.text, got, tc.kind)
+		}
+	}
+}
+
+func TestGenerateContentClassifiesStderr(t *testing.T) {
+	fake := claudetest.New(t).Replay().Stderr("Error: API Error: 529 {\"type\":\"overloaded_error\"}\n").ExitCode(1)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = llm.Call(context.Background(), "你好")
+	if !errors.Is(err, ErrOverloaded) {
+		t.Fatalf("expected ErrOverloaded, got %v", err)
+	}
+	var exitErr interface{ ExitCode() int }
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("expected wrapped exit error, got %v", err)
+	}
+}
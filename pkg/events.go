@@ -0,0 +1,122 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// EventType 结构化事件类型。
+type EventType int
+
+const (
+	// EventSystem CLI system 消息（如 init，包含 session_id、工具与 MCP 状态）。
+	EventSystem EventType = iota
+	// EventText 文本片段（开启 PartialMessages 时为 token 增量）。
+	EventText
+	// EventThinking thinking 片段，与 ThinkingTags 设置无关。
+	EventThinking
+	// EventToolUse 工具调用请求。
+	EventToolUse
+	// EventToolResult 工具执行结果。
+	EventToolResult
+	// EventResult 本轮结束，Response 为汇总结果。
+	EventResult
+	// EventError 调用失败，Err 为错误原因。
+	EventError
+)
+
+// String 返回 EventType 的字符串表示。
+func (t EventType) String() string {
+	switch t {
+	case EventSystem:
+		return "system"
+	case EventText:
+		return "text"
+	case EventThinking:
+		return "thinking"
+	case EventToolUse:
+		return "tool_use"
+	case EventToolResult:
+		return "tool_result"
+	case EventResult:
+		return "result"
+	case EventError:
+		return "error"
+	default:
+		return "unknown"
+	}
+}
+
+// Event 为 LLM.Stream 按顺序推送的结构化事件。
+type Event struct {
+	Type      EventType
+	Text      string                // EventText / EventThinking 的内容
+	Tool      *ToolEvent            // EventToolUse / EventToolResult 的工具信息
+	Response  *llms.ContentResponse // EventResult 的汇总结果
+	Err       error                 // EventError 的错误
+	SessionID string                // CLI 上报的会话 ID
+	Raw       map[string]any        // 原始 stream-json 负载（EventResult / EventError 为空）
+	Timestamp time.Time             // 事件时间戳
+}
+
+// eventSink 接收解析过程中产生的结构化事件，返回错误时中止解析。
+type eventSink func(Event) error
+
+// streamEventBuffer 为事件通道容量；消费者跟不上时解析会阻塞，形成背压。
+const streamEventBuffer = 16
+
+// Stream runs the messages like GenerateContent but delivers every parsed
+// event in order on the returned channel. The channel is closed after a final
+// EventResult or EventError. A slow consumer blocks parsing of CLI output;
+// cancelling ctx stops the CLI, sends an EventError carrying ctx.Err() and
+// closes the channel. 取消后消费者可能已停止读取，该事件以非阻塞方式发送，
+// 仅在通道缓冲已满时丢弃。
+// 参数：ctx 为上下文，messages 为对话消息，options 为调用参数。
+// 返回：事件通道与错误。
+func (l *LLM) Stream(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (<-chan Event, error) { //nolint:lll
+	if l == nil {
+		return nil, errors.New("claude code: nil receiver")
+	}
+
+	events := make(chan Event, streamEventBuffer)
+	sessionID := ""
+	send := func(event Event) error {
+		if event.SessionID != "" {
+			sessionID = event.SessionID
+		} else {
+			event.SessionID = sessionID
+		}
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	go func() {
+		defer close(events)
+		resp, err := l.generate(ctx, messages, options, send)
+		final := Event{Type: EventResult, Response: resp, Timestamp: time.Now()}
+		if err != nil {
+			final = Event{Type: EventError, Err: err, Timestamp: time.Now()}
+		}
+		if ctx.Err() == nil {
+			_ = send(final)
+			return
+		}
+		// 取消后 send 会立即放弃，改为非阻塞写入，避免消费者离开后 goroutine 泄漏。
+		if final.Type == EventError {
+			final.Err = ctx.Err()
+		}
+		final.SessionID = sessionID
+		select {
+		case events <- final:
+		default:
+		}
+	}()
+	return events, nil
+}
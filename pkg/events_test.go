@@ -0,0 +1,100 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestStreamDeliversEventsInOrder(t *testing.T) {
+	fake := claudetest.New(t).Replay(
+		`{"type":"system","subtype":"init","session_id":"sess-1"}`,
+		`{"type":"assistant","message":{"content":[{"type":"thinking","thinking":"想一想"}]}}`,
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"a.txt"}}]}}`,
+		`{"type":"tool_result","tool_use_id":"toolu_1","content":"hello"}`,
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"完成"}]}}`,
+		`{"type":"result","subtype":"success","session_id":"sess-1","result":"完成"}`,
+	)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	events, err := llm.Stream(context.Background(), []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "读取 a.txt"),
+	})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+
+	var got []Event
+	for event := range events {
+		got = append(got, event)
+	}
+	want := []EventType{EventSystem, EventThinking, EventToolUse, EventToolResult, EventText, EventResult}
+	if len(got) != len(want) {
+		t.Fatalf("unexpected events: %+v", got)
+	}
+	for i, event := range got {
+		if event.Type != want[i] {
+			t.Fatalf("event %d: got %s, want %s", i, event.Type, want[i])
+		}
+		if event.SessionID != "sess-1" {
+			t.Fatalf("event %d: unexpected session id %q", i, event.SessionID)
+		}
+	}
+	if got[1].Text != "想一想" || got[2].Tool.ToolName != "Read" || got[3].Tool.Output != "hello" {
+		t.Fatalf("unexpected event payloads: %+v %+v %+v", got[1], got[2].Tool, got[3].Tool)
+	}
+	if resp := got[5].Response; resp == nil || resp.Choices[0].Content != "完成" {
+		t.Fatalf("unexpected final response: %+v", got[5].Response)
+	}
+}
+
+func TestStreamReportsErrorEvent(t *testing.T) {
+	llm, err := New(WithCLIPath(claudetest.New(t).Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	events, err := llm.Stream(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	var last Event
+	for event := range events {
+		last = event
+	}
+	if last.Type != EventError || !errors.Is(last.Err, ErrEmptyPrompt) {
+		t.Fatalf("expected empty prompt error event, got %+v", last)
+	}
+}
+
+func TestStreamReportsCancellation(t *testing.T) {
+	fake := claudetest.New(t).Replay(`{"type":"system","subtype":"init","session_id":"sess-1"}`).HangAfter(1)
+	llm, err := New(WithCLIPath(fake.Path), WithCancelGracePeriod(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := llm.Stream(ctx, []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "长任务")})
+	if err != nil {
+		t.Fatalf("Stream: %v", err)
+	}
+	if first := <-events; first.Type != EventSystem {
+		t.Fatalf("unexpected first event: %+v", first)
+	}
+	cancel()
+
+	var last Event
+	for event := range events {
+		last = event
+	}
+	if last.Type != EventError || !errors.Is(last.Err, context.Canceled) || last.SessionID != "sess-1" {
+		t.Fatalf("expected cancellation error event, got %+v", last)
+	}
+}
@@ -0,0 +1,151 @@
+package claudecode
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// HistoryStrategy 控制恢复会话时发送多少对话历史。
+type HistoryStrategy int
+
+const (
+	// HistoryFull 始终按角色扁平化发送全部历史 (默认行为)。
+	HistoryFull HistoryStrategy = iota
+	// HistoryLastTurn 恢复会话时只发送最后一条 AI 消息之后的内容。
+	HistoryLastTurn
+	// HistoryDiff 恢复会话时只发送该会话尚未包含的消息；
+	// 无法比对（如历史被修改或进程重启）时退化为 HistoryLastTurn。
+	HistoryDiff
+)
+
+// String 返回 HistoryStrategy 的字符串表示。
+func (s HistoryStrategy) String() string {
+	switch s {
+	case HistoryFull:
+		return "full"
+	case HistoryLastTurn:
+		return "last_turn"
+	case HistoryDiff:
+		return "diff"
+	default:
+		return "unknown"
+	}
+}
+
+// maxTrackedSessions 限制 HistoryDiff 记录的会话数量。
+const maxTrackedSessions = 4096
+
+// historyTracker 记录各会话已包含的消息，供 HistoryDiff 比对。
+type historyTracker struct {
+	mu       sync.Mutex
+	sessions map[string]historyMark
+}
+
+// historyMark 为会话已包含的消息数量及其指纹。
+type historyMark struct {
+	count       int
+	fingerprint [sha256.Size]byte
+}
+
+func newHistoryTracker() *historyTracker {
+	return &historyTracker{sessions: make(map[string]historyMark)}
+}
+
+// record remembers that sessionID now contains messages.
+// 参数：sessionID 为 CLI 上报的会话 ID，messages 为本轮发送前的完整非系统消息。
+func (t *historyTracker) record(sessionID string, messages []llms.MessageContent) {
+	if t == nil || sessionID == "" {
+		return
+	}
+	fingerprint, ok := fingerprintMessages(messages)
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.sessions[sessionID]; !exists && len(t.sessions) >= maxTrackedSessions {
+		for k := range t.sessions {
+			delete(t.sessions, k)
+			break
+		}
+	}
+	t.sessions[sessionID] = historyMark{count: len(messages), fingerprint: fingerprint}
+}
+
+// diff returns the messages sessionID has not seen yet.
+// 参数：sessionID 为恢复的会话 ID，messages 为完整非系统消息。
+// 返回：新增消息（跳过会话自身产生的 AI 回复）与是否比对成功。
+func (t *historyTracker) diff(sessionID string, messages []llms.MessageContent) ([]llms.MessageContent, bool) {
+	if t == nil || sessionID == "" {
+		return nil, false
+	}
+	t.mu.Lock()
+	mark, ok := t.sessions[sessionID]
+	t.mu.Unlock()
+	if !ok || len(messages) < mark.count {
+		return nil, false
+	}
+	if fingerprint, ok := fingerprintMessages(messages[:mark.count]); !ok || fingerprint != mark.fingerprint {
+		return nil, false
+	}
+	rest := messages[mark.count:]
+	for len(rest) > 0 && rest[0].Role == llms.ChatMessageTypeAI {
+		rest = rest[1:]
+	}
+	if len(rest) == 0 {
+		return nil, false
+	}
+	return rest, true
+}
+
+// fingerprintMessages hashes messages for prefix comparison.
+func fingerprintMessages(messages []llms.MessageContent) ([sha256.Size]byte, bool) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return [sha256.Size]byte{}, false
+	}
+	return sha256.Sum256(data), true
+}
+
+// selectHistory picks the messages to send according to HistoryStrategy.
+// 参数：messages 为完整非系统消息。
+// 返回：待发送消息，以及是否仅为本轮内容（无需角色前缀）。
+func (l *LLM) selectHistory(messages []llms.MessageContent) ([]llms.MessageContent, bool) {
+	if !l.opts.Resume {
+		return messages, false
+	}
+	switch l.opts.HistoryStrategy {
+	case HistoryDiff:
+		if rest, ok := l.history.diff(l.opts.SessionID, messages); ok {
+			// 新增部分若包含 AI 消息（如调用方注入的回复），需保留角色前缀。
+			return rest, len(pendingTurn(rest)) == len(rest)
+		}
+		return pendingTurn(messages), true
+	case HistoryLastTurn:
+		return pendingTurn(messages), true
+	default:
+		return messages, false
+	}
+}
+
+// buildTurnPrompt joins the text of one turn without role prefixes.
+// 参数：messages 为本轮消息。
+// 返回：prompt 与错误。
+func buildTurnPrompt(messages []llms.MessageContent) (string, error) {
+	parts := make([]string, 0, len(messages))
+	for _, msg := range messages {
+		text, err := messageToText(msg)
+		if err != nil {
+			return "", fmt.Errorf("claude code: build turn prompt: %w", err)
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			parts = append(parts, text)
+		}
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
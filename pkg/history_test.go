@@ -0,0 +1,64 @@
+package claudecode
+
+import (
+	"context"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestHistoryStrategies(t *testing.T) {
+	fake := claudetest.New(t).Replay(`{"type":"result","subtype":"success","session_id":"sess-1","result":"ok"}`)
+	human := func(text string) llms.MessageContent { return llms.TextParts(llms.ChatMessageTypeHuman, text) }
+	ai := func(text string) llms.MessageContent { return llms.TextParts(llms.ChatMessageTypeAI, text) }
+	resume := WithCallOptions(WithSessionID("sess-1"), WithResume(true))
+
+	run := func(t *testing.T, llm *LLM, messages []llms.MessageContent, options ...llms.CallOption) string {
+		t.Helper()
+		if _, err := llm.GenerateContent(context.Background(), messages, options...); err != nil {
+			t.Fatalf("GenerateContent: %v", err)
+		}
+		return fake.LastInvocation().Prompt()
+	}
+	history := []llms.MessageContent{human("a"), ai("x"), human("b"), human("c")}
+
+	t.Run("full", func(t *testing.T) {
+		llm, _ := New(WithCLIPath(fake.Path))
+		if got := run(t, llm, history, resume); got != "User: a\n\nAssistant: x\n\nUser: b\n\nUser: c" {
+			t.Fatalf("unexpected prompt: %q", got)
+		}
+	})
+
+	t.Run("last turn", func(t *testing.T) {
+		llm, _ := New(WithCLIPath(fake.Path), WithHistoryStrategy(HistoryLastTurn))
+		if got := run(t, llm, history, resume); got != "b\n\nc" {
+			t.Fatalf("unexpected prompt: %q", got)
+		}
+		// 未恢复会话时仍发送完整历史。
+		if got := run(t, llm, history); got != "User: a\n\nAssistant: x\n\nUser: b\n\nUser: c" {
+			t.Fatalf("unexpected prompt without resume: %q", got)
+		}
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		llm, _ := New(WithCLIPath(fake.Path), WithHistoryStrategy(HistoryDiff))
+		if got := run(t, llm, []llms.MessageContent{human("a")}); got != "User: a" {
+			t.Fatalf("unexpected first prompt: %q", got)
+		}
+		// 会话已包含 a 及其回复；调用方注入的 AI 消息需带角色发送。
+		injected := []llms.MessageContent{human("a"), ai("x"), human("b"), ai("y"), human("c")}
+		if got := run(t, llm, injected, resume); got != "User: b\n\nAssistant: y\n\nUser: c" {
+			t.Fatalf("unexpected diff prompt: %q", got)
+		}
+		next := append(injected, ai("z"), human("d"))
+		if got := run(t, llm, next, resume); got != "d" {
+			t.Fatalf("unexpected follow-up prompt: %q", got)
+		}
+		// 历史被修改时退化为只发送本轮。
+		edited := []llms.MessageContent{human("changed"), ai("x"), human("e")}
+		if got := run(t, llm, edited, resume); got != "e" {
+			t.Fatalf("unexpected fallback prompt: %q", got)
+		}
+	})
+}
@@ -0,0 +1,331 @@
+package claudecode
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ErrAttachmentTooLarge is returned when an image or binary part exceeds MaxAttachmentSize.
+var ErrAttachmentTooLarge = errors.New("claude code: attachment too large")
+
+// pendingTurn returns the messages after the last AI reply.
+// 参数：messages 为非系统消息。
+// 返回：尚未被模型回复的消息。
+func pendingTurn(messages []llms.MessageContent) []llms.MessageContent {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == llms.ChatMessageTypeAI {
+			return messages[i+1:]
+		}
+	}
+	return messages
+}
+
+// hasToolResponses reports whether any message carries llms.ToolCallResponse parts.
+// 参数：messages 为待检查的消息。
+// 返回：是否包含工具结果。
+func hasToolResponses(messages []llms.MessageContent) bool {
+	for _, msg := range messages {
+		for _, part := range msg.Parts {
+			if _, ok := part.(llms.ToolCallResponse); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAttachments reports whether any message carries image or binary parts.
+// 参数：messages 为待检查的消息。
+// 返回：是否包含附件。
+func hasAttachments(messages []llms.MessageContent) bool {
+	for _, msg := range messages {
+		for _, part := range msg.Parts {
+			switch part.(type) {
+			case llms.ImageURLContent, llms.BinaryContent:
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// contentBuilder 将 llms.MessageContent 转换为 stream-json content blocks。
+// 无法作为 content block 发送的附件写入临时目录，供 CLI 的 Read 工具读取。
+type contentBuilder struct {
+	maxAttachmentSize int
+	// dir 为附件临时目录，为空时按需创建并由 Close 删除。
+	dir     string
+	ownsDir bool
+}
+
+// newContentBuilder creates a builder bound to the LLM options.
+// 参数：dir 为附件目录，为空时按需创建临时目录。
+// 返回：*contentBuilder。
+func (l *LLM) newContentBuilder(dir string) *contentBuilder {
+	maxSize := l.opts.MaxAttachmentSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxAttachmentSize
+	}
+	return &contentBuilder{maxAttachmentSize: maxSize, dir: dir}
+}
+
+// Close removes the attachment directory created by the builder.
+func (b *contentBuilder) Close() {
+	if b != nil && b.ownsDir && b.dir != "" {
+		_ = os.RemoveAll(b.dir)
+	}
+}
+
+// build converts messages into content blocks.
+// 文本合并为 text block，llms.ToolCallResponse 转为 tool_result block
+// （扁平化历史时对应的 tool_use 不在 CLI 会话中，按 "[ToolResult:name] ..." 文本发送），
+// 图片与二进制内容转为 image/document block 或临时文件引用。
+// 参数：messages 为待发送消息，withRoles 为是否在文本前加 "User:" 等角色前缀（扁平化历史时使用）。
+// 返回：content blocks 与错误。
+func (b *contentBuilder) build(messages []llms.MessageContent, withRoles bool) ([]map[string]any, error) {
+	var blocks []map[string]any
+	var texts []string
+
+	flushText := func() {
+		if len(texts) == 0 {
+			return
+		}
+		blocks = append(blocks, map[string]any{"type": "text", "text": strings.Join(texts, "\n\n")})
+		texts = nil
+	}
+
+	for _, msg := range messages {
+		prefix := ""
+		if withRoles {
+			prefix = rolePrefix(msg.Role)
+		}
+		var msgTexts []string
+		flushMessage := func() {
+			text := strings.TrimSpace(strings.Join(msgTexts, "\n"))
+			msgTexts = nil
+			if text == "" {
+				return
+			}
+			if prefix != "" {
+				text = fmt.Sprintf("%s: %s", prefix, text)
+				prefix = ""
+			}
+			texts = append(texts, text)
+		}
+
+		for _, part := range msg.Parts {
+			var block map[string]any
+			switch p := part.(type) {
+			case llms.ToolCallResponse:
+				if withRoles {
+					text, err := messageToText(llms.MessageContent{Role: msg.Role, Parts: []llms.ContentPart{part}})
+					if err != nil {
+						return nil, err
+					}
+					msgTexts = append(msgTexts, text)
+					continue
+				}
+				block = map[string]any{
+					"type":        "tool_result",
+					"tool_use_id": p.ToolCallID,
+					"content":     p.Content,
+				}
+			case llms.ImageURLContent:
+				var err error
+				if block, err = b.imageURLBlock(p); err != nil {
+					return nil, err
+				}
+			case llms.BinaryContent:
+				var err error
+				if block, err = b.binaryBlock(p.MIMEType, p.Data); err != nil {
+					return nil, err
+				}
+			default:
+				text, err := messageToText(llms.MessageContent{Role: msg.Role, Parts: []llms.ContentPart{part}})
+				if err != nil {
+					return nil, err
+				}
+				msgTexts = append(msgTexts, text)
+				continue
+			}
+			if block["type"] == "text" {
+				// 临时文件引用按普通文本拼接。
+				msgTexts = append(msgTexts, block["text"].(string))
+				continue
+			}
+			flushMessage()
+			flushText()
+			blocks = append(blocks, block)
+		}
+		flushMessage()
+	}
+	flushText()
+	return blocks, nil
+}
+
+// imageURLBlock converts an image URL part into an image content block.
+// 参数：p 为图片 URL，支持 data: URL 与 http(s) URL。
+// 返回：content block 与错误。
+func (b *contentBuilder) imageURLBlock(p llms.ImageURLContent) (map[string]any, error) {
+	if !strings.HasPrefix(p.URL, "data:") {
+		if !strings.HasPrefix(p.URL, "http://") && !strings.HasPrefix(p.URL, "https://") {
+			return nil, fmt.Errorf("claude code: unsupported image url: %q", truncateForError(p.URL))
+		}
+		return map[string]any{
+			"type":   "image",
+			"source": map[string]any{"type": "url", "url": p.URL},
+		}, nil
+	}
+
+	// data:[<mediatype>][;base64],<data>
+	header, payload, ok := strings.Cut(strings.TrimPrefix(p.URL, "data:"), ",")
+	if !ok {
+		return nil, errors.New("claude code: malformed data url")
+	}
+	mediaType, _, _ := strings.Cut(header, ";")
+	var data []byte
+	if strings.HasSuffix(header, ";base64") {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(payload); err != nil {
+			return nil, fmt.Errorf("claude code: decode data url: %w", err)
+		}
+	} else {
+		unescaped, err := url.PathUnescape(payload)
+		if err != nil {
+			return nil, fmt.Errorf("claude code: decode data url: %w", err)
+		}
+		data = []byte(unescaped)
+	}
+	return b.binaryBlock(mediaType, data)
+}
+
+// binaryBlock converts raw bytes into an image/document block or a temp file reference.
+// 参数：mimeType 为声明的 MIME 类型（可为空），data 为内容。
+// 返回：content block 与错误。
+func (b *contentBuilder) binaryBlock(mimeType string, data []byte) (map[string]any, error) {
+	if len(data) > b.maxAttachmentSize {
+		return nil, fmt.Errorf("%w: %d bytes (limit %d)", ErrAttachmentTooLarge, len(data), b.maxAttachmentSize)
+	}
+
+	mediaType := sniffMediaType(mimeType, data)
+	switch {
+	case supportedImageTypes[mediaType]:
+		return map[string]any{
+			"type":   "image",
+			"source": map[string]any{"type": "base64", "media_type": mediaType, "data": base64.StdEncoding.EncodeToString(data)},
+		}, nil
+	case mediaType == "application/pdf":
+		return map[string]any{
+			"type":   "document",
+			"source": map[string]any{"type": "base64", "media_type": mediaType, "data": base64.StdEncoding.EncodeToString(data)},
+		}, nil
+	case mediaType == "text/plain" && utf8.Valid(data):
+		return map[string]any{
+			"type":   "document",
+			"source": map[string]any{"type": "text", "media_type": mediaType, "data": string(data)},
+		}, nil
+	}
+
+	// 其余类型写入临时文件，由 Claude 通过 Read 工具按需读取。
+	path, err := b.writeAttachment(mediaType, data)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]any{
+		"type": "text",
+		"text": fmt.Sprintf("[Attachment: %s (%s, %d bytes)]", path, mediaType, len(data)),
+	}, nil
+}
+
+// writeAttachment writes data into the attachment directory.
+// 参数：mediaType 用于推断文件扩展名，data 为内容。
+// 返回：文件路径与错误。
+func (b *contentBuilder) writeAttachment(mediaType string, data []byte) (string, error) {
+	if b.dir == "" {
+		dir, err := os.MkdirTemp("", "claudecode-attachments-")
+		if err != nil {
+			return "", fmt.Errorf("claude code: create attachment dir: %w", err)
+		}
+		b.dir = dir
+		b.ownsDir = true
+	}
+
+	ext := ""
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) > 0 {
+		ext = exts[0]
+	}
+	file, err := os.CreateTemp(b.dir, "attachment-*"+ext)
+	if err != nil {
+		return "", fmt.Errorf("claude code: create attachment: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return "", fmt.Errorf("claude code: write attachment: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("claude code: write attachment: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// supportedImageTypes 为 Claude 支持以 image block 发送的图片类型。
+var supportedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// sniffMediaType determines the media type from the declared type or content.
+// 参数：declared 为调用方声明的 MIME 类型，data 为内容。
+// 返回：不含参数的 MIME 类型。
+func sniffMediaType(declared string, data []byte) string {
+	mediaType := strings.ToLower(strings.TrimSpace(declared))
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType = http.DetectContentType(data)
+	}
+	if parsed, _, err := mime.ParseMediaType(mediaType); err == nil {
+		mediaType = parsed
+	}
+	return mediaType
+}
+
+// truncateForError shortens long values embedded in error messages.
+func truncateForError(s string) string {
+	if len(s) > 64 {
+		return s[:61] + "..."
+	}
+	return s
+}
+
+// encodeUserMessage encodes content blocks as one stream-json user message line.
+// 参数：content 为 content blocks，sessionID 为已知会话 ID（可为空）。
+// 返回：以换行结尾的 JSON 行与错误。
+func encodeUserMessage(content []map[string]any, sessionID string) ([]byte, error) {
+	payload := map[string]any{
+		"type": "user",
+		"message": map[string]any{
+			"role":    "user",
+			"content": content,
+		},
+		"parent_tool_use_id": nil,
+	}
+	if sessionID != "" {
+		payload["session_id"] = sessionID
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("claude code: encode user message: %w", err)
+	}
+	return append(data, '\n'), nil
+}
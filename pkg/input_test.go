@@ -0,0 +1,163 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestContentBuilderPendingTurn(t *testing.T) {
+	content, err := (&LLM{}).newContentBuilder("").build(pendingTurn([]llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "旧问题"),
+		llms.TextParts(llms.ChatMessageTypeAI, "旧回答"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "新问题"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "补充"),
+	}), false)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(content) != 1 || content[0]["text"] != "新问题\n\n补充" {
+		t.Fatalf("unexpected content: %v", content)
+	}
+}
+
+func TestContentBuilderToolResults(t *testing.T) {
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "上海天气？"),
+		{Role: llms.ChatMessageTypeAI, Parts: []llms.ContentPart{llms.ToolCall{
+			ID: "toolu_1", Type: "function",
+			FunctionCall: &llms.FunctionCall{Name: "get_weather", Arguments: `{"city":"上海"}`},
+		}}},
+		{Role: llms.ChatMessageTypeTool, Parts: []llms.ContentPart{llms.ToolCallResponse{
+			ToolCallID: "toolu_1", Name: "get_weather", Content: "晴天",
+		}}},
+	}
+	turn := pendingTurn(messages)
+	if !hasToolResponses(turn) {
+		t.Fatalf("expected tool responses in pending turn")
+	}
+	content, err := (&LLM{}).newContentBuilder("").build(turn, false)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(content) != 1 || content[0]["type"] != "tool_result" || content[0]["tool_use_id"] != "toolu_1" || content[0]["content"] != "晴天" {
+		t.Fatalf("unexpected content: %v", content)
+	}
+}
+
+func TestContentBuilderAttachments(t *testing.T) {
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+	messages := []llms.MessageContent{
+		{Role: llms.ChatMessageTypeHuman, Parts: []llms.ContentPart{
+			llms.TextContent{Text: "看看这张截图"},
+			llms.BinaryContent{Data: png},
+			llms.ImageURLContent{URL: "https://example.com/a.jpg"},
+			llms.ImageURLContent{URL: "data:image/gif;base64,R0lGODlhAQABAAAAACw="},
+			llms.BinaryContent{MIMEType: "application/pdf", Data: []byte("%PDF-1.4")},
+			llms.BinaryContent{MIMEType: "application/zip", Data: []byte("PK\x03\x04")},
+		}},
+	}
+	if !hasAttachments(messages) {
+		t.Fatalf("expected attachments")
+	}
+
+	builder := (&LLM{}).newContentBuilder("")
+	content, err := builder.build(messages, true)
+	if err != nil {
+		t.Fatalf("build: %v", err)
+	}
+	if len(content) != 6 {
+		t.Fatalf("unexpected block count %d: %v", len(content), content)
+	}
+	if content[0]["text"] != "User: 看看这张截图" {
+		t.Fatalf("unexpected text block: %v", content[0])
+	}
+	source := content[1]["source"].(map[string]any)
+	if content[1]["type"] != "image" || source["media_type"] != "image/png" || source["type"] != "base64" {
+		t.Fatalf("unexpected sniffed image block: %v", content[1])
+	}
+	if content[2]["source"].(map[string]any)["url"] != "https://example.com/a.jpg" {
+		t.Fatalf("unexpected url image block: %v", content[2])
+	}
+	if content[3]["source"].(map[string]any)["media_type"] != "image/gif" {
+		t.Fatalf("unexpected data url block: %v", content[3])
+	}
+	if content[4]["type"] != "document" {
+		t.Fatalf("unexpected pdf block: %v", content[4])
+	}
+	ref, _ := content[5]["text"].(string)
+	if !strings.HasPrefix(ref, "[Attachment: "+builder.dir) || !strings.Contains(ref, "application/zip") {
+		t.Fatalf("unexpected attachment reference: %v", content[5])
+	}
+	if _, err := os.Stat(builder.dir); err != nil {
+		t.Fatalf("attachment dir missing: %v", err)
+	}
+	builder.Close()
+	if _, err := os.Stat(builder.dir); !os.IsNotExist(err) {
+		t.Fatalf("attachment dir not removed: %v", err)
+	}
+}
+
+func TestContentBuilderAttachmentTooLarge(t *testing.T) {
+	llm := &LLM{opts: Options{MaxAttachmentSize: 4}}
+	_, err := llm.newContentBuilder("").build([]llms.MessageContent{
+		{Role: llms.ChatMessageTypeHuman, Parts: []llms.ContentPart{llms.BinaryContent{MIMEType: "image/png", Data: []byte("12345")}}},
+	}, false)
+	if !errors.Is(err, ErrAttachmentTooLarge) {
+		t.Fatalf("expected ErrAttachmentTooLarge, got %v", err)
+	}
+}
+
+func TestGenerateContentFlattensToolResultsWithAttachments(t *testing.T) {
+	fake := claudetest.New(t)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 16)...)
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "上海天气？"),
+		{Role: llms.ChatMessageTypeAI, Parts: []llms.ContentPart{llms.ToolCall{
+			ID: "toolu_1", Type: "function",
+			FunctionCall: &llms.FunctionCall{Name: "get_weather", Arguments: `{"city":"上海"}`},
+		}}},
+		{Role: llms.ChatMessageTypeTool, Parts: []llms.ContentPart{llms.ToolCallResponse{
+			ToolCallID: "toolu_1", Name: "get_weather", Content: "晴天",
+		}}},
+		llms.TextParts(llms.ChatMessageTypeAI, "上海晴天。"),
+		{Role: llms.ChatMessageTypeHuman, Parts: []llms.ContentPart{
+			llms.TextContent{Text: "这是截图"},
+			llms.BinaryContent{Data: png},
+		}},
+	}
+	if _, err := llm.GenerateContent(context.Background(), messages); err != nil {
+		t.Fatalf("GenerateContent: %v", err)
+	}
+
+	lines := fake.LastInvocation().StdinLines()
+	if len(lines) != 1 {
+		t.Fatalf("unexpected stdin: %q", lines)
+	}
+	var msg struct {
+		Message struct {
+			Content []map[string]any `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &msg); err != nil {
+		t.Fatalf("decode stdin: %v", err)
+	}
+	content := msg.Message.Content
+	if len(content) != 2 || content[0]["type"] != "text" || content[1]["type"] != "image" {
+		t.Fatalf("unexpected content: %v", content)
+	}
+	text, _ := content[0]["text"].(string)
+	if !strings.Contains(text, "Tool: [ToolResult:get_weather] 晴天") || !strings.Contains(text, "User: 这是截图") {
+		t.Fatalf("tool result not flattened: %q", text)
+	}
+}
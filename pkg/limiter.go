@@ -0,0 +1,203 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the limiter queue has reached MaxQueued.
+	ErrQueueFull = errors.New("claude code: limiter queue full")
+	// ErrQueueTimeout is returned when a call waits longer than QueueTimeout.
+	ErrQueueTimeout = errors.New("claude code: limiter queue timeout")
+)
+
+// Priority 为排队调用的优先级，高优先级先出队，同优先级先进先出。
+type Priority int
+
+const (
+	// PriorityLow 后台任务等低优先级调用。
+	PriorityLow Priority = -1
+	// PriorityNormal 默认优先级。
+	PriorityNormal Priority = 0
+	// PriorityHigh 交互式对话等高优先级调用。
+	PriorityHigh Priority = 1
+)
+
+// LimiterConfig 配置 Limiter。
+type LimiterConfig struct {
+	// MaxRunning 为同时运行的 CLI 进程上限，<= 0 时为 1。
+	MaxRunning int
+	// MaxQueued 为排队调用上限，超出时返回 ErrQueueFull；0 表示不限。
+	MaxQueued int
+	// QueueTimeout 为最长排队时间，超出时返回 ErrQueueTimeout；0 表示仅受 ctx 限制。
+	QueueTimeout time.Duration
+}
+
+// LimiterStats 为 Limiter 的运行指标快照。
+type LimiterStats struct {
+	Running   int           // 运行中的进程数
+	Queued    int           // 排队中的调用数
+	Admitted  uint64        // 累计获得执行的调用数
+	Rejected  uint64        // 因队列已满被拒绝的调用数
+	TimedOut  uint64        // 排队超时的调用数
+	Cancelled uint64        // 排队期间 ctx 被取消的调用数
+	TotalWait time.Duration // 已获得执行的调用的累计排队时间
+	MaxWait   time.Duration // 单次最长排队时间
+}
+
+// AverageWait returns the mean queue wait of admitted calls.
+func (s LimiterStats) AverageWait() time.Duration {
+	if s.Admitted == 0 {
+		return 0
+	}
+	return s.TotalWait / time.Duration(s.Admitted)
+}
+
+// Limiter bounds the number of concurrently running CLI processes. A single
+// Limiter may be shared by several LLM instances (e.g. one per model) through
+// WithLimiter so that they draw from the same process budget.
+type Limiter struct {
+	cfg LimiterConfig
+
+	mu      sync.Mutex
+	running int
+	queue   []*limiterWaiter
+	stats   LimiterStats
+}
+
+// limiterWaiter 为一个排队中的调用。
+type limiterWaiter struct {
+	priority Priority
+	ready    chan struct{}
+	admitted bool
+}
+
+// NewLimiter creates a limiter.
+// 参数：cfg 为并发与排队配置。
+// 返回：*Limiter。
+func NewLimiter(cfg LimiterConfig) *Limiter {
+	if cfg.MaxRunning <= 0 {
+		cfg.MaxRunning = 1
+	}
+	return &Limiter{cfg: cfg}
+}
+
+// Stats returns a snapshot of the limiter metrics.
+func (l *Limiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := l.stats
+	stats.Running = l.running
+	stats.Queued = len(l.queue)
+	return stats
+}
+
+// Acquire waits for a process slot.
+// 参数：ctx 为上下文，priority 为排队优先级。
+// 返回：释放函数与错误（ErrQueueFull、ErrQueueTimeout 或 ctx.Err()）。
+func (l *Limiter) Acquire(ctx context.Context, priority Priority) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	if l.running < l.cfg.MaxRunning && len(l.queue) == 0 {
+		l.running++
+		l.stats.Admitted++
+		l.mu.Unlock()
+		return l.releaseFunc(), nil
+	}
+	if l.cfg.MaxQueued > 0 && len(l.queue) >= l.cfg.MaxQueued {
+		l.stats.Rejected++
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := &limiterWaiter{priority: priority, ready: make(chan struct{})}
+	l.enqueue(w)
+	l.mu.Unlock()
+
+	start := time.Now()
+	var expired <-chan time.Time
+	if l.cfg.QueueTimeout > 0 {
+		timer := time.NewTimer(l.cfg.QueueTimeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	var waitErr error
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		waitErr = ctx.Err()
+	case <-expired:
+		waitErr = ErrQueueTimeout
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if waitErr != nil && !w.admitted {
+		l.remove(w)
+		if errors.Is(waitErr, ErrQueueTimeout) {
+			l.stats.TimedOut++
+		} else {
+			l.stats.Cancelled++
+		}
+		return nil, waitErr
+	}
+	// 与取消同时获得名额时仍视为成功，由调用方随后的 ctx 检查处理。
+	wait := time.Since(start)
+	l.stats.Admitted++
+	l.stats.TotalWait += wait
+	if wait > l.stats.MaxWait {
+		l.stats.MaxWait = wait
+	}
+	return l.releaseFunc(), nil
+}
+
+// releaseFunc returns an idempotent release for one slot.
+func (l *Limiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.running--
+			l.dispatch()
+		})
+	}
+}
+
+// enqueue inserts w after all waiters with the same or higher priority.
+func (l *Limiter) enqueue(w *limiterWaiter) {
+	i := len(l.queue)
+	for i > 0 && l.queue[i-1].priority < w.priority {
+		i--
+	}
+	l.queue = append(l.queue, nil)
+	copy(l.queue[i+1:], l.queue[i:])
+	l.queue[i] = w
+}
+
+// remove deletes w from the queue.
+func (l *Limiter) remove(w *limiterWaiter) {
+	for i, q := range l.queue {
+		if q == w {
+			l.queue = append(l.queue[:i], l.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// dispatch admits queued waiters while slots are free.
+func (l *Limiter) dispatch() {
+	for l.running < l.cfg.MaxRunning && len(l.queue) > 0 {
+		w := l.queue[0]
+		l.queue = l.queue[1:]
+		w.admitted = true
+		l.running++
+		close(w.ready)
+	}
+}
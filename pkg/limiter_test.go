@@ -0,0 +1,122 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+)
+
+// waitQueued 等待 limiter 中的排队数达到 n。
+func waitQueued(t *testing.T, limiter *Limiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for limiter.Stats().Queued != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d queued, got %+v", n, limiter.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterPriorityOrder(t *testing.T) {
+	limiter := NewLimiter(LimiterConfig{MaxRunning: 1})
+	ctx := context.Background()
+
+	release, err := limiter.Acquire(ctx, PriorityNormal)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	order := make(chan string, 3)
+	start := func(name string, priority Priority, queued int) {
+		go func() {
+			r, err := limiter.Acquire(ctx, priority)
+			if err != nil {
+				order <- "error: " + err.Error()
+				return
+			}
+			order <- name
+			r()
+		}()
+		waitQueued(t, limiter, queued)
+	}
+	start("low", PriorityLow, 1)
+	start("normal", PriorityNormal, 2)
+	start("high", PriorityHigh, 3)
+
+	release()
+	for _, want := range []string{"high", "normal", "low"} {
+		if got := <-order; got != want {
+			t.Fatalf("got %s, want %s", got, want)
+		}
+	}
+
+	stats := limiter.Stats()
+	if stats.Running != 0 || stats.Queued != 0 || stats.Admitted != 4 || stats.MaxWait <= 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLimiterRejectsAndTimesOut(t *testing.T) {
+	limiter := NewLimiter(LimiterConfig{MaxRunning: 1, MaxQueued: 1, QueueTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	release, err := limiter.Acquire(ctx, PriorityNormal)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer release()
+
+	timedOut := make(chan error, 1)
+	go func() {
+		_, err := limiter.Acquire(ctx, PriorityNormal)
+		timedOut <- err
+	}()
+	waitQueued(t, limiter, 1)
+
+	if _, err := limiter.Acquire(ctx, PriorityHigh); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+	if err := <-timedOut; !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := limiter.Acquire(cancelled, PriorityNormal); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	stats := limiter.Stats()
+	if stats.Rejected != 1 || stats.TimedOut != 1 || stats.Cancelled != 1 || stats.Queued != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestLimiterSharedBetweenLLMs(t *testing.T) {
+	limiter := NewLimiter(LimiterConfig{MaxRunning: 1, MaxQueued: 1})
+	fake := claudetest.New(t)
+	sonnet, _ := New(WithCLIPath(fake.Path), WithModel("sonnet"), WithLimiter(limiter))
+	opus, _ := New(WithCLIPath(fake.Path), WithModel("opus"), WithLimiter(limiter))
+
+	release, err := limiter.Acquire(context.Background(), PriorityNormal)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := sonnet.Call(context.Background(), "你好")
+		done <- err
+	}()
+	waitQueued(t, limiter, 1)
+	if _, err := opus.Call(context.Background(), "你好"); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected shared queue to be full, got %v", err)
+	}
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("queued call: %v", err)
+	}
+}
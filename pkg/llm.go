@@ -4,11 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -16,6 +16,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
 	"github.com/tmc/langchaingo/llms"
 )
 
@@ -23,6 +24,12 @@ import (
 type LLM struct {
 	cliPath string
 	opts    Options
+	// history 记录各会话已包含的消息，供 HistoryDiff 使用。
+	history *historyTracker
+	// sessions 按会话 ID 串行化调用，避免多个 CLI 进程同时写入同一会话记录。
+	sessions *sessionLocker
+	// replays 记录 ReplayDir 中已回放的运行。
+	replays *replayer
 }
 
 var (
@@ -52,10 +59,15 @@ func New(opts ...Option) (*LLM, error) {
 		}
 		if cliPath == "" {
 			path, err := exec.LookPath("claude")
-			if err != nil {
+			switch {
+			case err == nil:
+				cliPath = path
+			case options.ReplayDir != "":
+				// 回放模式不启动 CLI，无需安装。
+				cliPath = "claude"
+			default:
 				return nil, fmt.Errorf("%w: %v", ErrCLINotFound, err)
 			}
-			cliPath = path
 		}
 	}
 
@@ -65,6 +77,12 @@ func New(opts ...Option) (*LLM, error) {
 	if options.MaxBufferSize <= 0 {
 		options.MaxBufferSize = defaultMaxBufferSize
 	}
+	if options.MaxAttachmentSize <= 0 {
+		options.MaxAttachmentSize = defaultMaxAttachmentSize
+	}
+	if err := validateOptions(&options); err != nil {
+		return nil, err
+	}
 	if options.Env == nil {
 		options.Env = map[string]string{}
 	}
@@ -73,11 +91,27 @@ func New(opts ...Option) (*LLM, error) {
 	}
 
 	return &LLM{
-		cliPath: cliPath,
-		opts:    options,
+		cliPath:  cliPath,
+		opts:     options,
+		history:  newHistoryTracker(),
+		sessions: newSessionLocker(),
+		replays:  newReplayer(),
 	}, nil
 }
 
+// validateOptions checks the declarative options that New and per-call overrides share.
+// 参数：options 为待校验的配置。
+// 返回：第一个校验错误。
+func validateOptions(options *Options) error {
+	if err := options.ToolPolicy.Validate(); err != nil {
+		return err
+	}
+	if err := validateMCPServers(options.MCPServers); err != nil {
+		return err
+	}
+	return validateAgents(options.Agents)
+}
+
 // Call implements llms.Model.Call by delegating to GenerateFromSinglePrompt.
 // 参数：ctx 为上下文，prompt 为输入文本，options 为调用参数。
 // 返回：模型响应文本与错误。
@@ -92,92 +126,375 @@ func (l *LLM) GenerateContent(ctx context.Context, messages []llms.MessageConten
 	if l == nil {
 		return nil, errors.New("claude code: nil receiver")
 	}
+	return l.generate(ctx, messages, options, nil)
+}
 
+// generate runs one CLI invocation and aggregates its output.
+// 参数：ctx 为上下文，messages 为对话消息，options 为调用参数，sink 为结构化事件回调（可为空）。
+// 返回：统一的 ContentResponse 与错误。
+func (l *LLM) generate(ctx context.Context, messages []llms.MessageContent, options []llms.CallOption, sink eventSink) (*llms.ContentResponse, error) { //nolint:lll
 	// 解析调用参数，汇总到统一的 CallOptions。
 	callOpts := llms.CallOptions{}
 	for _, opt := range options {
 		opt(&callOpts)
 	}
+	// 合并单次调用的覆盖项，之后的 l 仅在本次调用中使用。
+	l, err := l.withCallOptions(callOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// 同一会话同时只运行一个 CLI 进程，其余调用排队。
+	release, err := l.sessions.acquire(ctx, l.opts.SessionID, l.opts.SessionQueueDepth, l.opts.SessionQueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	// 拆分 system 消息与普通消息，避免混入非 system 内容。
 	systemFromMessages, nonSystem, err := splitSystemMessages(messages)
 	if err != nil {
 		return nil, err
 	}
+	inv := invocation{}
+	var schema map[string]any
+	if l.opts.JSONSchema != nil {
+		if schema, inv.jsonSchema, err = encodeJSONSchema(l.opts.JSONSchema); err != nil {
+			return nil, err
+		}
+	}
+	parser := l.newStreamParser(callOpts.StreamingFunc)
+	parser.sink = sink
+
+	if l.opts.ReplayDir != "" {
+		// 回放模式：从录制目录读取输出，不启动 CLI，也不占用 Limiter 名额或写入临时文件。
+		if err := l.replay(ctx, parser); err != nil {
+			return nil, err
+		}
+		return l.response(parser, nonSystem, schema)
+	}
+
+	// 受共享 Limiter 约束的进程名额，在会话排队之后获取，避免排队调用占用名额。
+	releaseSlot, err := l.opts.Limiter.Acquire(ctx, l.opts.Priority)
+	if err != nil {
+		return nil, err
+	}
+	defer releaseSlot()
 
 	// 合并系统提示词并构建最终 prompt。
-	systemPrompt := mergeSystemPrompt(l.opts.SystemPrompt, systemFromMessages)
-	prompt, err := buildPrompt(nonSystem)
+	inv.systemPrompt = mergeSystemPrompt(l.opts.SystemPrompt, systemFromMessages)
+	if inv.agents, err = encodeAgents(l.opts.Agents); err != nil {
+		return nil, err
+	}
+	prompt := ""
+	history, turnOnly := l.selectHistory(nonSystem)
+	if l.opts.Resume && l.opts.SessionID != "" && hasToolResponses(pendingTurn(nonSystem)) {
+		// 恢复的会话中已包含对应的 tool_use，工具结果只能作为本轮发送。
+		history, turnOnly = pendingTurn(nonSystem), true
+	}
+	if (turnOnly && hasToolResponses(history)) || hasAttachments(history) {
+		// 工具结果与附件需要以 content block 形式经 --input-format stream-json 发送。
+		// 只发送本轮时不加角色前缀；否则按角色扁平化整段历史。
+		builder := l.newContentBuilder("")
+		defer builder.Close()
+		content, err := builder.build(history, !turnOnly)
+		if err != nil {
+			return nil, err
+		}
+		if len(content) == 0 {
+			return nil, ErrEmptyPrompt
+		}
+		if inv.streamInput, err = encodeUserMessage(content, l.opts.SessionID); err != nil {
+			return nil, err
+		}
+		if builder.dir != "" {
+			inv.addDirs = append(inv.addDirs, builder.dir)
+		}
+	} else {
+		if turnOnly {
+			prompt, err = buildTurnPrompt(history)
+		} else {
+			prompt, err = buildPrompt(history)
+		}
+		if err != nil {
+			return nil, err
+		}
+		// 保障 prompt 非空，避免无效调用。
+		if strings.TrimSpace(prompt) == "" {
+			return nil, ErrEmptyPrompt
+		}
+	}
+
+	// 过长的系统提示词写入临时文件，避免超出 ARG_MAX 或在 ps 中暴露。
+	if l.useStdin(len(inv.systemPrompt)) {
+		if inv.systemPromptFile, err = writeSystemPromptFile("", inv.systemPrompt); err != nil {
+			return nil, err
+		}
+		defer os.Remove(inv.systemPromptFile)
+	}
+
+	// runCtx 可由工具桥接提前取消，用于在返回工具调用时终止本轮。
+	runCtx, cancelRun := context.WithCancel(ctx)
+	defer cancelRun()
+
+	// 将调用方声明的 llms.Tool 通过内置 MCP server 暴露给 CLI。
+	bridge, err := l.startToolBridge(runCtx, callOpts.Tools, cancelRun)
 	if err != nil {
 		return nil, err
 	}
-	// 保障 prompt 非空，避免无效调用。
-	if strings.TrimSpace(prompt) == "" {
-		return nil, ErrEmptyPrompt
+	defer bridge.Close()
+	if bridge != nil {
+		inv.mcpConfigPath = bridge.configPath
+		inv.allowedTools = bridge.toolNames
+		inv.permissionPromptTool = bridge.permissionTool
+	} else if len(l.opts.MCPServers) > 0 {
+		// 没有内置 server 时单独写入调用方配置的 MCP server。
+		if inv.mcpConfigPath, err = l.writeMCPServersConfig(); err != nil {
+			return nil, err
+		}
+		defer os.Remove(inv.mcpConfigPath)
 	}
 
 	// 构建 Claude CLI 命令并注入运行环境。
-	cmd := l.buildCommand(ctx, prompt, systemPrompt)
+	cmd := l.buildCommand(runCtx, prompt, inv)
 	cmd.Env = mergeEnv(os.Environ(), l.opts.Env)
 	if l.opts.Cwd != "" {
 		cmd.Dir = l.opts.Cwd
 	}
 
+	// 读取流式输出并捕获生成信息。
+	if bridge != nil {
+		parser.onSessionID = bridge.setSessionID
+		if bridge.deferCalls {
+			parser.onBridgedToolUse = bridge.markToolUseSeen
+		}
+	}
+	if err := l.run(ctx, cmd, parser, bridge); err != nil {
+		return nil, err
+	}
+	return l.response(parser, nonSystem, schema)
+}
+
+// response assembles the ContentResponse from a finished parser.
+// 参数：parser 为已读取完输出的解析器，nonSystem 为本次发送的非 system 消息，
+// schema 为结构化输出 schema（可为空）。
+// 返回：统一的 ContentResponse 与结构化输出校验错误。
+func (l *LLM) response(parser *streamParser, nonSystem []llms.MessageContent, schema map[string]any) (*llms.ContentResponse, error) {
+	// result 未携带 session_id 时使用 system init 中上报的会话 ID。
+	if parser.sessionID != "" {
+		if parser.generationInfo == nil {
+			parser.generationInfo = make(map[string]any)
+		}
+		if _, ok := parser.generationInfo["SessionID"]; !ok {
+			parser.generationInfo["SessionID"] = parser.sessionID
+		}
+	}
+
+	if parser.mcpServers != nil {
+		if parser.generationInfo == nil {
+			parser.generationInfo = make(map[string]any)
+		}
+		parser.generationInfo["MCPServers"] = parser.mcpServers
+	}
+
+	if l.opts.HistoryStrategy == HistoryDiff {
+		if id, ok := parser.generationInfo["SessionID"].(string); ok {
+			l.history.record(id, nonSystem)
+		}
+	}
+
+	// 封装为统一的 ContentResponse 返回。
+	choice := &llms.ContentChoice{
+		Content:        parser.builder.String(),
+		GenerationInfo: parser.generationInfo,
+	}
+	if len(parser.toolCalls) > 0 {
+		choice.ToolCalls = parser.toolCalls
+		choice.FuncCall = parser.toolCalls[0].FunctionCall
+		choice.StopReason = "tool_use"
+	} else if schema != nil {
+		if err := applyStructuredOutput(choice, schema); err != nil {
+			var schemaErr *SchemaError
+			if errors.As(err, &schemaErr) {
+				schemaErr.SessionID, _ = parser.generationInfo["SessionID"].(string)
+			}
+			return nil, err
+		}
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+}
+
+// run starts the CLI and feeds its output to the parser.
+// 参数：ctx 为调用方上下文，cmd 为已配置的命令，parser 为流解析器，bridge 为工具桥接（可为空）。
+// 返回：CLI 失败、解析或取消错误。
+func (l *LLM) run(ctx context.Context, cmd *command, parser *streamParser, bridge *toolBridge) error {
 	// 建立 stdout/stderr 管道，便于流式读取与错误收集。
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("claude code: stdout pipe: %w", err)
+		return fmt.Errorf("claude code: stdout pipe: %w", err)
 	}
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, fmt.Errorf("claude code: stderr pipe: %w", err)
+		return fmt.Errorf("claude code: stderr pipe: %w", err)
 	}
 
 	// 启动 CLI 子进程。
 	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("claude code: start cli: %w", err)
+		return fmt.Errorf("claude code: start cli: %w", err)
+	}
+	// 配置了 RecordDir 时将原始输出同时写入录制目录；录制失败不影响调用本身。
+	rec, err := l.startRecording(ctx, cmd)
+	if err != nil {
+		l.logger().WarnContext(ctx, "claude code: recording disabled", "error", err)
 	}
 
 	// 异步收集 stderr，防止阻塞主流程。
 	var stderrBuf bytes.Buffer
 	stderrDone := make(chan struct{})
 	go func() {
-		_, _ = io.Copy(&stderrBuf, stderr)
+		_, _ = io.Copy(rec.teeStderr(&stderrBuf), stderr)
 		close(stderrDone)
 	}()
 
-	// 读取流式输出并捕获生成信息。
-	responseText, genInfo, streamErr := l.readStream(ctx, stdout, callOpts.StreamingFunc)
-	if streamErr != nil {
-		// 出错时强制终止子进程并等待 stderr 收集完成。
-		_ = cmd.Process.Kill()
+	if streamErr := l.consumeStream(ctx, rec.teeStdout(stdout), parser); streamErr != nil {
+		// 出错时强制终止子进程（含进程组）并等待 stderr 收集完成。
+		killProcess(cmd.Cmd)
 		<-stderrDone
-		return nil, streamErr
+		_ = cmd.reap()
+		rec.finish(cmd.Cmd, streamErr)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return streamErr
 	}
 
 	// 等待子进程结束并处理可能的 CLI 失败信息。
-	if err := cmd.Wait(); err != nil {
+	// 因返回工具调用而主动终止的进程不视为失败。
+	stopped := bridge != nil && bridge.stopped() && ctx.Err() == nil
+	if err := cmd.reap(); err != nil && !stopped {
 		<-stderrDone
+		rec.finish(cmd.Cmd, err)
+		if ctx.Err() != nil {
+			// 调用方取消导致的退出不视为 CLI 失败。
+			return ctx.Err()
+		}
 		errText := strings.TrimSpace(stderrBuf.String())
-		if errText != "" {
-			return nil, fmt.Errorf("claude code: cli failed: %w: %s", err, errText)
+		if parser.resultErr != nil {
+			// 失败的 result 消息比退出码更具体。
+			parser.resultErr.Stderr = errText
+			parser.resultErr.Err = err
+			return parser.resultErr
 		}
-		return nil, fmt.Errorf("claude code: cli failed: %w", err)
+		return processError(err, errText)
 	}
 	<-stderrDone
-
-	// 封装为统一的 ContentResponse 返回。
-	choice := &llms.ContentChoice{
-		Content:        responseText,
-		GenerationInfo: genInfo,
+	rec.finish(cmd.Cmd, nil)
+	if parser.resultErr != nil {
+		return parser.resultErr
 	}
-	return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+	return nil
+}
+
+// invocation 汇总单次 CLI 调用中由消息与调用参数派生的命令行输入。
+type invocation struct {
+	// systemPrompt 为合并后的系统提示词。
+	systemPrompt string
+	// systemPromptFile 非空时以 --system-prompt-file 代替 --system-prompt 传递系统提示词。
+	systemPromptFile string
+	// mcpConfigPath 为生成的 --mcp-config 文件路径。
+	mcpConfigPath string
+	// allowedTools 为追加到 --allowedTools 的工具名（如桥接的 MCP 工具）。
+	allowedTools []string
+	// permissionPromptTool 非空时作为 --permission-prompt-tool 传递。
+	permissionPromptTool string
+	// jsonSchema 非空时作为 --json-schema 传递。
+	jsonSchema string
+	// agents 非空时作为 --agents 传递。
+	agents string
+	// addDirs 为追加给 --add-dir 的目录（如附件临时目录）。
+	addDirs []string
+	// streamInput 非空时以 --input-format stream-json 经 stdin 发送，不再使用 prompt 参数。
+	streamInput []byte
+}
+
+// command 为一次待启动的 CLI 进程。
+type command struct {
+	*exec.Cmd
+	// reap 由 configureProcess 返回，代替 Wait 等待进程退出并清理进程组。
+	reap func() error
+	// stdin 为经标准输入发送的 prompt 或 stream-json 消息，供录制使用。
+	stdin []byte
 }
 
 // buildCommand builds the CLI command arguments for a single prompt.
-// 参数：prompt 为用户输入，systemPrompt 为系统提示词。
-// 返回：exec.Cmd。
-func (l *LLM) buildCommand(ctx context.Context, prompt string, systemPrompt string) *exec.Cmd {
+// 参数：prompt 为用户输入，inv 为本次调用派生的命令行输入。
+// 返回：待启动的 *command。
+func (l *LLM) buildCommand(ctx context.Context, prompt string, inv invocation) *command {
+	args := l.buildArgs(inv)
+
+	var stdin []byte
+	switch {
+	case inv.streamInput != nil:
+		args = append(args, "--input-format", "stream-json", "--print")
+		stdin = inv.streamInput
+	case l.useStdin(len(prompt)):
+		// 未提供 prompt 参数时，--print 从 stdin 读取 prompt。
+		args = append(args, "--print")
+		stdin = []byte(prompt)
+	default:
+		// Use --print with delimiter to avoid prompt being parsed as flags.
+		args = append(args, "--print", "--", prompt)
+	}
+
+	// 命令样式示例：claude --output-format stream-json --verbose ... --print -- <prompt>
+	l.logCommand(ctx, "claude code: command", args)
+
+	cmd := &command{Cmd: exec.CommandContext(ctx, l.cliPath, args...), stdin: stdin}
+	cmd.reap = configureProcess(cmd.Cmd, l.opts.CancelGracePeriod)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	return cmd
+}
+
+// useStdin reports whether content of the given size should bypass argv.
+// 参数：size 为 prompt 或系统提示词的字节数。
+// 返回：是否经 stdin / 临时文件传递。
+func (l *LLM) useStdin(size int) bool {
+	switch l.opts.PromptInput {
+	case PromptInputArgv:
+		return false
+	case PromptInputStdin:
+		return size > 0
+	default:
+		return size > l.opts.PromptStdinThreshold
+	}
+}
+
+// writeSystemPromptFile writes the system prompt for --system-prompt-file.
+// 参数：dir 为目标目录（为空时使用系统临时目录），prompt 为系统提示词。
+// 返回：文件路径与错误，文件仅当前用户可读。
+func writeSystemPromptFile(dir, prompt string) (string, error) {
+	file, err := os.CreateTemp(dir, "claudecode-system-prompt-*.txt")
+	if err != nil {
+		return "", fmt.Errorf("claude code: create system prompt file: %w", err)
+	}
+	if _, err := file.WriteString(prompt); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("claude code: write system prompt file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("claude code: write system prompt file: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// buildArgs builds the CLI flags shared by one-shot calls and sessions.
+// 参数：inv 为本次调用派生的命令行输入。
+// 返回：不含 --print 与 prompt 的参数列表。
+func (l *LLM) buildArgs(inv invocation) []string {
 	args := []string{"--output-format", "stream-json", "--verbose"}
 
 	// Session management - 互斥处理：--resume 和 --session-id 不能同时使用
@@ -199,24 +516,50 @@ func (l *LLM) buildCommand(ctx context.Context, prompt string, systemPrompt stri
 	if l.opts.NoSessionPersistence {
 		args = append(args, "--no-session-persistence")
 	}
+	if l.opts.PartialMessages {
+		args = append(args, "--include-partial-messages")
+	}
 
-	if systemPrompt != "" {
-		args = append(args, "--system-prompt", systemPrompt)
+	if inv.systemPromptFile != "" {
+		args = append(args, "--system-prompt-file", inv.systemPromptFile)
+	} else if inv.systemPrompt != "" {
+		args = append(args, "--system-prompt", inv.systemPrompt)
 	}
 	if len(l.opts.Tools) > 0 {
 		args = append(args, "--tools", strings.Join(l.opts.Tools, ","))
 	}
-	if len(l.opts.AllowedTools) > 0 {
-		args = append(args, "--allowedTools", strings.Join(l.opts.AllowedTools, ","))
+	policyAllowed, policyDisallowed := l.opts.ToolPolicy.CLIRules(l.policyDir())
+	allowedTools := append(append(append([]string{}, l.opts.AllowedTools...), policyAllowed...), inv.allowedTools...)
+	if len(allowedTools) > 0 {
+		args = append(args, "--allowedTools", strings.Join(allowedTools, ","))
 	}
-	if len(l.opts.DisallowedTools) > 0 {
-		args = append(args, "--disallowedTools", strings.Join(l.opts.DisallowedTools, ","))
+	disallowedTools := append(append([]string{}, l.opts.DisallowedTools...), policyDisallowed...)
+	if len(disallowedTools) > 0 {
+		args = append(args, "--disallowedTools", strings.Join(disallowedTools, ","))
 	}
 	if l.opts.Model != "" {
 		args = append(args, "--model", l.opts.Model)
 	}
-	if l.opts.PermissionMode != "" {
-		args = append(args, "--permission-mode", l.opts.PermissionMode)
+	if permissionMode := l.permissionMode(inv); permissionMode != "" {
+		args = append(args, "--permission-mode", permissionMode)
+	}
+	if inv.mcpConfigPath != "" {
+		args = append(args, "--mcp-config", inv.mcpConfigPath)
+	}
+	if l.opts.StrictMCPConfig {
+		args = append(args, "--strict-mcp-config")
+	}
+	if inv.permissionPromptTool != "" {
+		args = append(args, "--permission-prompt-tool", inv.permissionPromptTool)
+	}
+	if inv.jsonSchema != "" {
+		args = append(args, "--json-schema", inv.jsonSchema)
+	}
+	if inv.agents != "" {
+		args = append(args, "--agents", inv.agents)
+	}
+	for _, dir := range inv.addDirs {
+		args = append(args, "--add-dir", dir)
 	}
 
 	// Append extra args in stable order for reproducibility.
@@ -236,112 +579,415 @@ func (l *LLM) buildCommand(ctx context.Context, prompt string, systemPrompt stri
 		}
 	}
 
-	// Use --print with delimiter to avoid prompt being parsed as flags.
-	args = append(args, "--print", "--", prompt)
-
-	// 命令样式示例：claude --output-format stream-json --verbose ... --print -- <prompt>
-	// 注意：此处会完整输出 prompt，便于排查命令拼装是否正确。
-	log.Printf("claude command: %s", strings.Join(append([]string{l.cliPath}, args...), " "))
-
-	return exec.CommandContext(ctx, l.cliPath, args...)
+	return args
 }
 
 // readStream parses stream-json output and returns the aggregated response.
 // 参数：ctx 为上下文，stdout 为 CLI 标准输出，streamingFunc 为流式回调。
 // 返回：拼接后的文本、生成信息与错误。
 func (l *LLM) readStream(ctx context.Context, stdout io.Reader, streamingFunc func(context.Context, []byte) error) (string, map[string]any, error) { //nolint:lll
+	parser := l.newStreamParser(streamingFunc)
+	if err := l.consumeStream(ctx, stdout, parser); err != nil {
+		return parser.builder.String(), parser.generationInfo, err
+	}
+	if parser.resultErr != nil {
+		return parser.builder.String(), parser.generationInfo, parser.resultErr
+	}
+	return parser.builder.String(), parser.generationInfo, nil
+}
+
+// consumeStream feeds every stdout line to the parser until EOF.
+// 参数：ctx 为上下文，stdout 为 CLI 标准输出，parser 为流解析器。
+// 返回：解析或读取错误。
+func (l *LLM) consumeStream(ctx context.Context, stdout io.Reader, parser *streamParser) error {
 	scanner := bufio.NewScanner(stdout)
 	scanner.Buffer(make([]byte, 0, 64*1024), l.opts.MaxBufferSize)
 
-	var builder strings.Builder
-	var generationInfo map[string]any
-
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-		var payload map[string]any
-		if err := json.Unmarshal([]byte(line), &payload); err != nil {
-			return builder.String(), generationInfo, fmt.Errorf("claude code: parse json: %w", err)
+		if _, err := parser.handleLine(ctx, scanner.Text()); err != nil {
+			return err
 		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("claude code: read stdout: %w", err)
+	}
+	return nil
+}
 
-		msgType, _ := payload["type"].(string)
+// streamParser 累积单轮 stream-json 输出，供一次性调用与长会话共用。
+type streamParser struct {
+	llm            *LLM
+	streamingFunc  func(context.Context, []byte) error
+	builder        strings.Builder
+	generationInfo map[string]any
+	// sessionID 为 CLI 在 system/result 消息中上报的会话 ID。
+	sessionID string
+	// mcpServers 为 system init 中上报的 MCP server 连接状态。
+	mcpServers []stream.MCPServerStatus
+
+	// 以下字段用于 --include-partial-messages 增量输出。
+	// partialMessageIDs 记录已通过增量输出的 assistant 消息，避免最终消息重复输出。
+	partialMessageIDs map[string]bool
+	currentMessageID  string
+	// blockTypes 记录当前消息中各 content block 的类型（按 index）。
+	blockTypes map[int]string
+	// pendingTextBreak 表示新 text block 的首个增量需要判断段落分隔。
+	pendingTextBreak bool
+
+	// onSessionID 非空时在会话 ID 变化时调用（可能在工具桥接的 goroutine 中读取）。
+	onSessionID func(id string)
+	// onBridgedToolUse 非空时，桥接工具的 tool_use 会被收集为 llms.ToolCall 返回给调用方。
+	onBridgedToolUse func()
+	toolCalls        []llms.ToolCall
+
+	// apiErr 为 assistant 消息上报的 API 错误分类，resultErr 为失败的 result 消息。
+	apiErr    error
+	resultErr *CLIError
+
+	// logCounts 按消息类型计数，用于日志采样。
+	logCounts map[string]int
+
+	// pendingTools 记录尚未收到结果的 tool_use，按 tool_use_id 关联结果并计算耗时。
+	pendingTools map[string]ToolEvent
+	// subagents 记录 Task 调用 ID 对应的 subagent_type，用于标注 subagent 产生的工具事件。
+	subagents map[string]string
+
+	// sink 非空时接收结构化事件（见 LLM.Stream）。
+	sink eventSink
+
+	// current 为正在处理的行，payload 为其按需解码的原始负载（供 Event.Raw 与调试日志使用）。
+	current stream.Event
+	payload map[string]any
+}
 
-		// 记录每行完整 stream-json，包含 msgType，便于排查输出内容。
-		logType := msgType
-		if logType == "" {
-			logType = "<empty>"
-		}
-		if pretty, err := json.MarshalIndent(payload, "", "  "); err == nil {
-			log.Printf("\nclaude code: stream-json (msgType=%s):\n%s\n", logType, string(pretty))
-		} else {
-			log.Printf("\nclaude code: stream-json (msgType=%s): %s\n", logType, line)
+// newStreamParser creates a parser bound to the LLM options.
+// 参数：streamingFunc 为流式回调，可为空。
+// 返回：*streamParser。
+func (l *LLM) newStreamParser(streamingFunc func(context.Context, []byte) error) *streamParser {
+	return &streamParser{
+		llm:           l,
+		streamingFunc: streamingFunc,
+	}
+}
+
+// handleLine parses a single stream-json line.
+// 参数：ctx 为上下文，line 为 CLI 输出的一行。
+// 返回：是否读到 result（即本轮结束）与错误。
+func (p *streamParser) handleLine(ctx context.Context, line string) (bool, error) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false, nil
+	}
+	event, err := stream.Parse([]byte(line))
+	if err != nil {
+		return false, fmt.Errorf("claude code: parse json: %w", err)
+	}
+	return p.handleEvent(ctx, event)
+}
+
+// handleEvent applies one decoded stream-json event.
+// 参数：ctx 为上下文，event 为 stream.Parse 的结果。
+// 返回：是否读到 result（即本轮结束）与错误。
+func (p *streamParser) handleEvent(ctx context.Context, event stream.Event) (bool, error) {
+	p.current, p.payload = event, nil
+	p.logLine(ctx, event)
+
+	if id := event.EventHeader().SessionID; id != "" && id != p.sessionID {
+		p.sessionID = id
+		if p.onSessionID != nil {
+			p.onSessionID(id)
 		}
+	}
 
-		switch msgType {
-		case "assistant":
-			// 处理 assistant 消息中的有序内容块（text / thinking / tool_use）
-			blocks, err := extractAssistantContent(payload)
-			if err != nil {
-				return builder.String(), generationInfo, err
-			}
-			for _, block := range blocks {
-				switch block.Kind {
-				case assistantContentText:
-					chunk := block.Text
-					if shouldInsertAssistantParagraphBreak(builder.String(), block.Text) {
-						chunk = "\n\n" + block.Text
-					}
-					if streamingFunc != nil {
-						if err := streamingFunc(ctx, []byte(chunk)); err != nil {
-							return builder.String(), generationInfo, err
-						}
-					}
-					builder.WriteString(chunk)
-				case assistantContentThinking:
-					if !l.opts.ThinkingTags {
-						continue
-					}
-					chunk := formatThinkingBlock(block.Text)
-					if streamingFunc != nil {
-						if err := streamingFunc(ctx, []byte(chunk)); err != nil {
-							return builder.String(), generationInfo, err
-						}
+	l := p.llm
+	switch e := event.(type) {
+	case *stream.SystemEvent:
+		if e.MCPServers != nil {
+			p.mcpServers = e.MCPServers
+			for _, s := range e.MCPServers {
+				if s.Status == "failed" {
+					l.logger().WarnContext(ctx, "claude code: mcp server failed to connect", "server", s.Name)
+				}
+			}
+		}
+		if err := p.notify(Event{Type: EventSystem, SessionID: p.sessionID}); err != nil {
+			return false, err
+		}
+	case *stream.AssistantEvent:
+		// API 失败时 CLI 以带 error 字段的 assistant 消息报告，随后的 result 为 is_error。
+		if e.Error != "" {
+			p.apiErr = assistantErrorKinds[e.Error]
+		}
+		// 已通过增量输出的消息只需处理 tool_use，文本与 thinking 不再重复输出。
+		streamed := p.partialMessageIDs[e.Message.ID]
+		// 处理 assistant 消息中的有序内容块（text / thinking / tool_use）
+		for _, block := range assistantContent(e.Message) {
+			if streamed && block.Kind != assistantContentToolUse {
+				continue
+			}
+			switch block.Kind {
+			case assistantContentText:
+				chunk := block.Text
+				if shouldInsertAssistantParagraphBreak(p.builder.String(), block.Text) {
+					chunk = "\n\n" + block.Text
+				}
+				if err := p.notify(Event{Type: EventText, Text: chunk}); err != nil {
+					return false, err
+				}
+				if err := p.emit(ctx, chunk); err != nil {
+					return false, err
+				}
+			case assistantContentThinking:
+				if err := p.notify(Event{Type: EventThinking, Text: block.Text}); err != nil {
+					return false, err
+				}
+				if !l.opts.ThinkingTags {
+					continue
+				}
+				if err := p.emit(ctx, formatThinkingBlock(block.Text)); err != nil {
+					return false, err
+				}
+			case assistantContentToolUse:
+				tu := block.ToolUse
+				if p.onBridgedToolUse != nil && strings.HasPrefix(tu.Name, bridgeToolName("")) {
+					if err := p.collectToolCall(tu); err != nil {
+						return false, err
 					}
-					builder.WriteString(chunk)
-				case assistantContentToolUse:
-					tu := block.ToolUse
-					l.handleToolEvent(ToolEvent{
-						Type:      ToolEventUse,
-						ToolName:  tu.Name,
-						ToolID:    tu.ID,
-						Input:     tu.Input,
-						Timestamp: time.Now(),
-					}, &builder, streamingFunc, ctx)
+				}
+				if err := p.toolEvent(ctx, ToolEvent{
+					Type:      ToolEventUse,
+					ToolName:  tu.Name,
+					ToolID:    tu.ID,
+					Input:     tu.Input,
+					Timestamp: time.Now(),
+				}, e.ParentToolUseID); err != nil {
+					return false, err
 				}
 			}
-		case "tool_result":
-			// 处理工具执行结果消息
-			l.handleToolEvent(ToolEvent{
-				Type:      ToolEventResult,
-				ToolID:    getStringField(payload, "tool_use_id"),
-				Output:    getStringField(payload, "content"),
-				Timestamp: time.Now(),
-			}, &builder, streamingFunc, ctx)
-		case "result":
-			generationInfo = mergeResultInfo(generationInfo, payload)
-		case "":
-			return builder.String(), generationInfo, fmt.Errorf("claude code: cli error: %v", payload)
-		default:
-			// Ignore other message types (system, stream_event, etc.).
 		}
+	case *stream.UserEvent:
+		// CLI 以 user 消息回传工具结果，content 中包含 tool_result blocks。
+		for _, result := range toolResults(e.Message) {
+			if err := p.toolEvent(ctx, result, e.ParentToolUseID); err != nil {
+				return false, err
+			}
+		}
+	case *stream.ToolResultEvent:
+		// 兼容旧版 CLI 的顶层 tool_result 消息。
+		if err := p.toolEvent(ctx, toolResultEvent(e.Block(), time.Now()), nil); err != nil {
+			return false, err
+		}
+	case *stream.StreamEvent:
+		if !l.opts.PartialMessages {
+			return false, nil
+		}
+		if err := p.handleStreamEvent(ctx, e.Event); err != nil {
+			return false, err
+		}
+	case *stream.ResultEvent:
+		p.generationInfo = mergeResultInfo(p.generationInfo, e)
+		p.resultErr = resultError(e, p.apiErr)
+		return true, nil
+	case *stream.UnknownEvent:
+		if e.Type != "" {
+			// Ignore other message types.
+			return false, nil
+		}
+		// 没有 type 字段的行为 CLI 直接输出的错误对象。
+		message := string(e.Raw())
+		kind := classifyMessage(message)
+		if kind == nil {
+			kind = ErrCLIFailed
+		}
+		return false, &CLIError{Kind: kind, Message: message}
 	}
-	if err := scanner.Err(); err != nil {
-		return builder.String(), generationInfo, fmt.Errorf("claude code: read stdout: %w", err)
+	return false, nil
+}
+
+// handleStreamEvent translates partial message events into incremental output.
+// 参数：ctx 为上下文，event 为 stream_event 中的 Anthropic 流式事件。
+// 返回：流式回调返回的错误。
+func (p *streamParser) handleStreamEvent(ctx context.Context, event stream.PartialEvent) error {
+	switch event.Type {
+	case "message_start":
+		p.currentMessageID = ""
+		if event.Message != nil {
+			p.currentMessageID = event.Message.ID
+		}
+		p.blockTypes = map[int]string{}
+	case "content_block_start":
+		blockType := ""
+		if event.ContentBlock != nil {
+			blockType = event.ContentBlock.Type
+		}
+		if p.blockTypes == nil {
+			p.blockTypes = map[int]string{}
+		}
+		p.blockTypes[event.Index] = blockType
+		switch blockType {
+		case "text":
+			p.markPartial()
+			p.pendingTextBreak = true
+		case "thinking":
+			p.markPartial()
+			if p.llm.opts.ThinkingTags {
+				return p.emit(ctx, "\n<think>\n")
+			}
+		}
+	case "content_block_delta":
+		if event.Delta == nil {
+			return nil
+		}
+		switch event.Delta.Type {
+		case "text_delta":
+			text := event.Delta.Text
+			if text == "" {
+				return nil
+			}
+			if p.pendingTextBreak {
+				p.pendingTextBreak = false
+				if shouldInsertAssistantParagraphBreak(p.builder.String(), text) {
+					text = "\n\n" + text
+				}
+			}
+			if err := p.notify(Event{Type: EventText, Text: text}); err != nil {
+				return err
+			}
+			return p.emit(ctx, text)
+		case "thinking_delta":
+			text := event.Delta.Thinking
+			if text == "" {
+				return nil
+			}
+			if err := p.notify(Event{Type: EventThinking, Text: text}); err != nil {
+				return err
+			}
+			if !p.llm.opts.ThinkingTags {
+				return nil
+			}
+			return p.emit(ctx, text)
+		}
+	case "content_block_stop":
+		if p.blockTypes[event.Index] == "thinking" && p.llm.opts.ThinkingTags {
+			return p.emit(ctx, "\n</think>\n")
+		}
 	}
+	return nil
+}
 
-	return builder.String(), generationInfo, nil
+// collectToolCall records a bridged tool_use as an llms.ToolCall for the caller.
+// 参数：tu 为 tool_use 信息。
+// 返回：参数编码错误。
+func (p *streamParser) collectToolCall(tu toolUseInfo) error {
+	arguments := []byte("{}")
+	if tu.Input != nil {
+		var err error
+		if arguments, err = json.Marshal(tu.Input); err != nil {
+			return fmt.Errorf("claude code: encode tool arguments: %w", err)
+		}
+	}
+	p.toolCalls = append(p.toolCalls, llms.ToolCall{
+		ID:   tu.ID,
+		Type: "function",
+		FunctionCall: &llms.FunctionCall{
+			Name:      strings.TrimPrefix(tu.Name, bridgeToolName("")),
+			Arguments: string(arguments),
+		},
+	})
+	p.onBridgedToolUse()
+	return nil
+}
+
+// markPartial records that the current message has been streamed incrementally.
+func (p *streamParser) markPartial() {
+	if p.currentMessageID == "" {
+		return
+	}
+	if p.partialMessageIDs == nil {
+		p.partialMessageIDs = map[string]bool{}
+	}
+	p.partialMessageIDs[p.currentMessageID] = true
+}
+
+// toolEvent notifies the event sink and applies OutputMode formatting.
+// 参数：ctx 为上下文，event 为工具事件，parent 为消息的 parent_tool_use_id（主 agent 为空）。
+// 返回：事件回调返回的错误。
+func (p *streamParser) toolEvent(ctx context.Context, event ToolEvent, parent *string) error {
+	eventType := EventToolUse
+	if parent != nil && *parent != "" {
+		event.ParentToolUseID = *parent
+		event.Agent = p.subagents[*parent]
+	}
+	switch event.Type {
+	case ToolEventUse:
+		if agent := subagentType(event); agent != "" && event.ToolID != "" {
+			if p.subagents == nil {
+				p.subagents = make(map[string]string)
+			}
+			p.subagents[event.ToolID] = agent
+		}
+		if event.ToolID != "" {
+			if p.pendingTools == nil {
+				p.pendingTools = make(map[string]ToolEvent)
+			}
+			p.pendingTools[event.ToolID] = event
+		}
+	case ToolEventResult:
+		eventType = EventToolResult
+		if use, ok := p.pendingTools[event.ToolID]; ok {
+			delete(p.pendingTools, event.ToolID)
+			if event.ToolName == "" {
+				event.ToolName = use.ToolName
+			}
+			event.Duration = event.Timestamp.Sub(use.Timestamp)
+		}
+	}
+	if err := p.notify(Event{Type: eventType, Tool: &event}); err != nil {
+		return err
+	}
+	p.llm.handleToolEvent(event, &p.builder, p.streamingFunc, ctx)
+	return nil
+}
+
+// notify forwards a structured event to the sink when present.
+// 参数：event 为结构化事件，Raw 为空时填入当前行的原始负载。
+// 返回：sink 返回的错误（如调用方取消）。
+func (p *streamParser) notify(event Event) error {
+	if p.sink == nil {
+		return nil
+	}
+	if event.Raw == nil {
+		event.Raw = p.rawPayload()
+	}
+	if event.SessionID == "" {
+		event.SessionID = p.sessionID
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	return p.sink(event)
+}
+
+// rawPayload decodes the current line into a map for Event.Raw and debug logs.
+// 每行最多解码一次，且仅在有消费者时进行。
+func (p *streamParser) rawPayload() map[string]any {
+	if p.payload == nil && p.current != nil {
+		_ = json.Unmarshal(p.current.Raw(), &p.payload)
+	}
+	return p.payload
+}
+
+// emit streams a chunk and appends it to the aggregated output.
+// 参数：ctx 为上下文，chunk 为输出片段。
+// 返回：流式回调返回的错误。
+func (p *streamParser) emit(ctx context.Context, chunk string) error {
+	if p.streamingFunc != nil {
+		if err := p.streamingFunc(ctx, []byte(chunk)); err != nil {
+			return err
+		}
+	}
+	p.builder.WriteString(chunk)
+	return nil
 }
 
 // shouldInsertAssistantParagraphBreak 判断新的 assistant 文本块前是否需要补段落分隔。
@@ -508,72 +1154,97 @@ type assistantContentBlock struct {
 	ToolUse toolUseInfo
 }
 
-// extractAssistantContent extracts ordered text/thinking/tool_use blocks from assistant messages.
-// 参数：payload 为 CLI JSON 行。
-// 返回：有序内容块与错误。
-func extractAssistantContent(payload map[string]any) ([]assistantContentBlock, error) {
-	message, ok := payload["message"].(map[string]any)
-	if !ok {
-		return nil, fmt.Errorf("claude code: assistant message missing 'message'")
+// toolResults converts the tool_result blocks of a user message into tool events.
+// 参数：msg 为 user 消息。
+// 返回：按出现顺序排列的工具结果事件。
+func toolResults(msg stream.Message) []ToolEvent {
+	now := time.Now()
+	var out []ToolEvent
+	for _, block := range msg.Content {
+		if block.Type == "tool_result" {
+			out = append(out, toolResultEvent(block, now))
+		}
 	}
+	return out
+}
 
-	content, ok := message["content"]
-	if !ok {
-		return nil, fmt.Errorf("claude code: assistant message missing 'content'")
+// toolResultEvent converts one tool_result block into a tool event.
+// 参数：block 为 tool_result block，ts 为事件时间戳。
+// 返回：ToolEventResult 事件。
+func toolResultEvent(block stream.ContentBlock, ts time.Time) ToolEvent {
+	output, images := toolResultContent(block)
+	return ToolEvent{
+		Type:      ToolEventResult,
+		ToolID:    block.ToolUseID,
+		Output:    output,
+		IsError:   block.IsError,
+		Images:    images,
+		Timestamp: ts,
 	}
+}
 
-	switch blocks := content.(type) {
-	case []any:
-		var out []assistantContentBlock
-		for _, block := range blocks {
-			blockMap, ok := block.(map[string]any)
-			if !ok {
+// toolResultContent flattens tool_result content into text and images.
+// 参数：block 为 tool_result block，content 为字符串或 text/image block 数组。
+// 返回：拼接后的文本与解码后的图片。
+func toolResultContent(block stream.ContentBlock) (string, []ToolImage) {
+	blocks, err := block.ResultBlocks()
+	if err != nil {
+		return "", nil
+	}
+	var texts []string
+	var images []ToolImage
+	for _, item := range blocks {
+		switch item.Type {
+		case "text":
+			if item.Text != "" {
+				texts = append(texts, item.Text)
+			}
+		case "image":
+			if item.Source == nil || item.Source.Type != "base64" {
 				continue
 			}
-			blockType, _ := blockMap["type"].(string)
-			switch blockType {
-			case "text":
-				text, _ := blockMap["text"].(string)
-				if text != "" {
-					out = append(out, assistantContentBlock{
-						Kind: assistantContentText,
-						Text: text,
-					})
-				}
-			case "thinking":
-				text, _ := blockMap["thinking"].(string)
-				if text != "" {
-					out = append(out, assistantContentBlock{
-						Kind: assistantContentThinking,
-						Text: text,
-					})
-				}
-			case "tool_use":
-				tu := toolUseInfo{
-					ID:   getStringField(blockMap, "id"),
-					Name: getStringField(blockMap, "name"),
-				}
-				if input, ok := blockMap["input"].(map[string]any); ok {
-					tu.Input = input
-				}
+			data, err := base64.StdEncoding.DecodeString(item.Source.Data)
+			if err != nil {
+				continue
+			}
+			images = append(images, ToolImage{MediaType: item.Source.MediaType, Data: data})
+		}
+	}
+	return strings.Join(texts, "\n"), images
+}
+
+// assistantContent extracts ordered text/thinking/tool_use blocks from an assistant message.
+// 参数：msg 为 assistant 消息（字符串 content 已由 stream 包转换为单个 text block）。
+// 返回：有序内容块。
+func assistantContent(msg stream.Message) []assistantContentBlock {
+	var out []assistantContentBlock
+	for _, block := range msg.Content {
+		switch block.Type {
+		case "text":
+			if block.Text != "" {
 				out = append(out, assistantContentBlock{
-					Kind:    assistantContentToolUse,
-					ToolUse: tu,
+					Kind: assistantContentText,
+					Text: block.Text,
 				})
 			}
+		case "thinking":
+			if block.Thinking != "" {
+				out = append(out, assistantContentBlock{
+					Kind: assistantContentThinking,
+					Text: block.Thinking,
+				})
+			}
+		case "tool_use":
+			tu := toolUseInfo{ID: block.ID, Name: block.Name}
+			// input 不是 JSON 对象时忽略。
+			_ = json.Unmarshal(block.Input, &tu.Input)
+			out = append(out, assistantContentBlock{
+				Kind:    assistantContentToolUse,
+				ToolUse: tu,
+			})
 		}
-		return out, nil
-	case string:
-		if blocks == "" {
-			return nil, nil
-		}
-		return []assistantContentBlock{{
-			Kind: assistantContentText,
-			Text: blocks,
-		}}, nil
-	default:
-		return nil, fmt.Errorf("claude code: unsupported assistant content type: %T", content)
 	}
+	return out
 }
 
 // formatThinkingBlock wraps thinking text in enterprise-wecom compatible think tags.
@@ -587,24 +1258,21 @@ func formatThinkingBlock(text string) string {
 }
 
 // mergeResultInfo extracts useful fields from result messages.
-// 参数：existing 为已有 GenerationInfo，payload 为 result 消息。
+// 参数：existing 为已有 GenerationInfo，result 为 result 消息。
 // 返回：合并后的 GenerationInfo。
-func mergeResultInfo(existing map[string]any, payload map[string]any) map[string]any {
+func mergeResultInfo(existing map[string]any, result *stream.ResultEvent) map[string]any {
 	if existing == nil {
 		existing = make(map[string]any)
 	}
 
-	if v, ok := payload["total_cost_usd"]; ok {
-		existing["TotalCostUSD"] = v
-	}
-	if v, ok := payload["usage"]; ok {
-		existing["Usage"] = v
-	}
-	if v, ok := payload["result"]; ok {
-		existing["Result"] = v
-	}
-	if v, ok := payload["structured_output"]; ok {
-		existing["StructuredOutput"] = v
+	existing["TotalCostUSD"] = result.TotalCostUSD
+	usageFromResult(result).setGenerationInfo(existing)
+	existing["Result"] = result.Result
+	if len(result.StructuredOutput) > 0 {
+		var output any
+		if err := json.Unmarshal(result.StructuredOutput, &output); err == nil {
+			existing["StructuredOutput"] = output
+		}
 	}
 
 	return existing
@@ -666,7 +1334,14 @@ func (l *LLM) handleToolEvent(event ToolEvent, builder *strings.Builder, streami
 			if len(output) > 500 {
 				output = output[:500] + "... (truncated)"
 			}
-			summary = fmt.Sprintf("  └─ 📤 %s\n", output)
+			if len(event.Images) > 0 {
+				output = strings.TrimSpace(fmt.Sprintf("%s [%d image(s)]", output, len(event.Images)))
+			}
+			marker := "📤"
+			if event.IsError {
+				marker = "❌"
+			}
+			summary = fmt.Sprintf("  └─ %s %s\n", marker, output)
 		}
 		// Verbose 模式不输出 result（避免太冗长）
 	}
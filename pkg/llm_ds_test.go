@@ -20,7 +20,7 @@ func TestLLMDeepSeek(t *testing.T) {
 	// 从系统环境中读取 ANTHROPIC_AUTH_TOKEN，其他参数使用默认值。
 	authToken := os.Getenv("ANTHROPIC_AUTH_TOKEN")
 	if authToken == "" {
-		t.Fatalf("ANTHROPIC_AUTH_TOKEN is required")
+		t.Skip("ANTHROPIC_AUTH_TOKEN is required")
 	}
 
 	// 使用 DeepSeek 默认环境变量配置。
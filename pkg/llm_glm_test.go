@@ -20,7 +20,7 @@ func TestLLMGLM(t *testing.T) {
 	// 从系统环境中读取 ANTHROPIC_AUTH_TOKEN。
 	authToken := os.Getenv("ANTHROPIC_AUTH_TOKEN")
 	if authToken == "" {
-		t.Fatalf("ANTHROPIC_AUTH_TOKEN is required")
+		t.Skip("ANTHROPIC_AUTH_TOKEN is required")
 	}
 
 	// 组装调用所需环境变量。
@@ -4,6 +4,8 @@ import (
 	"context"
 	"strings"
 	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
 )
 
 func TestShouldInsertAssistantParagraphBreak(t *testing.T) {
@@ -55,20 +57,13 @@ func TestShouldInsertAssistantParagraphBreak(t *testing.T) {
 	}
 }
 
-func TestExtractAssistantContentIncludesThinkingBlocks(t *testing.T) {
-	payload := map[string]any{
-		"message": map[string]any{
-			"content": []any{
-				map[string]any{"type": "thinking", "thinking": "先分析一下"},
-				map[string]any{"type": "text", "text": "这是结果"},
-			},
-		},
-	}
-
-	blocks, err := extractAssistantContent(payload)
+func TestAssistantContentIncludesThinkingBlocks(t *testing.T) {
+	event, err := stream.Parse([]byte(`{"type":"assistant","message":{"content":[{"type":"thinking","thinking":"先分析一下"},{"type":"text","text":"这是结果"}]}}`))
 	if err != nil {
-		t.Fatalf("extractAssistantContent: %v", err)
+		t.Fatalf("Parse: %v", err)
 	}
+
+	blocks := assistantContent(event.(*stream.AssistantEvent).Message)
 	if len(blocks) != 2 {
 		t.Fatalf("unexpected block count: %d", len(blocks))
 	}
@@ -152,3 +147,103 @@ func TestReadStreamThinkingTagsSuppressAfterVisibleText(t *testing.T) {
 		t.Fatalf("unexpected output: got %q want %q", got, want)
 	}
 }
+
+func TestReadStreamPartialMessagesDeduplicated(t *testing.T) {
+	llm := &LLM{
+		opts: Options{
+			PartialMessages: true,
+			ThinkingTags:    true,
+		},
+	}
+	stdout := strings.NewReader(
+		`{"type":"stream_event","event":{"type":"message_start","message":{"id":"msg_1"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_start","index":0,"content_block":{"type":"thinking"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_delta","index":0,"delta":{"type":"thinking_delta","thinking":"分析"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_stop","index":0}}` + "\n" +
+			`{"type":"assistant","message":{"id":"msg_1","content":[{"type":"thinking","thinking":"分析"}]}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_start","index":1,"content_block":{"type":"text"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"最终"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_delta","index":1,"delta":{"type":"text_delta","text":"答案"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_stop","index":1}}` + "\n" +
+			`{"type":"assistant","message":{"id":"msg_1","content":[{"type":"text","text":"最终答案"}]}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"message_start","message":{"id":"msg_2"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_start","index":0,"content_block":{"type":"text"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"第二段"}}}` + "\n" +
+			`{"type":"assistant","message":{"id":"msg_2","content":[{"type":"text","text":"第二段"}]}}` + "\n",
+	)
+
+	var chunks []string
+	streamingFunc := func(_ context.Context, chunk []byte) error {
+		chunks = append(chunks, string(chunk))
+		return nil
+	}
+	got, _, err := llm.readStream(context.Background(), stdout, streamingFunc)
+	if err != nil {
+		t.Fatalf("readStream: %v", err)
+	}
+	want := "\n<think>\n分析\n</think>\n最终答案\n\n第二段"
+	if got != want {
+		t.Fatalf("unexpected output: got %q want %q", got, want)
+	}
+	if strings.Join(chunks, "") != want {
+		t.Fatalf("streamed chunks mismatch: %q", chunks)
+	}
+	if len(chunks) != 6 {
+		t.Fatalf("expected incremental chunks, got %q", chunks)
+	}
+}
+
+func TestReadStreamIgnoresStreamEventsWhenPartialDisabled(t *testing.T) {
+	llm := &LLM{}
+	stdout := strings.NewReader(
+		`{"type":"stream_event","event":{"type":"message_start","message":{"id":"msg_1"}}}` + "\n" +
+			`{"type":"stream_event","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"最终"}}}` + "\n" +
+			`{"type":"assistant","message":{"id":"msg_1","content":[{"type":"text","text":"最终答案"}]}}` + "\n",
+	)
+
+	got, _, err := llm.readStream(context.Background(), stdout, nil)
+	if err != nil {
+		t.Fatalf("readStream: %v", err)
+	}
+	if got != "最终答案" {
+		t.Fatalf("unexpected output: %q", got)
+	}
+}
+
+func TestReadStreamToolResultsFromUserMessages(t *testing.T) {
+	var events []ToolEvent
+	llm := &LLM{
+		opts: Options{
+			OutputMode:    OutputModeFull,
+			ToolEventHook: func(event ToolEvent) { events = append(events, event) },
+		},
+	}
+	stdout := strings.NewReader(
+		`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"a.png"}},{"type":"tool_use","id":"toolu_2","name":"Bash","input":{"command":"false"}}]}}` + "\n" +
+			`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"读取成功"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"iVBORw=="}}]}]}}` + "\n" +
+			`{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_2","content":"exit 1","is_error":true}]}}` + "\n",
+	)
+	got, _, err := llm.readStream(context.Background(), stdout, nil)
+	if err != nil {
+		t.Fatalf("readStream: %v", err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+	read, bash := events[2], events[3]
+	if read.Type != ToolEventResult || read.ToolID != "toolu_1" || read.ToolName != "Read" || read.Output != "读取成功" || read.IsError {
+		t.Fatalf("unexpected Read result: %+v", read)
+	}
+	if len(read.Images) != 1 || read.Images[0].MediaType != "image/png" || len(read.Images[0].Data) != 4 {
+		t.Fatalf("unexpected Read images: %+v", read.Images)
+	}
+	if bash.ToolName != "Bash" || !bash.IsError || bash.Output != "exit 1" {
+		t.Fatalf("unexpected Bash result: %+v", bash)
+	}
+	if read.Duration < 0 || bash.Duration < 0 {
+		t.Fatalf("unexpected durations: %v %v", read.Duration, bash.Duration)
+	}
+	if !strings.Contains(got, "📤 读取成功 [1 image(s)]") || !strings.Contains(got, "❌ exit 1") {
+		t.Fatalf("unexpected output: %q", got)
+	}
+}
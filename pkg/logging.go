@@ -0,0 +1,199 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
+)
+
+// Redaction 控制日志中需要脱敏的内容，可按位组合。
+type Redaction uint8
+
+const (
+	// RedactPrompts 脱敏 prompt、系统提示词以及模型输出的文本与 thinking。
+	RedactPrompts Redaction = 1 << iota
+	// RedactToolInputs 脱敏 tool_use 的输入参数。
+	RedactToolInputs
+	// RedactEnvValues 脱敏 Options.Env 中的变量值，仅保留变量名。
+	RedactEnvValues
+	// RedactFileContents 脱敏 tool_result 内容与图片等二进制数据。
+	RedactFileContents
+
+	// RedactNone 不脱敏，仅用于本地调试。
+	RedactNone Redaction = 0
+	// RedactAll 脱敏以上全部内容 (默认行为)。
+	RedactAll = RedactPrompts | RedactToolInputs | RedactEnvValues | RedactFileContents
+)
+
+// promptFlags 为值属于 prompt 内容的 CLI 参数。
+var promptFlags = map[string]bool{
+	"--system-prompt":        true,
+	"--append-system-prompt": true,
+	// --agents 携带子代理的系统提示词。
+	"--agents": true,
+}
+
+// logger returns the configured logger or a quiet one.
+func (l *LLM) logger() *slog.Logger {
+	if l.opts.Logger != nil {
+		return l.opts.Logger
+	}
+	return slog.New(slog.DiscardHandler)
+}
+
+// logCommand logs the CLI invocation at debug level with prompts and env values redacted.
+// 参数：ctx 为上下文，msg 为日志消息，args 为 CLI 参数（不含可执行文件）。
+func (l *LLM) logCommand(ctx context.Context, msg string, args []string) {
+	logger := l.logger()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	logger.DebugContext(ctx, msg,
+		slog.String("cli", l.cliPath),
+		slog.Any("args", l.redactArgs(args)),
+		slog.Any("env", l.redactedEnv()),
+	)
+}
+
+// redactArgs returns a copy of CLI arguments with prompt values redacted.
+// 参数：args 为 CLI 参数（不含可执行文件）。
+// 返回：脱敏后的参数副本。
+func (l *LLM) redactArgs(args []string) []string {
+	logged := make([]string, len(args))
+	copy(logged, args)
+	if l.opts.Redaction&RedactPrompts == 0 {
+		return logged
+	}
+	for i := 0; i < len(logged); i++ {
+		if logged[i] == "--" {
+			// -- 之后均为 prompt。
+			for j := i + 1; j < len(logged); j++ {
+				logged[j] = redactedString(logged[j])
+			}
+			break
+		}
+		// --flag=value 形式（如经 ExtraArgs 传入）只保留参数名。
+		if flag, value, ok := strings.Cut(logged[i], "="); ok && promptFlags[flag] {
+			logged[i] = flag + "=" + redactedString(value)
+			continue
+		}
+		if promptFlags[logged[i]] && i+1 < len(logged) {
+			logged[i+1] = redactedString(logged[i+1])
+			i++
+		}
+	}
+	return logged
+}
+
+// redactedEnv returns Options.Env as sorted KEY=VALUE pairs, honoring RedactEnvValues.
+func (l *LLM) redactedEnv() []string {
+	env := make([]string, 0, len(l.opts.Env))
+	for k, v := range l.opts.Env {
+		if l.opts.Redaction&RedactEnvValues != 0 {
+			v = "[redacted]"
+		}
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// logLine logs one stream-json line at debug level, honoring sampling and redaction.
+// 参数：ctx 为上下文，event 为解析后的消息。
+func (p *streamParser) logLine(ctx context.Context, event stream.Event) {
+	l := p.llm
+	logger := l.logger()
+	if !logger.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	msgType := event.EventType()
+	if every := l.opts.LogSampling[msgType]; every > 1 {
+		if p.logCounts == nil {
+			p.logCounts = make(map[string]int)
+		}
+		n := p.logCounts[msgType]
+		p.logCounts[msgType]++
+		if n%every != 0 {
+			return
+		}
+	}
+
+	// 脱敏按字段名作用于任意消息（包括 stream 包未建模的类型），因此对原始 JSON 进行。
+	data, err := json.Marshal(redactValue(p.rawPayload(), "", l.opts.Redaction))
+	if err != nil {
+		return
+	}
+	logger.DebugContext(ctx, "claude code: stream-json",
+		slog.String("type", msgType),
+		slog.String("subtype", event.EventHeader().Subtype),
+		slog.String("payload", string(data)),
+	)
+}
+
+// redactValue returns a copy of a decoded JSON value with sensitive fields replaced.
+// 参数：v 为 JSON 值，blockType 为所属对象的 type 字段，redact 为脱敏策略。
+// 返回：脱敏后的副本。
+func redactValue(v any, blockType string, redact Redaction) any {
+	switch val := v.(type) {
+	case map[string]any:
+		typ := getStringField(val, "type")
+		out := make(map[string]any, len(val))
+		for k, child := range val {
+			if redactField(typ, k, child, redact) {
+				out[k] = redactedValue(child)
+				continue
+			}
+			out[k] = redactValue(child, typ, redact)
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, child := range val {
+			out[i] = redactValue(child, blockType, redact)
+		}
+		return out
+	default:
+		return v
+	}
+}
+
+// redactField reports whether a field must be redacted.
+// 参数：typ 为所属对象的 type 字段，key 为字段名，v 为字段值，redact 为脱敏策略。
+func redactField(typ, key string, v any, redact Redaction) bool {
+	switch key {
+	case "text", "thinking", "result":
+		_, isString := v.(string)
+		return isString && redact&RedactPrompts != 0
+	case "structured_output":
+		return redact&RedactPrompts != 0
+	case "input":
+		return typ == "tool_use" && redact&RedactToolInputs != 0
+	case "partial_json":
+		return redact&RedactToolInputs != 0
+	case "content":
+		return typ == "tool_result" && redact&RedactFileContents != 0
+	case "tool_use_result":
+		return redact&RedactFileContents != 0
+	case "data":
+		return redact&RedactFileContents != 0
+	}
+	return false
+}
+
+// redactedValue describes a redacted value without revealing it.
+func redactedValue(v any) any {
+	if s, ok := v.(string); ok {
+		return redactedString(s)
+	}
+	return "[redacted]"
+}
+
+// redactedString describes a redacted string by its length.
+func redactedString(s string) string {
+	return fmt.Sprintf("[redacted %d bytes]", len(s))
+}
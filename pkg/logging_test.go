@@ -0,0 +1,72 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestLogCommandRedactsPromptsAndEnv(t *testing.T) {
+	var buf bytes.Buffer
+	llm := &LLM{cliPath: "claude", opts: defaultOptions()}
+	llm.opts.Logger = newTestLogger(&buf)
+	llm.opts.Env = map[string]string{"ANTHROPIC_AUTH_TOKEN": "sk-secret"}
+
+	args := llm.buildArgs(invocation{systemPrompt: "系统机密", agents: `{"reviewer":{"description":"d","prompt":"子代理机密"}}`})
+	args = append(args, "--append-system-prompt=追加机密", "--agents={\"a\":{\"prompt\":\"等号机密\"}}")
+	args = append(args, "--print", "--", "用户机密")
+	llm.logCommand(context.Background(), "claude code: command", args)
+
+	out := buf.String()
+	for _, secret := range []string{"sk-secret", "系统机密", "用户机密", "子代理机密", "追加机密", "等号机密"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("log leaks %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, "ANTHROPIC_AUTH_TOKEN=[redacted]") || !strings.Contains(out, "--output-format") || !strings.Contains(out, "--agents") || !strings.Contains(out, "--append-system-prompt=[redacted") {
+		t.Fatalf("unexpected log: %s", out)
+	}
+}
+
+func TestLogLineRedactsAndSamples(t *testing.T) {
+	var buf bytes.Buffer
+	llm := &LLM{opts: defaultOptions()}
+	llm.opts.Logger = newTestLogger(&buf)
+	llm.opts.LogSampling = map[string]int{"stream_event": 3}
+
+	stdout := strings.NewReader(
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"回答机密"},{"type":"tool_use","id":"toolu_1","name":"Read","input":{"file_path":"/etc/secret"}}]}}` + "\n" +
+			`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"文件机密"}]}}` + "\n" +
+			strings.Repeat(`{"type":"stream_event","event":{"type":"ping"}}`+"\n", 6) +
+			`{"type":"result","subtype":"success","result":"回答机密"}` + "\n",
+	)
+	if _, _, err := llm.readStream(context.Background(), stdout, nil); err != nil {
+		t.Fatalf("readStream: %v", err)
+	}
+
+	out := buf.String()
+	for _, secret := range []string{"回答机密", "/etc/secret", "文件机密"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("log leaks %q: %s", secret, out)
+		}
+	}
+	if n := strings.Count(out, `"type":"stream_event"`); n != 2 {
+		t.Fatalf("expected 2 sampled stream_event lines, got %d", n)
+	}
+	if !strings.Contains(out, `\"name\":\"Read\"`) {
+		t.Fatalf("expected tool name to be kept: %s", out)
+	}
+}
+
+func TestLoggingQuietByDefault(t *testing.T) {
+	llm := &LLM{opts: defaultOptions()}
+	if llm.logger().Enabled(context.Background(), slog.LevelError) {
+		t.Fatalf("default logger should be quiet")
+	}
+}
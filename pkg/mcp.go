@@ -0,0 +1,437 @@
+package claudecode
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+const (
+	// bridgeServerName 为内置 MCP server 在 --mcp-config 中的名称。
+	bridgeServerName = "langchaingo"
+	// mcpProtocolVersion 为内置 MCP server 默认声明的协议版本。
+	mcpProtocolVersion = "2025-03-26"
+)
+
+// mcpToolNamePattern 为 MCP 工具名允许的字符集。
+var mcpToolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ToolHandler executes a caller-declared llms.Tool that Claude invoked through
+// the embedded MCP server. The returned text is sent back to Claude as the tool
+// result; a non-nil error is reported to Claude as a failed tool call.
+type ToolHandler func(ctx context.Context, call llms.FunctionCall) (string, error)
+
+// bridgeToolName returns the name Claude Code uses for a bridged tool.
+// 参数：name 为 llms.Tool 的函数名。
+// 返回：mcp__<server>__<name> 形式的工具名。
+func bridgeToolName(name string) string {
+	return "mcp__" + bridgeServerName + "__" + name
+}
+
+// mcpTool 为内置 MCP server 暴露的单个工具。
+type mcpTool struct {
+	Name        string
+	Description string
+	InputSchema any
+	// Call 执行工具，arguments 为 JSON 对象文本。
+	Call func(ctx context.Context, arguments string) (string, error)
+}
+
+// mcpServer 是进程内的 MCP server，使用 Streamable HTTP 传输监听本地回环地址。
+// 本机任意进程都能连接回环端口，因此每个请求必须携带随机生成的 bearer token。
+type mcpServer struct {
+	listener net.Listener
+	server   *http.Server
+	token    string
+	tools    []mcpTool
+	byName   map[string]mcpTool
+	wg       sync.WaitGroup
+}
+
+// startMCPServer starts an MCP server on 127.0.0.1 with a random port.
+// 参数：ctx 为工具调用的基础上下文，tools 为暴露的工具列表。
+// 返回：*mcpServer 与错误。
+func startMCPServer(ctx context.Context, tools []mcpTool) (*mcpServer, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("claude code: mcp token: %w", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("claude code: mcp listen: %w", err)
+	}
+
+	s := &mcpServer{
+		listener: listener,
+		token:    hex.EncodeToString(secret),
+		tools:    tools,
+		byName:   make(map[string]mcpTool, len(tools)),
+	}
+	for _, tool := range tools {
+		s.byName[tool.Name] = tool
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp", s.handleHTTP)
+	s.server = &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		_ = s.server.Serve(listener)
+	}()
+	return s, nil
+}
+
+// URL returns the Streamable HTTP endpoint of the server.
+func (s *mcpServer) URL() string {
+	return "http://" + s.listener.Addr().String() + "/mcp"
+}
+
+// Headers returns the HTTP headers the CLI must send, written into --mcp-config.
+func (s *mcpServer) Headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + s.token}
+}
+
+// authorized reports whether the request carries the server token.
+func (s *mcpServer) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// Close stops the server and waits for the serve loop to exit.
+// 返回：关闭错误。
+func (s *mcpServer) Close() error {
+	err := s.server.Close()
+	s.wg.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// mcpRequest 为 JSON-RPC 2.0 请求或通知。
+type mcpRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// mcpError 为 JSON-RPC 2.0 错误对象。
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// handleHTTP serves a single JSON-RPC POST request.
+func (s *mcpServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		// 拒绝未携带 token 的本地进程调用调用方工具或审批工具。
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		// 不提供服务端推送的 SSE 流。
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req mcpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeMCPResponse(w, nil, nil, &mcpError{Code: -32700, Message: "parse error"})
+		return
+	}
+
+	// 通知没有 id，不需要响应体。
+	if len(req.ID) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	result, rpcErr := s.dispatch(r.Context(), req)
+	writeMCPResponse(w, req.ID, result, rpcErr)
+}
+
+// dispatch routes a JSON-RPC method to its handler.
+// 参数：ctx 为请求上下文，req 为 JSON-RPC 请求。
+// 返回：结果对象与 JSON-RPC 错误。
+func (s *mcpServer) dispatch(ctx context.Context, req mcpRequest) (any, *mcpError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		version := params.ProtocolVersion
+		if version == "" {
+			version = mcpProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities":    map[string]any{"tools": map[string]any{}},
+			"serverInfo":      map[string]any{"name": bridgeServerName, "version": "1.0.0"},
+		}, nil
+	case "ping":
+		return map[string]any{}, nil
+	case "tools/list":
+		tools := make([]map[string]any, 0, len(s.tools))
+		for _, tool := range s.tools {
+			tools = append(tools, map[string]any{
+				"name":        tool.Name,
+				"description": tool.Description,
+				"inputSchema": tool.InputSchema,
+			})
+		}
+		return map[string]any{"tools": tools}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, &mcpError{Code: -32602, Message: "invalid params"}
+		}
+		tool, ok := s.byName[params.Name]
+		if !ok {
+			return nil, &mcpError{Code: -32602, Message: "unknown tool: " + params.Name}
+		}
+		arguments := string(params.Arguments)
+		if arguments == "" || arguments == "null" {
+			arguments = "{}"
+		}
+		output, err := tool.Call(ctx, arguments)
+		if err != nil {
+			return mcpToolResult(err.Error(), true), nil
+		}
+		return mcpToolResult(output, false), nil
+	default:
+		return nil, &mcpError{Code: -32601, Message: "method not found: " + req.Method}
+	}
+}
+
+// mcpToolResult builds a tools/call result with a single text block.
+// 参数：text 为结果文本，isError 为是否执行失败。
+// 返回：tools/call 结果对象。
+func mcpToolResult(text string, isError bool) map[string]any {
+	return map[string]any{
+		"content": []map[string]any{{"type": "text", "text": text}},
+		"isError": isError,
+	}
+}
+
+// writeMCPResponse writes a JSON-RPC response as application/json.
+func writeMCPResponse(w http.ResponseWriter, id json.RawMessage, result any, rpcErr *mcpError) {
+	resp := map[string]any{"jsonrpc": "2.0", "id": id}
+	if rpcErr != nil {
+		resp["error"] = rpcErr
+	} else {
+		resp["result"] = result
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// toolUseSettleTimeout 为返回工具调用模式下等待 stdout 中 tool_use 出现的最长时间。
+const toolUseSettleTimeout = 2 * time.Second
+
+// errToolCallDeferred 为返回工具调用模式下 MCP 调用的占位结果，本轮随后被终止。
+var errToolCallDeferred = errors.New("claude code: tool call returned to caller")
+
+// toolBridge 将调用方的 llms.Tool 通过内置 MCP server 暴露给 CLI。
+type toolBridge struct {
+	server     *mcpServer
+	configPath string
+	toolNames  []string
+
+	// permissionTool 非空时为 --permission-prompt-tool 使用的工具名。
+	permissionTool string
+	// sessionID 为当前 CLI 会话 ID，供权限请求使用。
+	sessionID atomic.Value
+
+	// deferCalls 表示未配置 ToolHandler：工具调用返回给调用方而不是在进程内执行。
+	deferCalls bool
+	// stop 终止本轮 CLI 进程。
+	stop     func()
+	stopOnce sync.Once
+	stopFlag atomic.Bool
+	seen     chan struct{}
+	seenOnce sync.Once
+}
+
+// startToolBridge starts the embedded MCP server for caller-declared tools
+// and the approval tool backing PermissionHandler and ToolPolicy.
+// 未配置 ToolHandler 时，Claude 的工具调用会终止本轮并以 llms.ToolCall 返回。
+// 参数：ctx 为本次调用上下文，tools 为 CallOptions.Tools，stop 用于终止本轮 CLI 进程。
+// 返回：*toolBridge（既无工具也无权限回调时为 nil）与错误。
+func (l *LLM) startToolBridge(ctx context.Context, tools []llms.Tool, stop func()) (*toolBridge, error) {
+	permission := l.permissionHandler()
+	if len(tools) == 0 && permission == nil {
+		return nil, nil
+	}
+
+	handler := l.opts.ToolHandler
+	bridge := &toolBridge{
+		deferCalls: handler == nil && len(tools) > 0,
+		stop:       stop,
+		seen:       make(chan struct{}),
+	}
+	bridge.sessionID.Store(l.opts.SessionID)
+	mcpTools := make([]mcpTool, 0, len(tools)+1)
+	if permission != nil {
+		mcpTools = append(mcpTools, permissionTool(permission, l.opts.PermissionTimeout, bridge.currentSessionID))
+		bridge.permissionTool = bridgeToolName(permissionToolName)
+	}
+	for _, tool := range tools {
+		if tool.Type != "function" || tool.Function == nil {
+			return nil, fmt.Errorf("claude code: unsupported tool type: %q", tool.Type)
+		}
+		fn := tool.Function
+		if !mcpToolNamePattern.MatchString(fn.Name) {
+			return nil, fmt.Errorf("claude code: invalid tool name: %q", fn.Name)
+		}
+		if fn.Name == permissionToolName && permission != nil {
+			return nil, fmt.Errorf("claude code: tool name %q is reserved for the permission handler", fn.Name)
+		}
+		schema := fn.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		name := fn.Name
+		call := func(ctx context.Context, arguments string) (string, error) {
+			return handler(ctx, llms.FunctionCall{Name: name, Arguments: arguments})
+		}
+		if bridge.deferCalls {
+			call = bridge.deferCall
+		}
+		mcpTools = append(mcpTools, mcpTool{
+			Name:        name,
+			Description: fn.Description,
+			InputSchema: schema,
+			Call:        call,
+		})
+		bridge.toolNames = append(bridge.toolNames, bridgeToolName(name))
+	}
+
+	// 调用方配置的 MCP server 与内置 server 写入同一个配置文件。
+	servers, err := l.mcpServersConfig()
+	if err != nil {
+		return nil, err
+	}
+	server, err := startMCPServer(ctx, mcpTools)
+	if err != nil {
+		return nil, err
+	}
+	servers[bridgeServerName] = map[string]any{"type": "http", "url": server.URL(), "headers": server.Headers()}
+	configPath, err := writeMCPConfig(servers)
+	if err != nil {
+		_ = server.Close()
+		return nil, err
+	}
+
+	bridge.server = server
+	bridge.configPath = configPath
+	return bridge, nil
+}
+
+// deferCall handles an MCP tool call in return mode: once the matching tool_use
+// has been parsed from stdout, the CLI process is stopped so the caller can
+// execute the tool itself.
+// 参数：ctx 为 MCP 请求上下文。
+// 返回：始终返回 errToolCallDeferred。
+func (b *toolBridge) deferCall(ctx context.Context, _ string) (string, error) {
+	b.stopOnce.Do(func() {
+		b.stopFlag.Store(true)
+		go func() {
+			// tool_use 在工具执行前已写入 stdout，等待解析器读到后再终止进程。
+			select {
+			case <-b.seen:
+			case <-time.After(toolUseSettleTimeout):
+			case <-ctx.Done():
+			}
+			b.stop()
+		}()
+	})
+	<-ctx.Done()
+	return "", errToolCallDeferred
+}
+
+// markToolUseSeen is called by the stream parser when a bridged tool_use is parsed.
+func (b *toolBridge) markToolUseSeen() {
+	b.seenOnce.Do(func() {
+		close(b.seen)
+	})
+}
+
+// setSessionID records the CLI session ID for permission requests.
+func (b *toolBridge) setSessionID(id string) {
+	b.sessionID.Store(id)
+}
+
+// currentSessionID returns the last recorded CLI session ID.
+func (b *toolBridge) currentSessionID() string {
+	id, _ := b.sessionID.Load().(string)
+	return id
+}
+
+// stopped reports whether the turn was stopped to return tool calls.
+func (b *toolBridge) stopped() bool {
+	return b.stopFlag.Load()
+}
+
+// Close stops the MCP server and removes the generated config file.
+func (b *toolBridge) Close() {
+	if b == nil {
+		return
+	}
+	_ = b.server.Close()
+	_ = os.Remove(b.configPath)
+}
+
+// writeMCPConfig writes an --mcp-config file readable only by the current user.
+// 参数：servers 为 mcpServers 字段内容（名称 -> 配置）。
+// 返回：临时文件路径与错误，调用方负责删除。
+func writeMCPConfig(servers map[string]any) (string, error) {
+	data, err := json.Marshal(map[string]any{"mcpServers": servers})
+	if err != nil {
+		return "", fmt.Errorf("claude code: encode mcp config: %w", err)
+	}
+	// os.CreateTemp 创建的文件权限为 0600。
+	file, err := os.CreateTemp("", "claudecode-mcp-*.json")
+	if err != nil {
+		return "", fmt.Errorf("claude code: create mcp config: %w", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("claude code: write mcp config: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(file.Name())
+		return "", fmt.Errorf("claude code: write mcp config: %w", err)
+	}
+	return file.Name(), nil
+}
@@ -0,0 +1,210 @@
+package claudecode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// newMCPRequest 构造携带 server token 的 JSON-RPC POST 请求。
+func newMCPRequest(t *testing.T, server *mcpServer, body []byte) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, server.URL(), bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("new request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range server.Headers() {
+		req.Header.Set(k, v)
+	}
+	return req
+}
+
+// postMCP 向内置 MCP server 发送一次 JSON-RPC 请求并解析响应。
+func postMCP(t *testing.T, server *mcpServer, method string, params any) map[string]any {
+	t.Helper()
+	body, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	resp, err := http.DefaultClient.Do(newMCPRequest(t, server, body))
+	if err != nil {
+		t.Fatalf("post %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatalf("decode %s: %v", method, err)
+	}
+	return out
+}
+
+func TestToolBridgeServesCallerTools(t *testing.T) {
+	var got llms.FunctionCall
+	llm := &LLM{opts: Options{
+		ToolHandler: func(_ context.Context, call llms.FunctionCall) (string, error) {
+			got = call
+			if call.Name == "fail" {
+				return "", errors.New("boom")
+			}
+			return "晴天", nil
+		},
+	}}
+	tools := []llms.Tool{
+		{Type: "function", Function: &llms.FunctionDefinition{
+			Name:        "get_weather",
+			Description: "查询天气",
+			Parameters:  map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+		}},
+		{Type: "function", Function: &llms.FunctionDefinition{Name: "fail"}},
+	}
+
+	bridge, err := llm.startToolBridge(context.Background(), tools, func() {})
+	if err != nil {
+		t.Fatalf("startToolBridge: %v", err)
+	}
+
+	data, err := os.ReadFile(bridge.configPath)
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	url := bridge.server.URL()
+	if !strings.Contains(string(data), url) || !strings.Contains(string(data), `"Authorization":"Bearer `+bridge.server.token+`"`) {
+		t.Fatalf("config missing server url or token: %s", data)
+	}
+	if info, err := os.Stat(bridge.configPath); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected config permissions: %v %v", info, err)
+	}
+	if strings.Join(bridge.toolNames, ",") != "mcp__langchaingo__get_weather,mcp__langchaingo__fail" {
+		t.Fatalf("unexpected tool names: %v", bridge.toolNames)
+	}
+
+	init := postMCP(t, bridge.server, "initialize", map[string]any{"protocolVersion": "2025-06-18"})
+	if v := init["result"].(map[string]any)["protocolVersion"]; v != "2025-06-18" {
+		t.Fatalf("unexpected protocol version: %v", v)
+	}
+
+	list := postMCP(t, bridge.server, "tools/list", nil)
+	listed := list["result"].(map[string]any)["tools"].([]any)
+	if len(listed) != 2 || listed[0].(map[string]any)["name"] != "get_weather" {
+		t.Fatalf("unexpected tools/list: %v", list)
+	}
+
+	call := postMCP(t, bridge.server, "tools/call", map[string]any{"name": "get_weather", "arguments": map[string]any{"city": "上海"}})
+	result := call["result"].(map[string]any)
+	if result["isError"] != false || result["content"].([]any)[0].(map[string]any)["text"] != "晴天" {
+		t.Fatalf("unexpected tools/call result: %v", call)
+	}
+	if got.Name != "get_weather" || got.Arguments != `{"city":"上海"}` {
+		t.Fatalf("unexpected handler call: %+v", got)
+	}
+
+	failed := postMCP(t, bridge.server, "tools/call", map[string]any{"name": "fail"})
+	if failed["result"].(map[string]any)["isError"] != true {
+		t.Fatalf("expected tool error result: %v", failed)
+	}
+
+	unknown := postMCP(t, bridge.server, "resources/list", nil)
+	if _, ok := unknown["error"]; !ok {
+		t.Fatalf("expected method not found: %v", unknown)
+	}
+
+	unauthorized, err := http.Post(url, "application/json", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"get_weather"}}`))
+	if err != nil {
+		t.Fatalf("post without token: %v", err)
+	}
+	unauthorized.Body.Close()
+	if unauthorized.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", unauthorized.StatusCode)
+	}
+
+	bridge.Close()
+	if _, err := os.Stat(bridge.configPath); !os.IsNotExist(err) {
+		t.Fatalf("config file not removed: %v", err)
+	}
+}
+
+func TestBuildArgsIncludesToolBridge(t *testing.T) {
+	llm := &LLM{opts: Options{AllowedTools: []string{"Read"}}}
+	args := strings.Join(llm.buildArgs(invocation{
+		mcpConfigPath: "/tmp/mcp.json",
+		allowedTools:  []string{"mcp__langchaingo__get_weather"},
+	}), " ")
+	if !strings.Contains(args, "--allowedTools Read,mcp__langchaingo__get_weather") {
+		t.Fatalf("missing allowed tools: %s", args)
+	}
+	if !strings.Contains(args, "--mcp-config /tmp/mcp.json") {
+		t.Fatalf("missing mcp config: %s", args)
+	}
+}
+
+func TestToolBridgeDefersCallsWithoutHandler(t *testing.T) {
+	llm := &LLM{}
+	stopped := make(chan struct{})
+	tools := []llms.Tool{{Type: "function", Function: &llms.FunctionDefinition{Name: "get_weather"}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	bridge, err := llm.startToolBridge(ctx, tools, func() {
+		close(stopped)
+		cancel()
+	})
+	if err != nil {
+		t.Fatalf("startToolBridge: %v", err)
+	}
+	defer bridge.Close()
+	if !bridge.deferCalls {
+		t.Fatalf("expected return mode without handler")
+	}
+
+	body := `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"get_weather","arguments":{}}}`
+	req := newMCPRequest(t, bridge.server, []byte(body))
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	select {
+	case <-stopped:
+		t.Fatalf("stopped before tool_use was parsed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	bridge.markToolUseSeen()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("turn was not stopped")
+	}
+	if !bridge.stopped() {
+		t.Fatalf("expected stopped flag")
+	}
+}
+
+func TestReadStreamCollectsBridgedToolCalls(t *testing.T) {
+	llm := &LLM{}
+	seen := 0
+	parser := llm.newStreamParser(nil)
+	parser.onBridgedToolUse = func() { seen++ }
+	stdout := strings.NewReader(
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"查一下"}]}}` + "\n" +
+			`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_1","name":"mcp__langchaingo__get_weather","input":{"city":"上海"}}]}}` + "\n" +
+			`{"type":"assistant","message":{"content":[{"type":"tool_use","id":"toolu_2","name":"Read","input":{"file_path":"a.txt"}}]}}` + "\n",
+	)
+	if err := llm.consumeStream(context.Background(), stdout, parser); err != nil {
+		t.Fatalf("consumeStream: %v", err)
+	}
+	if seen != 1 || len(parser.toolCalls) != 1 {
+		t.Fatalf("unexpected tool calls: %+v", parser.toolCalls)
+	}
+	call := parser.toolCalls[0]
+	if call.ID != "toolu_1" || call.Type != "function" || call.FunctionCall.Name != "get_weather" || call.FunctionCall.Arguments != `{"city":"上海"}` {
+		t.Fatalf("unexpected tool call: %+v %+v", call, call.FunctionCall)
+	}
+}
@@ -0,0 +1,150 @@
+package claudecode
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ErrInvalidMCPServer is returned when an MCPServer definition is incomplete or conflicts with another.
+var ErrInvalidMCPServer = errors.New("claude code: invalid mcp server")
+
+// MCPTransport 为 MCP server 的传输方式。
+type MCPTransport string
+
+const (
+	// MCPStdio 以子进程方式启动，经 stdin/stdout 通信。
+	MCPStdio MCPTransport = "stdio"
+	// MCPSSE 为 Server-Sent Events 传输。
+	MCPSSE MCPTransport = "sse"
+	// MCPHTTP 为 Streamable HTTP 传输。
+	MCPHTTP MCPTransport = "http"
+)
+
+// MCPServer 描述一个交给 CLI 连接的 MCP server。
+type MCPServer struct {
+	// Name 为 server 名称，工具以 mcp__<Name>__<tool> 出现；只能包含字母、数字、_ 与 -。
+	Name string
+	// Type 为传输方式，为空时按 Command（stdio）或 URL（http）推断。
+	Type MCPTransport
+	// Command、Args、Env 用于 stdio server。
+	Command string
+	Args    []string
+	Env     map[string]string
+	// URL、Headers 用于 sse / http server。
+	URL     string
+	Headers map[string]string
+}
+
+// transport returns the explicit or inferred transport.
+func (s MCPServer) transport() MCPTransport {
+	switch {
+	case s.Type != "":
+		return s.Type
+	case s.Command != "":
+		return MCPStdio
+	default:
+		return MCPHTTP
+	}
+}
+
+// config returns the server entry of the --mcp-config file.
+func (s MCPServer) config() map[string]any {
+	transport := s.transport()
+	entry := map[string]any{"type": string(transport)}
+	if transport == MCPStdio {
+		entry["command"] = s.Command
+		if len(s.Args) > 0 {
+			entry["args"] = append([]string{}, s.Args...)
+		}
+		if len(s.Env) > 0 {
+			entry["env"] = maps.Clone(s.Env)
+		}
+		return entry
+	}
+	entry["url"] = s.URL
+	if len(s.Headers) > 0 {
+		entry["headers"] = maps.Clone(s.Headers)
+	}
+	return entry
+}
+
+// validateMCPServers checks names, transports and required fields.
+// 参数：servers 为 Options.MCPServers。
+// 返回：第一个无效定义对应的错误（包装 ErrInvalidMCPServer）。
+func validateMCPServers(servers []MCPServer) error {
+	seen := make(map[string]bool, len(servers))
+	for _, s := range servers {
+		invalid := func(reason string) error {
+			return fmt.Errorf("%w: %q: %s", ErrInvalidMCPServer, s.Name, reason)
+		}
+		switch {
+		case !mcpToolNamePattern.MatchString(s.Name):
+			return invalid("name must match " + mcpToolNamePattern.String())
+		case s.Name == bridgeServerName:
+			return invalid("name is reserved for caller tools")
+		case seen[s.Name]:
+			return invalid("duplicate name")
+		}
+		seen[s.Name] = true
+
+		switch s.transport() {
+		case MCPStdio:
+			if s.Command == "" {
+				return invalid("stdio server requires Command")
+			}
+		case MCPSSE, MCPHTTP:
+			if s.URL == "" {
+				return invalid(string(s.transport()) + " server requires URL")
+			}
+		default:
+			return invalid("unknown transport " + string(s.Type))
+		}
+	}
+	return nil
+}
+
+// mcpServersConfig returns the mcpServers entries for Options.MCPServers.
+// 返回：名称 -> 配置，定义无效时返回错误。
+func (l *LLM) mcpServersConfig() (map[string]any, error) {
+	if err := validateMCPServers(l.opts.MCPServers); err != nil {
+		return nil, err
+	}
+	servers := make(map[string]any, len(l.opts.MCPServers)+1)
+	for _, s := range l.opts.MCPServers {
+		servers[s.Name] = s.config()
+	}
+	return servers, nil
+}
+
+// writeMCPServersConfig writes an --mcp-config file with only Options.MCPServers.
+// 返回：临时文件路径与错误，调用方负责删除。
+func (l *LLM) writeMCPServersConfig() (string, error) {
+	servers, err := l.mcpServersConfig()
+	if err != nil {
+		return "", err
+	}
+	return writeMCPConfig(servers)
+}
+
+// removeIfSet removes a temporary file when path is not empty.
+func removeIfSet(path string) {
+	if path != "" {
+		_ = os.Remove(path)
+	}
+}
+
+// ResponseMCPServers extracts the MCP server statuses reported in system init.
+// 参数：resp 为 GenerateContent 的返回值。
+// 返回：各 server 的连接状态（含内置的 langchaingo server）与是否存在。
+func ResponseMCPServers(resp *llms.ContentResponse) ([]stream.MCPServerStatus, bool) {
+	if resp == nil || len(resp.Choices) == 0 || resp.Choices[0] == nil {
+		return nil, false
+	}
+	statuses, ok := resp.Choices[0].GenerationInfo["MCPServers"].([]stream.MCPServerStatus)
+	return statuses, ok
+}
@@ -0,0 +1,108 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestWithMCPServersWritesConfig(t *testing.T) {
+	fake := claudetest.New(t).Replay(
+		`{"type":"system","subtype":"init","session_id":"sess-mcp","mcp_servers":[{"name":"github","status":"connected"},{"name":"tickets","status":"failed"}]}`,
+		`{"type":"result","subtype":"success","session_id":"sess-mcp","result":"ok"}`,
+	)
+	llm, err := New(
+		WithCLIPath(fake.Path),
+		WithStrictMCPConfig(true),
+		WithMCPServers(
+			MCPServer{Name: "github", Command: "github-mcp", Args: []string{"stdio"}, Env: map[string]string{"GITHUB_TOKEN": "t"}},
+			MCPServer{Name: "tickets", Type: MCPSSE, URL: "https://mcp.example.com/sse", Headers: map[string]string{"Authorization": "Bearer x"}},
+		),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	resp, err := llm.GenerateContent(context.Background(), []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "hi")})
+	if err != nil {
+		t.Fatalf("GenerateContent: %v", err)
+	}
+
+	inv := fake.LastInvocation()
+	file, ok := inv.File("--mcp-config")
+	if !ok {
+		t.Fatalf("missing --mcp-config: %q", inv.Args)
+	}
+	var config struct {
+		MCPServers map[string]map[string]any `json:"mcpServers"`
+	}
+	if err := json.Unmarshal([]byte(file.Content), &config); err != nil {
+		t.Fatalf("decode config: %v", err)
+	}
+	github := config.MCPServers["github"]
+	if github["type"] != "stdio" || github["command"] != "github-mcp" || github["env"].(map[string]any)["GITHUB_TOKEN"] != "t" {
+		t.Fatalf("unexpected stdio config: %v", github)
+	}
+	tickets := config.MCPServers["tickets"]
+	if tickets["type"] != "sse" || tickets["url"] != "https://mcp.example.com/sse" || tickets["headers"].(map[string]any)["Authorization"] != "Bearer x" {
+		t.Fatalf("unexpected sse config: %v", tickets)
+	}
+	if _, ok := config.MCPServers[bridgeServerName]; ok {
+		t.Fatalf("bridge server should not be started without tools")
+	}
+	if file.Mode != 0o600 {
+		t.Fatalf("unexpected config mode: %v", file.Mode)
+	}
+	if _, err := os.Stat(inv.Flag("--mcp-config")); !os.IsNotExist(err) {
+		t.Fatalf("config file not removed: %v", err)
+	}
+	if !inv.HasFlag("--strict-mcp-config") {
+		t.Fatalf("missing --strict-mcp-config")
+	}
+
+	statuses, ok := ResponseMCPServers(resp)
+	if !ok || len(statuses) != 2 || statuses[1].Name != "tickets" || statuses[1].Status != "failed" {
+		t.Fatalf("unexpected statuses: %+v", statuses)
+	}
+}
+
+func TestMCPServersMergedWithToolBridge(t *testing.T) {
+	llm := &LLM{opts: Options{
+		MCPServers: []MCPServer{{Name: "docs", URL: "http://127.0.0.1:9/mcp"}},
+		ToolHandler: func(context.Context, llms.FunctionCall) (string, error) {
+			return "", nil
+		},
+	}}
+	tools := []llms.Tool{{Type: "function", Function: &llms.FunctionDefinition{Name: "lookup"}}}
+	bridge, err := llm.startToolBridge(context.Background(), tools, func() {})
+	if err != nil {
+		t.Fatalf("startToolBridge: %v", err)
+	}
+	defer bridge.Close()
+
+	data := readTestFile(t, bridge.configPath)
+	if !strings.Contains(data, `"docs":{"type":"http","url":"http://127.0.0.1:9/mcp"}`) || !strings.Contains(data, bridge.server.URL()) {
+		t.Fatalf("config missing servers: %s", data)
+	}
+}
+
+func TestValidateMCPServers(t *testing.T) {
+	invalid := [][]MCPServer{
+		{{Name: "bad name", Command: "x"}},
+		{{Name: bridgeServerName, Command: "x"}},
+		{{Name: "a", Command: "x"}, {Name: "a", URL: "http://x"}},
+		{{Name: "a", Type: MCPStdio}},
+		{{Name: "a", Type: MCPHTTP}},
+		{{Name: "a", Type: "websocket", URL: "ws://x"}},
+	}
+	for _, servers := range invalid {
+		if _, err := New(WithCLIPath("claude"), WithMCPServers(servers...)); !errors.Is(err, ErrInvalidMCPServer) {
+			t.Errorf("%+v: expected ErrInvalidMCPServer, got %v", servers, err)
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package claudecode
 
-import "time"
+import (
+	"log/slog"
+	"maps"
+	"time"
+)
 
 // OutputMode 控制输出内容的详细程度。
 type OutputMode int
@@ -28,6 +32,33 @@ func (m OutputMode) String() string {
 	}
 }
 
+// PromptInputMode 控制 prompt 与系统提示词的传递方式。
+type PromptInputMode int
+
+const (
+	// PromptInputAuto 超过 PromptStdinThreshold 时改用 stdin / 临时文件传递 (默认行为)。
+	// 默认阈值为 0，即 prompt 与系统提示词都不出现在 argv 中。
+	PromptInputAuto PromptInputMode = iota
+	// PromptInputArgv 始终作为命令行参数传递。
+	PromptInputArgv
+	// PromptInputStdin 始终经 stdin 传递 prompt，系统提示词写入 --system-prompt-file。
+	PromptInputStdin
+)
+
+// String 返回 PromptInputMode 的字符串表示。
+func (m PromptInputMode) String() string {
+	switch m {
+	case PromptInputAuto:
+		return "auto"
+	case PromptInputArgv:
+		return "argv"
+	case PromptInputStdin:
+		return "stdin"
+	default:
+		return "unknown"
+	}
+}
+
 // ToolEventType 工具事件类型。
 type ToolEventType int
 
@@ -57,7 +88,19 @@ type ToolEvent struct {
 	ToolID    string         // 工具调用 ID
 	Input     map[string]any // tool_use 时的输入参数
 	Output    string         // tool_result 时的输出内容
+	IsError   bool           // tool_result 是否为执行失败
+	Images    []ToolImage    // tool_result 中的图片输出
+	Duration  time.Duration  // tool_result 距对应 tool_use 的耗时，未匹配时为 0
 	Timestamp time.Time      // 事件时间戳
+
+	ParentToolUseID string // 由 subagent 产生时为启动它的 Task 调用 ID，主 agent 的事件为空
+	Agent           string // 由 subagent 产生时为其 subagent_type，e.g. "security-reviewer"
+}
+
+// ToolImage 工具结果中的图片。
+type ToolImage struct {
+	MediaType string // MIME 类型，e.g. "image/png"
+	Data      []byte // 解码后的图片内容
 }
 
 // ToolEventHook 工具事件回调函数类型。
@@ -87,12 +130,31 @@ type Options struct {
 	ExtraArgs map[string]string
 	// MaxBufferSize sets the maximum stdout line size for stream-json parsing.
 	MaxBufferSize int
+	// MaxAttachmentSize limits the size of each image or binary message part.
+	MaxAttachmentSize int
 	// OutputMode 控制输出内容的详细程度。
 	OutputMode OutputMode
 	// ToolEventHook 工具事件回调，当 Agent 调用工具时触发。
 	ToolEventHook ToolEventHook
 	// ThinkingTags 控制是否将 Claude 的 thinking block 渲染为 <think>...</think> 文本。
 	ThinkingTags bool
+	// ToolHandler 执行 CallOptions.Tools 中声明的工具，经内置 MCP server 暴露给 CLI。
+	// 为空时工具调用会终止本轮，并以 ContentChoice.ToolCalls 返回给调用方。
+	ToolHandler ToolHandler
+	// PartialMessages 传入 --include-partial-messages，按 token 增量回调 StreamingFunc。
+	PartialMessages bool
+	// CancelGracePeriod 为取消时 SIGINT 与强制终止进程组之间的宽限期。
+	CancelGracePeriod time.Duration
+	// Logger 接收调试日志，为空时不输出任何日志。
+	Logger *slog.Logger
+	// Redaction 控制日志脱敏范围，默认 RedactAll。
+	Redaction Redaction
+	// LogSampling 按 stream-json 消息类型采样日志，值 N 表示每 N 条记录 1 条。
+	LogSampling map[string]int
+	// PromptInput 控制 prompt 经命令行参数还是 stdin 传递。
+	PromptInput PromptInputMode
+	// PromptStdinThreshold 为 PromptInputAuto 下改用 stdin 的字节数阈值，0 表示始终使用 stdin。
+	PromptStdinThreshold int
 
 	// SessionID 指定会话 ID（UUID 格式），用于恢复/继续特定会话。
 	// 当设置时，Claude CLI 将加载并继续该会话的对话历史。
@@ -103,6 +165,39 @@ type Options struct {
 	ForkSession bool
 	// NoSessionPersistence 禁用 session 持久化（仅 --print 模式有效）。
 	NoSessionPersistence bool
+	// HistoryStrategy 控制恢复会话时发送的历史范围。
+	HistoryStrategy HistoryStrategy
+	// SessionQueueDepth 为同一会话允许排队等待的调用数，超出时返回 ErrSessionBusy。
+	SessionQueueDepth int
+	// SessionQueueTimeout 为同一会话的最长排队时间，0 表示仅受 ctx 限制。
+	SessionQueueTimeout time.Duration
+	// Limiter 限制同时运行的 CLI 进程数，可在多个 LLM 之间共享；为空时不限制。
+	Limiter *Limiter
+	// Priority 为在 Limiter 中排队时的优先级。
+	Priority Priority
+	// PermissionHandler 非空时，CLI 执行未被预先允许的工具前通过 --permission-prompt-tool 询问该回调；
+	// 默认的 bypassPermissions 会改为 default 模式。
+	PermissionHandler PermissionHandler
+	// ToolPolicy 为声明式工具策略，可与 PermissionHandler 组合（未命中规则的请求交给回调）。
+	ToolPolicy *ToolPolicy
+	// PermissionTimeout 为单次权限决策的最长等待时间，超时视为拒绝；0 表示仅受本轮上下文限制。
+	PermissionTimeout time.Duration
+	// MCPServers 为交给 CLI 连接的 MCP server，与内置的调用方工具 server 写入同一个临时 --mcp-config 文件。
+	MCPServers []MCPServer
+	// StrictMCPConfig 为 true 时传递 --strict-mcp-config，忽略用户与项目级的 MCP 配置。
+	StrictMCPConfig bool
+	// Agents 为经 --agents 注册的自定义 subagent，键为名称，主 agent 通过 Task 工具委派。
+	Agents map[string]AgentDefinition
+	// JSONSchema 非空时经 --json-schema 请求结构化输出，并在返回前校验；
+	// 可为 JSON 文本（string、[]byte、json.RawMessage）或可编码为 JSON 的值。
+	JSONSchema any
+	// StructuredOutputRetries 为 GenerateJSON 在输出未通过校验时的重试次数。
+	StructuredOutputRetries int
+	// RecordDir 非空时，每次 CLI 运行的参数、环境变量（按 Redaction 脱敏）与原始 stdout/stderr
+	// 写入该目录下的独立子目录。
+	RecordDir string
+	// ReplayDir 非空时 GenerateContent 从录制目录回放输出，不启动 CLI。
+	ReplayDir string
 }
 
 // Option mutates Options.
@@ -111,14 +206,30 @@ type Option func(*Options)
 const (
 	defaultPermissionMode = "bypassPermissions"
 	defaultMaxBufferSize  = 1024 * 1024
+	// defaultMaxAttachmentSize 与 Anthropic API 单张图片 5MB 的上限一致。
+	defaultMaxAttachmentSize = 5 * 1024 * 1024
+	// defaultPromptStdinThreshold 为 0：用户内容默认不进入 argv，避免经 ps 泄露。
+	defaultPromptStdinThreshold = 0
+	// defaultCancelGracePeriod 留给 CLI 保存会话记录并清理子进程的时间。
+	defaultCancelGracePeriod = 5 * time.Second
+	// defaultSessionQueueDepth 足以覆盖群聊中多人同时发言的场景。
+	defaultSessionQueueDepth = 16
+	// defaultStructuredOutputRetries 覆盖偶发的格式错误，同时限制额外开销。
+	defaultStructuredOutputRetries = 2
 )
 
 func defaultOptions() Options {
 	return Options{
-		PermissionMode: defaultPermissionMode,
-		MaxBufferSize:  defaultMaxBufferSize,
-		Env:            map[string]string{},
-		ExtraArgs:      map[string]string{},
+		PermissionMode:          defaultPermissionMode,
+		MaxBufferSize:           defaultMaxBufferSize,
+		MaxAttachmentSize:       defaultMaxAttachmentSize,
+		PromptStdinThreshold:    defaultPromptStdinThreshold,
+		Redaction:               RedactAll,
+		CancelGracePeriod:       defaultCancelGracePeriod,
+		SessionQueueDepth:       defaultSessionQueueDepth,
+		StructuredOutputRetries: defaultStructuredOutputRetries,
+		Env:                     map[string]string{},
+		ExtraArgs:               map[string]string{},
 	}
 }
 
@@ -207,6 +318,16 @@ func WithMaxBufferSize(size int) Option {
 	}
 }
 
+// WithMaxAttachmentSize sets the maximum size of each image or binary part.
+// 参数：size 为字节数，超过时 GenerateContent 返回 ErrAttachmentTooLarge。
+func WithMaxAttachmentSize(size int) Option {
+	return func(o *Options) {
+		if size > 0 {
+			o.MaxAttachmentSize = size
+		}
+	}
+}
+
 // WithOutputMode sets the output detail level.
 // 参数：mode 为 OutputMode 枚举值。
 func WithOutputMode(mode OutputMode) Option {
@@ -230,6 +351,81 @@ func WithThinkingTags(enabled bool) Option {
 	}
 }
 
+// WithToolHandler sets the handler for caller-declared llms.Tool definitions.
+// 参数：handler 为工具执行函数。
+// 设置后 CallOptions.Tools 会经内置 MCP server（--mcp-config）暴露给 CLI，
+// Claude 调用工具时由 handler 在当前进程内执行；未设置时工具调用返回给调用方。
+func WithToolHandler(handler ToolHandler) Option {
+	return func(o *Options) {
+		o.ToolHandler = handler
+	}
+}
+
+// WithPartialMessages enables incremental token deltas via --include-partial-messages.
+// 参数：enabled 为是否启用增量输出。
+// 开启后 text/thinking 增量会立即回调 StreamingFunc，最终 assistant 消息不再重复输出。
+func WithPartialMessages(enabled bool) Option {
+	return func(o *Options) {
+		o.PartialMessages = enabled
+	}
+}
+
+// WithCancelGracePeriod sets how long a cancelled CLI may run after SIGINT.
+// 参数：grace 为宽限期，超时后整个进程组被 SIGKILL；0 表示立即强制终止。
+func WithCancelGracePeriod(grace time.Duration) Option {
+	return func(o *Options) {
+		if grace >= 0 {
+			o.CancelGracePeriod = grace
+		}
+	}
+}
+
+// WithLogger sets the structured logger for commands and stream-json lines.
+// 参数：logger 为 slog 日志器，命令与每行 stream-json 以 Debug 级别记录。
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithRedaction sets which content is redacted from logs.
+// 参数：redact 为 Redaction 位组合，RedactNone 表示不脱敏。
+func WithRedaction(redact Redaction) Option {
+	return func(o *Options) {
+		o.Redaction = redact
+	}
+}
+
+// WithLogSampling samples stream-json logs per message type.
+// 参数：every 为消息类型到采样间隔的映射，e.g. {"stream_event": 100}。
+func WithLogSampling(every map[string]int) Option {
+	return func(o *Options) {
+		o.LogSampling = make(map[string]int, len(every))
+		for k, v := range every {
+			o.LogSampling[k] = v
+		}
+	}
+}
+
+// WithPromptInput sets how the prompt and system prompt are passed to the CLI.
+// 参数：mode 为 PromptInputMode 枚举值。
+// 经 stdin 传递时 prompt 不会出现在 argv（ps 可见）中，也不受 ARG_MAX 限制。
+func WithPromptInput(mode PromptInputMode) Option {
+	return func(o *Options) {
+		o.PromptInput = mode
+	}
+}
+
+// WithPromptStdinThreshold sets the size above which PromptInputAuto switches to stdin.
+// 参数：size 为字节数；不超过该大小的内容经 argv 传递，会在 ps 中可见。
+func WithPromptStdinThreshold(size int) Option {
+	return func(o *Options) {
+		if size > 0 {
+			o.PromptStdinThreshold = size
+		}
+	}
+}
+
 // WithSessionID sets the session ID for conversation continuity.
 // 参数：sessionID 为 UUID 格式的会话 ID。
 // 设置后 Claude CLI 将加载并继续该会话的对话历史。
@@ -265,3 +461,122 @@ func WithNoSessionPersistence(disabled bool) Option {
 		o.NoSessionPersistence = disabled
 	}
 }
+
+// WithHistoryStrategy sets how much history is sent when resuming a session.
+// 参数：strategy 为 HistoryStrategy 枚举值。
+// 恢复会话时 CLI 已从会话记录中加载历史，HistoryLastTurn / HistoryDiff 可避免重复发送。
+func WithHistoryStrategy(strategy HistoryStrategy) Option {
+	return func(o *Options) {
+		o.HistoryStrategy = strategy
+	}
+}
+
+// WithSessionQueue configures per-session serialization.
+// 参数：depth 为同一会话允许排队的调用数（0 表示会话忙时立即返回 ErrSessionBusy），
+// timeout 为最长排队时间（0 表示仅受 ctx 限制）。
+func WithSessionQueue(depth int, timeout time.Duration) Option {
+	return func(o *Options) {
+		if depth >= 0 {
+			o.SessionQueueDepth = depth
+		}
+		if timeout >= 0 {
+			o.SessionQueueTimeout = timeout
+		}
+	}
+}
+
+// WithLimiter sets a process limiter shared with other LLM instances.
+// 参数：limiter 为 NewLimiter 创建的限流器，为空时不限制。
+func WithLimiter(limiter *Limiter) Option {
+	return func(o *Options) {
+		o.Limiter = limiter
+	}
+}
+
+// WithPriority sets the queue priority in the Limiter.
+// 参数：priority 为 Priority 枚举值，可配合 WithCallOptions 按调用设置。
+func WithPriority(priority Priority) Option {
+	return func(o *Options) {
+		o.Priority = priority
+	}
+}
+
+// WithPermissionHandler routes CLI permission prompts to a Go callback.
+// 参数：handler 为权限决策回调，可阻塞等待人工审批（见 PermissionQueue）。
+func WithPermissionHandler(handler PermissionHandler) Option {
+	return func(o *Options) {
+		o.PermissionHandler = handler
+	}
+}
+
+// WithToolPolicy enforces a declarative tool policy.
+// 参数：policy 为工具策略，New 时校验。
+func WithToolPolicy(policy *ToolPolicy) Option {
+	return func(o *Options) {
+		o.ToolPolicy = policy
+	}
+}
+
+// WithPermissionTimeout bounds how long a single permission decision may take.
+// 参数：timeout 为最长等待时间，超时视为拒绝。
+func WithPermissionTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.PermissionTimeout = timeout
+	}
+}
+
+// WithMCPServers sets the MCP servers the CLI connects to.
+// 参数：servers 为 MCP server 定义，New 时校验，可配合 WithCallOptions 按租户设置。
+func WithMCPServers(servers ...MCPServer) Option {
+	return func(o *Options) {
+		o.MCPServers = append([]MCPServer{}, servers...)
+	}
+}
+
+// WithStrictMCPConfig ignores MCP servers configured outside the adapter.
+// 参数：strict 为 true 时仅使用 WithMCPServers 与内置 server。
+func WithStrictMCPConfig(strict bool) Option {
+	return func(o *Options) {
+		o.StrictMCPConfig = strict
+	}
+}
+
+// WithAgents registers custom subagents without files in .claude/agents.
+// 参数：agents 为名称 -> 定义，New 时校验，可配合 WithCallOptions 按次设置。
+func WithAgents(agents map[string]AgentDefinition) Option {
+	return func(o *Options) {
+		o.Agents = maps.Clone(agents)
+	}
+}
+
+// WithJSONSchema requests structured output matching a JSON Schema.
+// 参数：schema 为 JSON 文本或可编码为 JSON 的值（如 map[string]any）。
+func WithJSONSchema(schema any) Option {
+	return func(o *Options) {
+		o.JSONSchema = schema
+	}
+}
+
+// WithStructuredOutputRetries sets how often GenerateJSON retries invalid output.
+// 参数：retries 为重试次数，0 表示不重试。
+func WithStructuredOutputRetries(retries int) Option {
+	return func(o *Options) {
+		o.StructuredOutputRetries = retries
+	}
+}
+
+// WithRecordDir records each CLI run for bug reports and golden tests.
+// 参数：dir 为录制根目录，不存在时自动创建。
+func WithRecordDir(dir string) Option {
+	return func(o *Options) {
+		o.RecordDir = dir
+	}
+}
+
+// WithReplayDir serves GenerateContent from recordings instead of spawning the CLI.
+// 参数：dir 为单次运行目录（每次调用都回放它）或 WithRecordDir 的根目录（按顺序逐个回放）。
+func WithReplayDir(dir string) Option {
+	return func(o *Options) {
+		o.ReplayDir = dir
+	}
+}
@@ -0,0 +1,222 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// permissionToolName 为内置 MCP server 上供 --permission-prompt-tool 调用的工具名。
+const permissionToolName = "approve"
+
+// ErrPermissionNotPending is returned by PermissionQueue.Resolve for unknown or already resolved requests.
+var ErrPermissionNotPending = errors.New("claude code: permission request not pending")
+
+// PermissionBehavior 为权限决策结果。
+type PermissionBehavior string
+
+const (
+	// PermissionAllow 允许工具执行。
+	PermissionAllow PermissionBehavior = "allow"
+	// PermissionDeny 拒绝工具执行，Message 会反馈给 Claude。
+	PermissionDeny PermissionBehavior = "deny"
+)
+
+// PermissionRequest 描述 CLI 在执行工具前请求的授权。
+type PermissionRequest struct {
+	// ToolName 为工具名，如 Bash、Write 或 mcp__server__tool。
+	ToolName string
+	// Input 为工具输入参数。
+	Input map[string]any
+	// ToolUseID 为对应 tool_use 的 ID，可能为空。
+	ToolUseID string
+	// SessionID 为发起请求的 CLI 会话 ID，会话尚未初始化时为空。
+	SessionID string
+}
+
+// PermissionDecision 为 PermissionHandler 的决策。
+type PermissionDecision struct {
+	Behavior PermissionBehavior
+	// UpdatedInput 非空时以修改后的参数执行工具，仅对 PermissionAllow 生效。
+	UpdatedInput map[string]any
+	// Message 为拒绝原因，仅对 PermissionDeny 生效。
+	Message string
+	// Interrupt 为 true 时拒绝后终止本轮，而不是让 Claude 换一种方式继续。
+	Interrupt bool
+}
+
+// PermissionHandler decides whether Claude may run a tool. It may block, e.g.
+// while a human approves the request in chat; ctx is cancelled when the turn
+// ends or Options.PermissionTimeout elapses. A non-nil error denies the request.
+type PermissionHandler func(ctx context.Context, req PermissionRequest) (PermissionDecision, error)
+
+// permissionTool builds the MCP tool consulted via --permission-prompt-tool.
+// 参数：handler 为调用方的 PermissionHandler，timeout 为单次决策的最长等待时间，
+// sessionID 返回当前会话 ID。
+// 返回：mcpTool。
+func permissionTool(handler PermissionHandler, timeout time.Duration, sessionID func() string) mcpTool {
+	return mcpTool{
+		Name:        permissionToolName,
+		Description: "Decides whether a tool call is permitted.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"tool_name":   map[string]any{"type": "string"},
+				"input":       map[string]any{"type": "object"},
+				"tool_use_id": map[string]any{"type": "string"},
+			},
+			"required": []string{"tool_name", "input"},
+		},
+		Call: func(ctx context.Context, arguments string) (string, error) {
+			var params struct {
+				ToolName  string         `json:"tool_name"`
+				Input     map[string]any `json:"input"`
+				ToolUseID string         `json:"tool_use_id"`
+			}
+			if err := json.Unmarshal([]byte(arguments), &params); err != nil {
+				return "", fmt.Errorf("claude code: decode permission request: %w", err)
+			}
+			req := PermissionRequest{
+				ToolName:  params.ToolName,
+				Input:     params.Input,
+				ToolUseID: params.ToolUseID,
+				SessionID: sessionID(),
+			}
+			return encodePermissionDecision(req, decidePermission(ctx, handler, timeout, req))
+		},
+	}
+}
+
+// decidePermission runs the handler, denying on errors and timeouts.
+// 参数：ctx 为 MCP 请求上下文，handler 为决策回调，timeout 为最长等待时间（<=0 不限制），req 为请求。
+// 返回：最终决策。
+func decidePermission(ctx context.Context, handler PermissionHandler, timeout time.Duration, req PermissionRequest) PermissionDecision {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	decision, err := handler(ctx, req)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return PermissionDecision{Behavior: PermissionDeny, Message: "permission request timed out"}
+	case err != nil:
+		return PermissionDecision{Behavior: PermissionDeny, Message: err.Error()}
+	}
+	return decision
+}
+
+// encodePermissionDecision encodes a decision in the format the CLI expects.
+// 参数：req 为原始请求，decision 为决策。
+// 返回：JSON 文本与错误。
+func encodePermissionDecision(req PermissionRequest, decision PermissionDecision) (string, error) {
+	var payload map[string]any
+	if decision.Behavior == PermissionAllow {
+		// CLI 要求 allow 时携带 updatedInput，未修改时回传原始参数。
+		input := decision.UpdatedInput
+		if input == nil {
+			input = req.Input
+		}
+		if input == nil {
+			input = map[string]any{}
+		}
+		payload = map[string]any{"behavior": string(PermissionAllow), "updatedInput": input}
+	} else {
+		// 未知的决策一律按拒绝处理。
+		message := decision.Message
+		if message == "" {
+			message = "permission denied"
+		}
+		payload = map[string]any{"behavior": string(PermissionDeny), "message": message}
+		if decision.Interrupt {
+			payload["interrupt"] = true
+		}
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", fmt.Errorf("claude code: encode permission decision: %w", err)
+	}
+	return string(data), nil
+}
+
+// PendingPermission 为 PermissionQueue 中等待决策的请求。
+type PendingPermission struct {
+	// ID 用于 PermissionQueue.Resolve。
+	ID string
+	PermissionRequest
+}
+
+// PermissionQueue turns permission requests into a stream that another
+// goroutine resolves asynchronously, e.g. after asking a human in chat.
+// Use its Handle method as the PermissionHandler.
+type PermissionQueue struct {
+	requests chan PendingPermission
+	seq      atomic.Uint64
+
+	mu      sync.Mutex
+	pending map[string]chan PermissionDecision
+}
+
+// NewPermissionQueue creates an empty PermissionQueue.
+func NewPermissionQueue() *PermissionQueue {
+	return &PermissionQueue{
+		requests: make(chan PendingPermission),
+		pending:  make(map[string]chan PermissionDecision),
+	}
+}
+
+// Requests returns the channel of requests awaiting a decision.
+func (q *PermissionQueue) Requests() <-chan PendingPermission {
+	return q.requests
+}
+
+// Handle implements PermissionHandler: it publishes the request on Requests
+// and waits for Resolve or ctx cancellation.
+// 参数：ctx 为请求上下文，req 为权限请求。
+// 返回：决策与错误。
+func (q *PermissionQueue) Handle(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+	id := "perm-" + strconv.FormatUint(q.seq.Add(1), 10)
+	decided := make(chan PermissionDecision, 1)
+	q.mu.Lock()
+	q.pending[id] = decided
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.pending, id)
+		q.mu.Unlock()
+	}()
+
+	select {
+	case q.requests <- PendingPermission{ID: id, PermissionRequest: req}:
+	case <-ctx.Done():
+		return PermissionDecision{}, ctx.Err()
+	}
+	select {
+	case decision := <-decided:
+		return decision, nil
+	case <-ctx.Done():
+		return PermissionDecision{}, ctx.Err()
+	}
+}
+
+// Resolve delivers the decision for a pending request.
+// 参数：id 为 PendingPermission.ID，decision 为决策。
+// 返回：请求不存在或已结束时返回 ErrPermissionNotPending。
+func (q *PermissionQueue) Resolve(id string, decision PermissionDecision) error {
+	q.mu.Lock()
+	decided, ok := q.pending[id]
+	if ok {
+		delete(q.pending, id)
+	}
+	q.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrPermissionNotPending, id)
+	}
+	decided <- decision
+	return nil
+}
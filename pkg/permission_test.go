@@ -0,0 +1,135 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// callPermissionTool 调用内置 MCP server 的审批工具并解析决策。
+func callPermissionTool(t *testing.T, bridge *toolBridge, toolName string, input map[string]any) map[string]any {
+	t.Helper()
+	resp := postMCP(t, bridge.server, "tools/call", map[string]any{
+		"name":      permissionToolName,
+		"arguments": map[string]any{"tool_name": toolName, "input": input, "tool_use_id": "toolu_1"},
+	})
+	result := resp["result"].(map[string]any)
+	text := result["content"].([]any)[0].(map[string]any)["text"].(string)
+	var decision map[string]any
+	if err := json.Unmarshal([]byte(text), &decision); err != nil {
+		t.Fatalf("decode decision %q: %v", text, err)
+	}
+	return decision
+}
+
+func TestPermissionBridgeDecisions(t *testing.T) {
+	var got []PermissionRequest
+	llm := &LLM{opts: Options{
+		PermissionTimeout: 50 * time.Millisecond,
+		PermissionHandler: func(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+			got = append(got, req)
+			command, _ := req.Input["command"].(string)
+			switch {
+			case req.ToolName == "Read":
+				return PermissionDecision{Behavior: PermissionAllow}, nil
+			case strings.HasPrefix(command, "rm "):
+				return PermissionDecision{Behavior: PermissionDeny, Message: "不允许删除文件", Interrupt: true}, nil
+			case command == "sleep":
+				<-ctx.Done()
+				return PermissionDecision{}, ctx.Err()
+			case command == "fail":
+				return PermissionDecision{}, errors.New("审批服务不可用")
+			}
+			return PermissionDecision{Behavior: PermissionAllow, UpdatedInput: map[string]any{"command": command + " --dry-run"}}, nil
+		},
+	}}
+	bridge, err := llm.startToolBridge(context.Background(), nil, func() {})
+	if err != nil {
+		t.Fatalf("startToolBridge: %v", err)
+	}
+	defer bridge.Close()
+	if bridge.permissionTool != "mcp__langchaingo__approve" || bridge.deferCalls || len(bridge.toolNames) != 0 {
+		t.Fatalf("unexpected bridge: %+v", bridge)
+	}
+	bridge.setSessionID("sess-1")
+
+	allow := callPermissionTool(t, bridge, "Read", map[string]any{"file_path": "a.txt"})
+	if allow["behavior"] != "allow" || allow["updatedInput"].(map[string]any)["file_path"] != "a.txt" {
+		t.Fatalf("expected allow with original input, got %v", allow)
+	}
+	modified := callPermissionTool(t, bridge, "Bash", map[string]any{"command": "make"})
+	if modified["updatedInput"].(map[string]any)["command"] != "make --dry-run" {
+		t.Fatalf("expected modified input, got %v", modified)
+	}
+	deny := callPermissionTool(t, bridge, "Bash", map[string]any{"command": "rm -rf /"})
+	if deny["behavior"] != "deny" || deny["message"] != "不允许删除文件" || deny["interrupt"] != true {
+		t.Fatalf("unexpected deny: %v", deny)
+	}
+	timeout := callPermissionTool(t, bridge, "Bash", map[string]any{"command": "sleep"})
+	if timeout["behavior"] != "deny" || timeout["message"] != "permission request timed out" {
+		t.Fatalf("expected timeout deny, got %v", timeout)
+	}
+	failed := callPermissionTool(t, bridge, "Bash", map[string]any{"command": "fail"})
+	if failed["behavior"] != "deny" || failed["message"] != "审批服务不可用" {
+		t.Fatalf("expected error deny, got %v", failed)
+	}
+
+	if len(got) != 5 || got[0].SessionID != "sess-1" || got[0].ToolUseID != "toolu_1" {
+		t.Fatalf("unexpected requests: %+v", got)
+	}
+}
+
+func TestPermissionQueueResolvesAsynchronously(t *testing.T) {
+	queue := NewPermissionQueue()
+	type outcome struct {
+		decision PermissionDecision
+		err      error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		decision, err := queue.Handle(context.Background(), PermissionRequest{ToolName: "Write"})
+		done <- outcome{decision, err}
+	}()
+
+	pending := <-queue.Requests()
+	if pending.ToolName != "Write" || pending.ID == "" {
+		t.Fatalf("unexpected pending request: %+v", pending)
+	}
+	if err := queue.Resolve(pending.ID, PermissionDecision{Behavior: PermissionDeny, Message: "管理员拒绝"}); err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	res := <-done
+	if res.err != nil || res.decision.Message != "管理员拒绝" {
+		t.Fatalf("unexpected outcome: %+v", res)
+	}
+	if err := queue.Resolve(pending.ID, PermissionDecision{}); !errors.Is(err, ErrPermissionNotPending) {
+		t.Fatalf("expected ErrPermissionNotPending, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := queue.Handle(ctx, PermissionRequest{ToolName: "Bash"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestBuildArgsPermissionPromptTool(t *testing.T) {
+	llm := &LLM{opts: defaultOptions()}
+	args := llm.buildArgs(invocation{permissionPromptTool: "mcp__langchaingo__approve"})
+	if i := slices.Index(args, "--permission-prompt-tool"); i < 0 || args[i+1] != "mcp__langchaingo__approve" {
+		t.Fatalf("missing --permission-prompt-tool: %v", args)
+	}
+	if i := slices.Index(args, "--permission-mode"); i < 0 || args[i+1] != "default" {
+		t.Fatalf("expected default permission mode, got %v", args)
+	}
+
+	llm.opts.PermissionMode = "acceptEdits"
+	args = llm.buildArgs(invocation{permissionPromptTool: "mcp__langchaingo__approve"})
+	if i := slices.Index(args, "--permission-mode"); i < 0 || args[i+1] != "acceptEdits" {
+		t.Fatalf("expected explicit permission mode, got %v", args)
+	}
+}
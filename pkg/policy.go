@@ -0,0 +1,528 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrInvalidToolPolicy is returned by New when Options.ToolPolicy fails validation.
+var ErrInvalidToolPolicy = errors.New("claude code: invalid tool policy")
+
+// ToolRule 为一条工具规则。Patterns 为空时匹配该工具的所有调用，否则按工具类型匹配参数：
+//   - Bash：命令 glob，如 "git *"、"go test *"，* 可匹配任意字符；
+//   - Read/Write/Edit/MultiEdit/NotebookEdit/Glob/Grep：路径，相对路径以 Options.Cwd 为基准，
+//     不含通配符时匹配该文件或目录下的所有文件，含通配符时 * 不跨目录、** 跨目录；
+//     Glob 的 pattern、Grep 的 glob 为绝对路径或含 ".." 时，其首个通配符之前的目录也须匹配；
+//   - WebFetch：主机名，"*.example.com" 匹配其子域名。
+//
+// Tool 可使用 * 通配（如 "mcp__github__*"），此时不能带 Patterns。
+type ToolRule struct {
+	Tool     string   `json:"tool"`
+	Patterns []string `json:"patterns,omitempty"`
+}
+
+// String renders the rule in CLI permission rule style, e.g. Bash(git *).
+func (r ToolRule) String() string {
+	if len(r.Patterns) == 0 {
+		return r.Tool
+	}
+	return r.Tool + "(" + strings.Join(r.Patterns, ", ") + ")"
+}
+
+// ToolPolicy 为声明式的工具策略：Deny 优先于 Allow，均不匹配时交给 PermissionHandler，
+// 未配置 PermissionHandler 时拒绝。能以 CLI 权限规则表达的部分经 --allowedTools /
+// --disallowedTools 传递，其余在运行时经 --permission-prompt-tool 执行。
+// 注意 CLI 在 default 模式下不会为工作目录内的只读操作（如 Read/Glob/Grep）询问权限，
+// 对这些工具的限制应使用 Deny 规则（会编译为 CLI 规则）。bypassPermissions 与 acceptEdits
+// 模式会跳过 --permission-prompt-tool，设置 ToolPolicy 时这两种模式会被替换为 default。
+type ToolPolicy struct {
+	Allow []ToolRule `json:"allow,omitempty"`
+	Deny  []ToolRule `json:"deny,omitempty"`
+}
+
+// PolicyVerdict 为策略对单次工具调用的判定。
+type PolicyVerdict int
+
+const (
+	// PolicyNoMatch 表示没有规则匹配。
+	PolicyNoMatch PolicyVerdict = iota
+	// PolicyAllow 表示命中 Allow 规则。
+	PolicyAllow
+	// PolicyDeny 表示命中 Deny 规则。
+	PolicyDeny
+)
+
+// String 返回 PolicyVerdict 的字符串表示。
+func (v PolicyVerdict) String() string {
+	switch v {
+	case PolicyNoMatch:
+		return "no_match"
+	case PolicyAllow:
+		return "allow"
+	case PolicyDeny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+// policyArgKind 为工具参数的匹配方式。
+type policyArgKind int
+
+const (
+	policyArgNone policyArgKind = iota
+	policyArgCommand
+	policyArgPath
+	policyArgHost
+)
+
+// policyTools 记录支持 Patterns 的内置工具及其参数字段。
+// globField 为 Glob/Grep 的文件 glob 参数，其为绝对路径或含 ".." 时可跳出 path，需一并匹配。
+var policyTools = map[string]struct {
+	kind      policyArgKind
+	field     string
+	globField string
+}{
+	"Bash":         {kind: policyArgCommand, field: "command"},
+	"Read":         {kind: policyArgPath, field: "file_path"},
+	"Write":        {kind: policyArgPath, field: "file_path"},
+	"Edit":         {kind: policyArgPath, field: "file_path"},
+	"MultiEdit":    {kind: policyArgPath, field: "file_path"},
+	"NotebookEdit": {kind: policyArgPath, field: "notebook_path"},
+	"Glob":         {kind: policyArgPath, field: "path", globField: "pattern"},
+	"Grep":         {kind: policyArgPath, field: "path", globField: "glob"},
+	"WebFetch":     {kind: policyArgHost, field: "url"},
+}
+
+// Validate checks tool names and patterns.
+// 返回：第一个无效规则对应的错误（包装 ErrInvalidToolPolicy）。
+func (p *ToolPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, group := range [][]ToolRule{p.Allow, p.Deny} {
+		for _, rule := range group {
+			if err := rule.validate(); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidToolPolicy, rule, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r ToolRule) validate() error {
+	if strings.TrimSpace(r.Tool) == "" {
+		return errors.New("empty tool name")
+	}
+	if strings.ContainsAny(r.Tool, "(), ") {
+		return errors.New("tool name must not contain parentheses, commas or spaces")
+	}
+	compileGlob(r.Tool, true)
+	if len(r.Patterns) == 0 {
+		return nil
+	}
+	if strings.Contains(r.Tool, "*") {
+		return errors.New("wildcard tool names cannot have patterns")
+	}
+	tool, ok := policyTools[r.Tool]
+	if !ok {
+		return errors.New("tool does not support patterns")
+	}
+	for _, pattern := range r.Patterns {
+		if strings.TrimSpace(pattern) == "" {
+			return errors.New("empty pattern")
+		}
+		if tool.kind == policyArgHost && strings.ContainsAny(pattern, "/:") {
+			return fmt.Errorf("pattern %q must be a host name", pattern)
+		}
+		if tool.kind == policyArgCommand {
+			// 命令 glob 与基准目录无关，校验时预先编译。
+			compileGlob(pattern, true)
+		}
+	}
+	return nil
+}
+
+// CLIRules compiles the rules that the CLI can enforce itself.
+// 编译结果不会比运行时匹配更宽松：拒绝规则尽量编译（Bash 以前缀规则、路径以绝对路径规则表达，
+// 可能比运行时更严格）；允许规则仅编译不带 Patterns 的工具名，且该工具没有需要运行时判断的拒绝规则，
+// 否则 CLI 直接放行会绕过运行时检查。
+// 参数：dir 为相对路径的基准目录。
+// 返回：--allowedTools 与 --disallowedTools 的规则列表。
+func (p *ToolPolicy) CLIRules(dir string) (allowed, disallowed []string) {
+	if p == nil {
+		return nil, nil
+	}
+	for _, rule := range p.Allow {
+		if len(rule.Patterns) > 0 || strings.Contains(rule.Tool, "*") || p.hasRuntimeDeny(rule.Tool) {
+			continue
+		}
+		allowed = append(allowed, rule.Tool)
+	}
+	for _, rule := range p.Deny {
+		disallowed = append(disallowed, rule.compileDeny(dir)...)
+	}
+	return allowed, disallowed
+}
+
+// hasRuntimeDeny reports whether a deny rule for tool depends on its input.
+func (p *ToolPolicy) hasRuntimeDeny(tool string) bool {
+	for _, rule := range p.Deny {
+		if globMatch(rule.Tool, tool, true) && (len(rule.Patterns) > 0 || strings.Contains(rule.Tool, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileDeny converts a deny rule into CLI permission rule syntax.
+// 参数：dir 为相对路径的基准目录。
+// 返回：CLI 规则，无法表达时为空（仍在运行时执行）。
+func (r ToolRule) compileDeny(dir string) []string {
+	if len(r.Patterns) == 0 {
+		if !strings.Contains(r.Tool, "*") {
+			return []string{r.Tool}
+		}
+		// mcp__server__* 可用服务器级规则 mcp__server 表达。
+		if server, ok := strings.CutSuffix(r.Tool, "__*"); ok && strings.HasPrefix(server, "mcp__") && !strings.Contains(server, "*") {
+			return []string{server}
+		}
+		return nil
+	}
+	var out []string
+	for _, pattern := range r.Patterns {
+		switch policyTools[r.Tool].kind {
+		case policyArgCommand:
+			// 取第一个通配符之前的部分作为前缀，前缀规则覆盖的命令不少于 glob。
+			prefix := strings.TrimSpace(pattern[:strings.IndexAny(pattern+"*", "*?")])
+			switch {
+			case prefix == "":
+			case prefix == pattern:
+				out = append(out, fmt.Sprintf("Bash(%s)", pattern))
+			default:
+				out = append(out, fmt.Sprintf("Bash(%s:*)", prefix))
+			}
+		case policyArgPath:
+			// CLI 以 // 开头表示绝对路径。
+			path := "/" + filepath.ToSlash(resolvePolicyPath(pattern, dir))
+			out = append(out, fmt.Sprintf("%s(%s)", r.Tool, path))
+			if !strings.ContainsAny(pattern, "*?") {
+				out = append(out, fmt.Sprintf("%s(%s/**)", r.Tool, strings.TrimSuffix(path, "/")))
+			}
+		case policyArgHost:
+			if !strings.Contains(pattern, "*") {
+				out = append(out, fmt.Sprintf("WebFetch(domain:%s)", strings.ToLower(pattern)))
+			}
+		}
+	}
+	return out
+}
+
+// Evaluate matches a permission request against the policy.
+// 参数：req 为权限请求，dir 为相对路径的基准目录。
+// 返回：判定结果与命中的规则（未命中时为空）。
+func (p *ToolPolicy) Evaluate(req PermissionRequest, dir string) (PolicyVerdict, string) {
+	if p == nil {
+		return PolicyNoMatch, ""
+	}
+	for _, rule := range p.Deny {
+		if rule.matches(req, dir, true) {
+			return PolicyDeny, rule.String()
+		}
+	}
+	for _, rule := range p.Allow {
+		if rule.matches(req, dir, false) {
+			return PolicyAllow, rule.String()
+		}
+	}
+	return PolicyNoMatch, ""
+}
+
+// matches reports whether the rule covers the request.
+// 参数：req 为权限请求，dir 为基准目录，deny 为是否按拒绝规则匹配
+// （拒绝规则在复合命令的任一子命令命中即生效，允许规则要求全部子命令命中）。
+func (r ToolRule) matches(req PermissionRequest, dir string, deny bool) bool {
+	if !globMatch(r.Tool, req.ToolName, true) {
+		return false
+	}
+	if len(r.Patterns) == 0 {
+		return true
+	}
+	tool := policyTools[r.Tool]
+	value, _ := req.Input[tool.field].(string)
+	switch tool.kind {
+	case policyArgCommand:
+		return r.matchCommand(value, deny)
+	case policyArgPath:
+		if value == "" {
+			// Glob/Grep 未指定 path 时作用于工作目录。
+			value = "."
+		}
+		targets := []string{resolvePolicyPath(value, dir)}
+		if glob, _ := req.Input[tool.globField].(string); tool.globField != "" && escapesSearchPath(glob) {
+			// 以 glob 中首个通配符之前的目录作为实际搜索范围。
+			targets = append(targets, resolvePolicyPath(globBase(glob), targets[0]))
+		}
+		// 拒绝规则命中任一目标即生效，允许规则要求全部目标命中。
+		matched := 0
+		for _, target := range targets {
+			for _, pattern := range r.Patterns {
+				if matchPolicyPath(resolvePolicyPath(pattern, dir), target) {
+					matched++
+					break
+				}
+			}
+		}
+		return matched > 0 && (deny || matched == len(targets))
+	case policyArgHost:
+		parsed, err := url.Parse(value)
+		if err != nil || parsed.Hostname() == "" {
+			return deny
+		}
+		host := strings.ToLower(parsed.Hostname())
+		for _, pattern := range r.Patterns {
+			pattern = strings.ToLower(pattern)
+			if sub, ok := strings.CutPrefix(pattern, "*."); ok {
+				if strings.HasSuffix(host, "."+sub) {
+					return true
+				}
+			} else if host == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shellOperators 拆分复合命令；shellSubstitutions 无法静态判断，不会被允许规则放行。
+var (
+	shellOperators     = regexp.MustCompile(`&&|\|\||[;&|\n]`)
+	shellSubstitutions = []string{"`", "$(", "<(", ">(", ">", "<"}
+)
+
+// matchCommand matches a Bash command, splitting compound commands.
+func (r ToolRule) matchCommand(command string, deny bool) bool {
+	command = strings.TrimSpace(command)
+	if command == "" {
+		return false
+	}
+	if !deny {
+		for _, s := range shellSubstitutions {
+			if strings.Contains(command, s) {
+				return false
+			}
+		}
+	}
+	segments := shellOperators.Split(command, -1)
+	matched := 0
+	for _, segment := range segments {
+		segment = strings.Join(strings.Fields(segment), " ")
+		if segment == "" {
+			matched++
+			continue
+		}
+		ok := false
+		for _, pattern := range r.Patterns {
+			if globMatch(pattern, segment, true) || (strings.HasSuffix(pattern, " *") && segment == strings.TrimSuffix(pattern, " *")) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			if deny {
+				return true
+			}
+			matched++
+		}
+	}
+	return !deny && matched == len(segments)
+}
+
+// resolvePolicyPath makes a path absolute relative to dir and cleans it.
+func resolvePolicyPath(path, dir string) string {
+	if strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, path[2:])
+		}
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	return filepath.Clean(path)
+}
+
+// escapesSearchPath reports whether a Glob/Grep glob can reach outside its search path.
+func escapesSearchPath(glob string) bool {
+	if glob == "" {
+		return false
+	}
+	if filepath.IsAbs(glob) || strings.HasPrefix(glob, "~/") {
+		return true
+	}
+	for _, part := range strings.Split(filepath.ToSlash(glob), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// globBase returns the directory part of glob before the first wildcard segment.
+func globBase(glob string) string {
+	parts := strings.Split(filepath.ToSlash(glob), "/")
+	for i, part := range parts {
+		if strings.ContainsAny(part, "*?[{") {
+			parts = parts[:i]
+			break
+		}
+	}
+	base := strings.Join(parts, "/")
+	if base == "" && strings.HasPrefix(glob, "/") {
+		return "/"
+	}
+	if base == "" {
+		return "."
+	}
+	return filepath.FromSlash(base)
+}
+
+// matchPolicyPath matches a cleaned absolute path against a resolved pattern.
+func matchPolicyPath(pattern, path string) bool {
+	if !strings.ContainsAny(pattern, "*?") {
+		return path == pattern || strings.HasPrefix(path, strings.TrimSuffix(pattern, string(filepath.Separator))+string(filepath.Separator))
+	}
+	return globMatch(filepath.ToSlash(pattern), filepath.ToSlash(path), false)
+}
+
+// maxCachedGlobs 限制 globMatch 缓存的正则数量。
+const maxCachedGlobs = 1024
+
+// globCache 缓存编译后的 glob，策略中的规则只在首次匹配时编译。
+var globCache = struct {
+	sync.Mutex
+	res map[globKey]*regexp.Regexp
+}{res: make(map[globKey]*regexp.Regexp)}
+
+// globKey 为 globCache 的键。
+type globKey struct {
+	pattern    string
+	crossSlash bool
+}
+
+// globMatch matches s against a glob where ? matches one character and * any run.
+// 参数：crossSlash 为 false 时单个 * 不匹配 "/"，** 匹配任意字符。
+func globMatch(pattern, s string, crossSlash bool) bool {
+	re := compileGlob(pattern, crossSlash)
+	return re != nil && re.MatchString(s)
+}
+
+// compileGlob returns the cached regexp for a glob, compiling it on first use.
+// 返回：编译失败时为 nil。
+func compileGlob(pattern string, crossSlash bool) *regexp.Regexp {
+	key := globKey{pattern, crossSlash}
+	globCache.Lock()
+	re, ok := globCache.res[key]
+	globCache.Unlock()
+	if ok {
+		return re
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				b.WriteString(".*")
+				i++
+			} else if crossSlash {
+				b.WriteString(".*")
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, _ = regexp.Compile(b.String())
+
+	globCache.Lock()
+	defer globCache.Unlock()
+	if len(globCache.res) >= maxCachedGlobs {
+		for k := range globCache.res {
+			delete(globCache.res, k)
+			break
+		}
+	}
+	globCache.res[key] = re
+	return re
+}
+
+// policyDir returns the base directory for relative policy paths.
+func (l *LLM) policyDir() string {
+	if l.opts.Cwd != "" {
+		return l.opts.Cwd
+	}
+	dir, _ := os.Getwd()
+	return dir
+}
+
+// permissionMode returns the --permission-mode value for one invocation.
+// bypassPermissions 从不询问 --permission-prompt-tool，acceptEdits 会自动批准文件编辑，
+// 两者都会绕过审批回调；配置审批工具时前者改为 default，设置 ToolPolicy 时两者均改为 default。
+// 参数：inv 为本次调用派生的命令行输入。
+// 返回：权限模式，为空时不传递。
+func (l *LLM) permissionMode(inv invocation) string {
+	mode := l.opts.PermissionMode
+	if inv.permissionPromptTool == "" {
+		return mode
+	}
+	switch {
+	case mode == defaultPermissionMode:
+		return "default"
+	case mode == "acceptEdits" && l.opts.ToolPolicy != nil:
+		return "default"
+	}
+	return mode
+}
+
+// permissionHandler combines ToolPolicy and PermissionHandler into the callback
+// served by the approval tool.
+// 返回：组合后的回调，两者均未配置时为 nil。
+func (l *LLM) permissionHandler() PermissionHandler {
+	policy, handler := l.opts.ToolPolicy, l.opts.PermissionHandler
+	if policy == nil {
+		return handler
+	}
+	dir := l.policyDir()
+	logger := l.logger()
+	return func(ctx context.Context, req PermissionRequest) (PermissionDecision, error) {
+		verdict, rule := policy.Evaluate(req, dir)
+		logger.InfoContext(ctx, "claude code: tool policy decision",
+			slog.String("tool", req.ToolName),
+			slog.String("verdict", verdict.String()),
+			slog.String("rule", rule),
+			slog.String("session_id", req.SessionID),
+		)
+		switch {
+		case verdict == PolicyDeny:
+			return PermissionDecision{Behavior: PermissionDeny, Message: "denied by tool policy: " + rule}, nil
+		case verdict == PolicyAllow:
+			return PermissionDecision{Behavior: PermissionAllow}, nil
+		case handler != nil:
+			return handler(ctx, req)
+		}
+		return PermissionDecision{Behavior: PermissionDeny, Message: "not allowed by tool policy: " + req.ToolName}, nil
+	}
+}
@@ -0,0 +1,214 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+)
+
+// testPolicy 对应安全评审要求的示例策略。
+func testPolicy() *ToolPolicy {
+	return &ToolPolicy{
+		Allow: []ToolRule{
+			{Tool: "Read"},
+			{Tool: "Bash", Patterns: []string{"git *", "go test *"}},
+			{Tool: "Write", Patterns: []string{"./workspace"}},
+			{Tool: "WebFetch", Patterns: []string{"pkg.go.dev", "*.example.com"}},
+			{Tool: "mcp__github__*"},
+		},
+		Deny: []ToolRule{
+			{Tool: "Bash", Patterns: []string{"git push *"}},
+			{Tool: "Read", Patterns: []string{"~/.ssh", "**/.env"}},
+			{Tool: "WebSearch"},
+		},
+	}
+}
+
+func TestToolPolicyEvaluate(t *testing.T) {
+	policy := testPolicy()
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	cases := []struct {
+		tool  string
+		input map[string]any
+		want  PolicyVerdict
+	}{
+		{"Bash", map[string]any{"command": "git status"}, PolicyAllow},
+		{"Bash", map[string]any{"command": "go test ./..."}, PolicyAllow},
+		{"Bash", map[string]any{"command": "git diff && go test ./pkg"}, PolicyAllow},
+		{"Bash", map[string]any{"command": "git status && rm -rf /"}, PolicyNoMatch},
+		{"Bash", map[string]any{"command": "git log $(rm -rf /)"}, PolicyNoMatch},
+		{"Bash", map[string]any{"command": "git log > /etc/passwd"}, PolicyNoMatch},
+		{"Bash", map[string]any{"command": "git  push origin main"}, PolicyDeny},
+		{"Bash", map[string]any{"command": "go build ./..."}, PolicyNoMatch},
+		{"Write", map[string]any{"file_path": "workspace/notes.md"}, PolicyAllow},
+		{"Write", map[string]any{"file_path": "/srv/bot/workspace/a/b.txt"}, PolicyAllow},
+		{"Write", map[string]any{"file_path": "workspace/../main.go"}, PolicyNoMatch},
+		{"Write", map[string]any{"file_path": "/srv/bot/workspace-old/a.txt"}, PolicyNoMatch},
+		{"Read", map[string]any{"file_path": "main.go"}, PolicyAllow},
+		{"Read", map[string]any{"file_path": "config/.env"}, PolicyDeny},
+		{"WebFetch", map[string]any{"url": "https://pkg.go.dev/net/http"}, PolicyAllow},
+		{"WebFetch", map[string]any{"url": "https://docs.example.com/a"}, PolicyAllow},
+		{"WebFetch", map[string]any{"url": "https://example.com.evil.io/a"}, PolicyNoMatch},
+		{"WebSearch", map[string]any{"query": "x"}, PolicyDeny},
+		{"mcp__github__create_issue", map[string]any{}, PolicyAllow},
+		{"Edit", map[string]any{"file_path": "workspace/a.txt"}, PolicyNoMatch},
+	}
+	for _, tc := range cases {
+		got, rule := policy.Evaluate(PermissionRequest{ToolName: tc.tool, Input: tc.input}, "/srv/bot")
+		if got != tc.want {
+			t.Errorf("%s %v: got %v (rule %q), want %v", tc.tool, tc.input, got, rule, tc.want)
+		}
+	}
+}
+
+func TestToolPolicyChecksSearchGlobs(t *testing.T) {
+	policy := &ToolPolicy{
+		Allow: []ToolRule{{Tool: "Glob", Patterns: []string{"."}}, {Tool: "Grep", Patterns: []string{"."}}},
+		Deny:  []ToolRule{{Tool: "Glob", Patterns: []string{"/etc"}}, {Tool: "Grep", Patterns: []string{"~/.ssh"}}},
+	}
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	cases := []struct {
+		tool  string
+		input map[string]any
+		want  PolicyVerdict
+	}{
+		{"Glob", map[string]any{"pattern": "**/*.go"}, PolicyAllow},
+		{"Glob", map[string]any{"pattern": "src/*.go", "path": "pkg"}, PolicyAllow},
+		{"Glob", map[string]any{"pattern": "/etc/**/*.conf"}, PolicyDeny},
+		{"Glob", map[string]any{"pattern": "../../../etc/*"}, PolicyDeny},
+		{"Glob", map[string]any{"pattern": "../other/*.go"}, PolicyNoMatch},
+		{"Glob", map[string]any{"pattern": "/srv/bot/pkg/*.go"}, PolicyAllow},
+		{"Grep", map[string]any{"pattern": "/etc", "glob": "*.go"}, PolicyAllow},
+		{"Grep", map[string]any{"pattern": "key", "glob": "~/.ssh/*"}, PolicyDeny},
+		{"Grep", map[string]any{"pattern": "key", "path": "pkg", "glob": "../../*"}, PolicyNoMatch},
+	}
+	for _, tc := range cases {
+		got, rule := policy.Evaluate(PermissionRequest{ToolName: tc.tool, Input: tc.input}, "/srv/bot")
+		if got != tc.want {
+			t.Errorf("%s %v: got %v (rule %q), want %v", tc.tool, tc.input, got, rule, tc.want)
+		}
+	}
+}
+
+func TestToolPolicyCLIRules(t *testing.T) {
+	allowed, disallowed := testPolicy().CLIRules("/srv/bot")
+	// Read 存在依赖参数的拒绝规则，不能整体交给 CLI 放行。
+	if len(allowed) != 0 {
+		t.Fatalf("unexpected allowed rules: %v", allowed)
+	}
+	if !slices.Contains(disallowed, "Bash(git push:*)") || !slices.Contains(disallowed, "WebSearch") {
+		t.Fatalf("missing deny rules: %v", disallowed)
+	}
+	if !slices.Contains(disallowed, "Read(//srv/bot/**/.env)") {
+		t.Fatalf("missing path deny rule: %v", disallowed)
+	}
+
+	policy := &ToolPolicy{
+		Allow: []ToolRule{{Tool: "Grep"}, {Tool: "Bash", Patterns: []string{"git *"}}},
+		Deny:  []ToolRule{{Tool: "mcp__shell__*"}, {Tool: "WebFetch", Patterns: []string{"internal.corp"}}},
+	}
+	allowed, disallowed = policy.CLIRules("/srv/bot")
+	if strings.Join(allowed, ",") != "Grep" {
+		t.Fatalf("unexpected allowed rules: %v", allowed)
+	}
+	if strings.Join(disallowed, ",") != "mcp__shell,WebFetch(domain:internal.corp)" {
+		t.Fatalf("unexpected disallowed rules: %v", disallowed)
+	}
+}
+
+func TestToolPolicyValidate(t *testing.T) {
+	invalid := []ToolRule{
+		{Tool: ""},
+		{Tool: "Bash(git)"},
+		{Tool: "Task", Patterns: []string{"x"}},
+		{Tool: "mcp__*", Patterns: []string{"x"}},
+		{Tool: "WebFetch", Patterns: []string{"https://example.com"}},
+		{Tool: "Bash", Patterns: []string{" "}},
+	}
+	for _, rule := range invalid {
+		policy := &ToolPolicy{Allow: []ToolRule{rule}}
+		if err := policy.Validate(); !errors.Is(err, ErrInvalidToolPolicy) {
+			t.Errorf("%s: expected ErrInvalidToolPolicy, got %v", rule, err)
+		}
+	}
+	if _, err := New(WithCLIPath("claude"), WithToolPolicy(&ToolPolicy{Deny: []ToolRule{{Tool: ""}}})); !errors.Is(err, ErrInvalidToolPolicy) {
+		t.Fatalf("expected New to validate policy, got %v", err)
+	}
+
+	// 单次调用传入的无效策略同样拒绝，且不启动 CLI。
+	fake := claudetest.New(t)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	invalidPolicy := &ToolPolicy{Allow: []ToolRule{{Tool: "Bash(git)"}}}
+	if _, err := llm.Call(context.Background(), "你好", WithCallOptions(WithToolPolicy(invalidPolicy))); !errors.Is(err, ErrInvalidToolPolicy) {
+		t.Fatalf("expected per-call ErrInvalidToolPolicy, got %v", err)
+	}
+	if n := len(fake.Invocations()); n != 0 {
+		t.Fatalf("CLI started %d times with an invalid policy", n)
+	}
+}
+
+func TestToolPolicyForcesDefaultPermissionMode(t *testing.T) {
+	cases := []struct {
+		mode   string
+		policy *ToolPolicy
+		tool   string
+		want   string
+	}{
+		{mode: "bypassPermissions", want: "bypassPermissions"},
+		{mode: "bypassPermissions", tool: "mcp__langchaingo__approve", want: "default"},
+		{mode: "acceptEdits", tool: "mcp__langchaingo__approve", want: "acceptEdits"},
+		{mode: "acceptEdits", policy: testPolicy(), tool: "mcp__langchaingo__approve", want: "default"},
+		{mode: "bypassPermissions", policy: testPolicy(), tool: "mcp__langchaingo__approve", want: "default"},
+		{mode: "plan", policy: testPolicy(), tool: "mcp__langchaingo__approve", want: "plan"},
+	}
+	for _, tc := range cases {
+		llm := &LLM{opts: Options{PermissionMode: tc.mode, ToolPolicy: tc.policy}}
+		if got := llm.permissionMode(invocation{permissionPromptTool: tc.tool}); got != tc.want {
+			t.Errorf("mode %s, policy %v, tool %q: got %s, want %s", tc.mode, tc.policy != nil, tc.tool, got, tc.want)
+		}
+	}
+}
+
+func TestToolPolicyFallsBackToPermissionHandler(t *testing.T) {
+	var asked []string
+	llm := &LLM{opts: Options{
+		Cwd:        "/srv/bot",
+		ToolPolicy: testPolicy(),
+		PermissionHandler: func(_ context.Context, req PermissionRequest) (PermissionDecision, error) {
+			asked = append(asked, req.ToolName)
+			return PermissionDecision{Behavior: PermissionAllow}, nil
+		},
+	}}
+	handler := llm.permissionHandler()
+	ctx := context.Background()
+
+	deny, _ := handler(ctx, PermissionRequest{ToolName: "Bash", Input: map[string]any{"command": "git push"}})
+	if deny.Behavior != PermissionDeny || !strings.Contains(deny.Message, "git push *") {
+		t.Fatalf("expected policy deny, got %+v", deny)
+	}
+	allow, _ := handler(ctx, PermissionRequest{ToolName: "Bash", Input: map[string]any{"command": "git status"}})
+	if allow.Behavior != PermissionAllow {
+		t.Fatalf("expected policy allow, got %+v", allow)
+	}
+	fallback, _ := handler(ctx, PermissionRequest{ToolName: "Edit", Input: map[string]any{"file_path": "a.go"}})
+	if fallback.Behavior != PermissionAllow || len(asked) != 1 || asked[0] != "Edit" {
+		t.Fatalf("expected handler fallback, got %+v asked %v", fallback, asked)
+	}
+
+	llm.opts.PermissionHandler = nil
+	closed, _ := llm.permissionHandler()(ctx, PermissionRequest{ToolName: "Edit"})
+	if closed.Behavior != PermissionDeny {
+		t.Fatalf("expected deny without handler, got %+v", closed)
+	}
+}
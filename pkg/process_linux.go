@@ -0,0 +1,26 @@
+//go:build linux
+
+package claudecode
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// pPID 为 waitid 的 idtype P_PID。
+const pPID = 1
+
+// awaitExit blocks until the process exits without reaping it
+// (waitid with WNOWAIT), so its pid and process group id stay reserved.
+// 参数：pid 为已启动且尚未被 Wait 回收的子进程。
+// 返回：进程已退出且仍未被回收时为 true。
+func awaitExit(pid int) bool {
+	var siginfo [16]uint64
+	for {
+		_, _, errno := syscall.Syscall6(syscall.SYS_WAITID, pPID, uintptr(pid),
+			uintptr(unsafe.Pointer(&siginfo[0])), syscall.WEXITED|syscall.WNOWAIT, 0, 0)
+		if errno != syscall.EINTR {
+			return errno == 0
+		}
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package claudecode
+
+import (
+	"os/exec"
+	"time"
+)
+
+// configureProcess keeps the default cancellation (Process.Kill) on platforms
+// without process groups; grace only bounds how long Wait blocks on pipes.
+// 参数：cmd 为待启动的命令，grace 为等待宽限期。
+// 返回：reap，代替 cmd.Wait 等待 CLI 退出；无进程组时无需清理。
+func configureProcess(cmd *exec.Cmd, grace time.Duration) (reap func() error) {
+	cmd.WaitDelay = grace
+	return cmd.Wait
+}
+
+// killProcess immediately kills the CLI.
+// 参数：cmd 为已启动的命令。
+func killProcess(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,90 @@
+//go:build unix
+
+package claudecode
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// configureProcess starts the CLI in its own process group so that tool
+// subprocesses (Bash builds, dev servers) are terminated together with it.
+// 取消时先向进程组发送 SIGINT，grace 后仍未退出则 SIGKILL 整个进程组。
+// 参数：cmd 为待启动的命令，grace 为 SIGINT 与 SIGKILL 之间的宽限期。
+// 返回：reap，代替 cmd.Wait 等待 CLI 退出；进程组长尚未被回收时清理组内残留的子进程，
+// 回收后不再向该进程组发送任何信号（pgid 可能已被复用）。
+func configureProcess(cmd *exec.Cmd, grace time.Duration) (reap func() error) {
+	var (
+		mu     sync.Mutex
+		timer  *time.Timer
+		exited bool
+	)
+	// signal 仅在进程组长退出前发送信号，之后 pgid 不再属于本次调用。
+	signal := func(sig syscall.Signal) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if exited {
+			return os.ErrProcessDone
+		}
+		return signalGroup(cmd.Process.Pid, sig)
+	}
+	// markExited 停止宽限期计时器，并禁止后续向进程组发送信号。
+	markExited := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		exited = true
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		if grace <= 0 {
+			return signal(syscall.SIGKILL)
+		}
+		// CLI 收到 SIGINT 退出后，其子进程可能仍留在进程组中，宽限期后统一清理。
+		mu.Lock()
+		if timer == nil {
+			timer = time.AfterFunc(grace, func() { _ = signal(syscall.SIGKILL) })
+		}
+		mu.Unlock()
+		return signal(syscall.SIGINT)
+	}
+	cmd.WaitDelay = grace
+	return func() error {
+		// 进程组长退出但未被回收前，其 pid 与 pgid 不会被复用，此时清理残留子进程是安全的。
+		if awaitExit(cmd.Process.Pid) {
+			_ = signal(syscall.SIGKILL)
+			markExited()
+			return cmd.Wait()
+		}
+		// 无法在回收前观察退出的平台上，仅依赖取消路径清理进程组。
+		err := cmd.Wait()
+		markExited()
+		return err
+	}
+}
+
+// killProcess immediately kills the CLI and its process group.
+// 参数：cmd 为已启动的命令。
+func killProcess(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	_ = signalGroup(cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// signalGroup sends sig to every process in the group.
+// 参数：pgid 为进程组 ID，sig 为信号。
+// 返回：进程组已不存在时为 os.ErrProcessDone。
+func signalGroup(pgid int, sig syscall.Signal) error {
+	err := syscall.Kill(-pgid, sig)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
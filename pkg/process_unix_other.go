@@ -0,0 +1,11 @@
+//go:build unix && !linux
+
+package claudecode
+
+// awaitExit reports that the platform cannot observe an exit without
+// reaping the process; leftover children are then only cleaned up on cancel.
+// 参数：pid 为子进程 ID。
+// 返回：始终为 false。
+func awaitExit(pid int) bool {
+	return false
+}
@@ -0,0 +1,103 @@
+//go:build unix
+
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+)
+
+// processAlive reports whether pid exists and is not a zombie.
+func processAlive(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil {
+		return false
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	// /proc/<pid>/stat: pid (comm) state ...
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) == 0 || fields[0] != "Z"
+}
+
+// waitProcessExit 等待 pid 退出，超时后测试失败。
+func waitProcessExit(t *testing.T, pid int) {
+	t.Helper()
+	if pid == 0 {
+		t.Fatalf("child pid not recorded")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child %d survived", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCancelInterruptsAndKillsProcessGroup(t *testing.T) {
+	fake := claudetest.New(t).SpawnChild().Replay(`{"type":"system","subtype":"init","session_id":"sess-1"}`).HangAfter(1)
+	llm, err := New(WithCLIPath(fake.Path), WithCancelGracePeriod(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = llm.Call(ctx, "启动服务")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancellation took %v", elapsed)
+	}
+
+	inv := fake.LastInvocation()
+	if inv.Signal != os.Interrupt.String() {
+		t.Fatalf("expected SIGINT before SIGKILL, got %q", inv.Signal)
+	}
+	waitProcessExit(t, inv.ChildPID)
+}
+
+func TestReapKillsLeftoverProcessGroup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("leftover children are only cleaned up before reaping on linux")
+	}
+	fake := claudetest.New(t).SpawnChild()
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := llm.Call(context.Background(), "后台任务"); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	waitProcessExit(t, fake.LastInvocation().ChildPID)
+}
+
+func TestNoSignalAfterReap(t *testing.T) {
+	cmd := exec.CommandContext(context.Background(), "true")
+	reap := configureProcess(cmd, time.Second)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err := reap(); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	// 回收后 pgid 可能已被复用，取消不得再向该进程组发送信号。
+	if err := cmd.Cancel(); !errors.Is(err, os.ErrProcessDone) {
+		t.Fatalf("expected os.ErrProcessDone after reap, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package claudecode
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// promptSource 返回 prompt 的传递方式：argv 或 stdin。
+func promptSource(inv claudetest.Invocation) string {
+	if inv.HasFlag("--") {
+		return PromptInputArgv.String()
+	}
+	return PromptInputStdin.String()
+}
+
+// systemPrompt 返回经 --system-prompt 或 --system-prompt-file 传递的系统提示词。
+func systemPrompt(inv claudetest.Invocation) string {
+	if file, ok := inv.File("--system-prompt-file"); ok {
+		return file.Content
+	}
+	return inv.Flag("--system-prompt")
+}
+
+func TestPromptInputModesDeliverIdenticalPrompt(t *testing.T) {
+	fake := claudetest.New(t).Replay(
+		`{"type":"assistant","message":{"content":[{"type":"text","text":"ok"}]}}`,
+		`{"type":"result","subtype":"success","result":"ok"}`,
+	)
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, "你是助手"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "--not-a-flag\n第二行"),
+	}
+
+	var prompts []string
+	for _, mode := range []PromptInputMode{PromptInputArgv, PromptInputStdin} {
+		llm, err := New(WithCLIPath(fake.Path), WithPromptInput(mode))
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		resp, err := llm.GenerateContent(context.Background(), messages)
+		if err != nil {
+			t.Fatalf("%s: GenerateContent: %v", mode, err)
+		}
+		if resp.Choices[0].Content != "ok" {
+			t.Fatalf("%s: unexpected content %q", mode, resp.Choices[0].Content)
+		}
+		inv := fake.LastInvocation()
+		if got := promptSource(inv); got != mode.String() {
+			t.Fatalf("%s: prompt delivered via %s", mode, got)
+		}
+		if got := systemPrompt(inv); got != "你是助手" {
+			t.Fatalf("%s: unexpected system prompt %q", mode, got)
+		}
+		if _, ok := inv.File("--system-prompt-file"); ok != (mode == PromptInputStdin) {
+			t.Fatalf("%s: unexpected --system-prompt-file usage: %q", mode, inv.Args)
+		}
+		prompts = append(prompts, inv.Prompt())
+	}
+	if prompts[0] != prompts[1] {
+		t.Fatalf("prompts differ:\nargv:  %q\nstdin: %q", prompts[0], prompts[1])
+	}
+}
+
+func TestPromptInputAutoSwitchesOnSize(t *testing.T) {
+	fake := claudetest.New(t)
+	llm, err := New(WithCLIPath(fake.Path), WithPromptStdinThreshold(1024))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := llm.Call(context.Background(), "短消息"); err != nil {
+		t.Fatalf("short prompt: %v", err)
+	}
+	if got := promptSource(fake.LastInvocation()); got != "argv" {
+		t.Fatalf("short prompt delivered via %s", got)
+	}
+
+	long := strings.Repeat("日志行\n", 1024)
+	if _, err := llm.Call(context.Background(), long); err != nil {
+		t.Fatalf("long prompt: %v", err)
+	}
+	inv := fake.LastInvocation()
+	if got := promptSource(inv); got != "stdin" {
+		t.Fatalf("long prompt delivered via %s", got)
+	}
+	if got := inv.Prompt(); !strings.Contains(got, strings.TrimSpace(long)) {
+		t.Fatalf("long prompt truncated: %d bytes", len(got))
+	}
+}
+
+func TestPromptInputDefaultsToStdin(t *testing.T) {
+	fake := claudetest.New(t)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	messages := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, "你是助手"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "短消息"),
+	}
+	if _, err := llm.GenerateContent(context.Background(), messages); err != nil {
+		t.Fatalf("GenerateContent: %v", err)
+	}
+	inv := fake.LastInvocation()
+	if got := promptSource(inv); got != "stdin" {
+		t.Fatalf("short prompt delivered via %s", got)
+	}
+	if file, ok := inv.File("--system-prompt-file"); !ok || file.Content != "你是助手" || file.Mode != 0o600 {
+		t.Fatalf("expected --system-prompt-file by default: %+v %v", file, ok)
+	}
+}
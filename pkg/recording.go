@@ -0,0 +1,270 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrReplayExhausted is returned when every recorded run in ReplayDir has been served.
+var ErrReplayExhausted = errors.New("claude code: no recorded runs left to replay")
+
+// 录制目录中每次运行的文件名。
+const (
+	recordInvocationFile = "invocation.json"
+	recordStdoutFile     = "stdout.jsonl"
+	recordStderrFile     = "stderr.txt"
+	recordExitFile       = "exit.json"
+)
+
+// recordSeq 保证同一时刻开始的运行目录名不冲突。
+var recordSeq atomic.Uint64
+
+// RecordedInvocation 描述录制的 CLI 调用，prompt 与环境变量值按 Options.Redaction 脱敏。
+type RecordedInvocation struct {
+	CLI  string   `json:"cli"`
+	Args []string `json:"args"`
+	Env  []string `json:"env,omitempty"`
+	Cwd  string   `json:"cwd,omitempty"`
+	// Stdin 为经标准输入发送的 prompt 或 stream-json 消息，同样按 RedactPrompts 脱敏。
+	Stdin     string    `json:"stdin,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// RecordedExit 描述录制的 CLI 退出状态。
+type RecordedExit struct {
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+	FinishedAt time.Time `json:"finished_at"`
+}
+
+// recorder 将一次 CLI 运行的原始输出写入录制目录。
+type recorder struct {
+	dir    string
+	stdout *recordWriter
+	stderr *recordWriter
+}
+
+// recordWriter 写入一个录制文件。写入失败时记录并告警首个错误、停止写入，
+// 但始终向调用方报告成功，避免录制失败中断输出解析或阻塞 stderr 的读取。
+type recordWriter struct {
+	ctx    context.Context
+	logger *slog.Logger
+	file   *os.File
+	err    error
+}
+
+// Write implements io.Writer and never fails.
+func (w *recordWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		if _, err := w.file.Write(p); err != nil {
+			w.err = err
+			w.logger.WarnContext(w.ctx, "claude code: recording write failed", "file", w.file.Name(), "error", err)
+		}
+	}
+	return len(p), nil
+}
+
+// startRecording creates the run directory and writes the invocation.
+// RecordDir 为空时返回 nil，nil recorder 的方法均为空操作。
+// 参数：ctx 用于记录录制失败的日志，cmd 为即将启动的命令。
+// 返回：*recorder 与错误。
+func (l *LLM) startRecording(ctx context.Context, cmd *command) (*recorder, error) {
+	if l.opts.RecordDir == "" {
+		return nil, nil
+	}
+	// 录制包含 prompt、模型输出与 stderr，目录与文件仅当前用户可访问。
+	if err := os.MkdirAll(l.opts.RecordDir, 0o700); err != nil {
+		return nil, fmt.Errorf("claude code: create record dir: %w", err)
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%06d", now.UTC().Format("20060102T150405.000000000Z"), recordSeq.Add(1))
+	dir := filepath.Join(l.opts.RecordDir, name)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("claude code: create record dir: %w", err)
+	}
+
+	inv := RecordedInvocation{
+		CLI:       cmd.Path,
+		Args:      l.redactArgs(cmd.Args[1:]),
+		Env:       l.redactedEnv(),
+		Cwd:       cmd.Dir,
+		Stdin:     string(cmd.stdin),
+		StartedAt: now,
+	}
+	if inv.Stdin != "" && l.opts.Redaction&RedactPrompts != 0 {
+		inv.Stdin = redactedString(inv.Stdin)
+	}
+	if err := writeJSONFile(filepath.Join(dir, recordInvocationFile), inv); err != nil {
+		return nil, err
+	}
+
+	stdout, err := createRecordFile(filepath.Join(dir, recordStdoutFile))
+	if err != nil {
+		return nil, fmt.Errorf("claude code: create recording: %w", err)
+	}
+	stderr, err := createRecordFile(filepath.Join(dir, recordStderrFile))
+	if err != nil {
+		_ = stdout.Close()
+		return nil, fmt.Errorf("claude code: create recording: %w", err)
+	}
+	logger := l.logger()
+	return &recorder{
+		dir:    dir,
+		stdout: &recordWriter{ctx: ctx, logger: logger, file: stdout},
+		stderr: &recordWriter{ctx: ctx, logger: logger, file: stderr},
+	}, nil
+}
+
+// teeStdout copies everything read from stdout into the recording.
+func (r *recorder) teeStdout(stdout io.Reader) io.Reader {
+	if r == nil {
+		return stdout
+	}
+	return io.TeeReader(stdout, r.stdout)
+}
+
+// teeStderr copies everything written to w into the recording.
+func (r *recorder) teeStderr(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return io.MultiWriter(w, r.stderr)
+}
+
+// finish writes the exit status and closes the recording files.
+// 参数：cmd 为已结束的命令，err 为视为失败的 Wait 或读取输出错误（为空表示成功）。
+func (r *recorder) finish(cmd *exec.Cmd, err error) {
+	if r == nil {
+		return
+	}
+	_ = r.stdout.file.Close()
+	_ = r.stderr.file.Close()
+	exit := RecordedExit{FinishedAt: time.Now()}
+	if err != nil {
+		exit.Error = err.Error()
+		exit.ExitCode = -1
+		if cmd.ProcessState != nil && cmd.ProcessState.ExitCode() > 0 {
+			exit.ExitCode = cmd.ProcessState.ExitCode()
+		}
+	}
+	_ = writeJSONFile(filepath.Join(r.dir, recordExitFile), exit)
+}
+
+// createRecordFile creates a recording file readable only by the current user.
+// 参数：path 为文件路径。
+// 返回：打开的文件与错误。
+func createRecordFile(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+}
+
+// writeJSONFile writes v as indented JSON.
+func writeJSONFile(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("claude code: encode %s: %w", filepath.Base(path), err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o600); err != nil {
+		return fmt.Errorf("claude code: write %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// replayer 记录每个回放目录已提供的运行数，在 LLM 副本之间共享。
+type replayer struct {
+	mu   sync.Mutex
+	next map[string]int
+}
+
+func newReplayer() *replayer {
+	return &replayer{next: make(map[string]int)}
+}
+
+// take returns the next recorded run directory.
+// dir 本身即为单次录制时每次调用都回放它；否则按名称顺序依次回放子目录。
+// 参数：dir 为 ReplayDir。
+// 返回：运行目录与错误，全部回放完毕时返回 ErrReplayExhausted。
+func (r *replayer) take(dir string) (string, error) {
+	if _, err := os.Stat(filepath.Join(dir, recordStdoutFile)); err == nil {
+		return dir, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", fmt.Errorf("claude code: read replay dir: %w", err)
+	}
+	var runs []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, entry.Name(), recordStdoutFile)); err == nil {
+			runs = append(runs, entry.Name())
+		}
+	}
+	sort.Strings(runs)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := r.next[dir]
+	if n >= len(runs) {
+		return "", fmt.Errorf("%w: %s", ErrReplayExhausted, dir)
+	}
+	r.next[dir] = n + 1
+	return filepath.Join(dir, runs[n]), nil
+}
+
+// replay feeds a recorded run to the parser instead of starting the CLI.
+// 录制的 stderr 与退出码用于还原 CLI 失败。
+// 参数：ctx 为调用方上下文，parser 为流解析器。
+// 返回：与真实运行一致的解析或 CLI 错误。
+func (l *LLM) replay(ctx context.Context, parser *streamParser) error {
+	dir, err := l.replays.take(l.opts.ReplayDir)
+	if err != nil {
+		return err
+	}
+	stdout, err := os.Open(filepath.Join(dir, recordStdoutFile))
+	if err != nil {
+		return fmt.Errorf("claude code: open recording: %w", err)
+	}
+	defer stdout.Close()
+
+	if err := l.consumeStream(ctx, stdout, parser); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+
+	var exit RecordedExit
+	if data, err := os.ReadFile(filepath.Join(dir, recordExitFile)); err == nil {
+		if err := json.Unmarshal(data, &exit); err != nil {
+			return fmt.Errorf("claude code: decode %s: %w", recordExitFile, err)
+		}
+	}
+	if exit.ExitCode != 0 {
+		stderr, _ := os.ReadFile(filepath.Join(dir, recordStderrFile))
+		errText := strings.TrimSpace(string(stderr))
+		exitErr := fmt.Errorf("claude code: recorded exit status %d", exit.ExitCode)
+		if parser.resultErr != nil {
+			parser.resultErr.Stderr = errText
+			parser.resultErr.Err = exitErr
+			return parser.resultErr
+		}
+		return processError(exitErr, errText)
+	}
+	if parser.resultErr != nil {
+		return parser.resultErr
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite testdata/replay golden files")
+
+func readTestFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	output := `{"type":"system","subtype":"init","session_id":"sess-rec"}
+{"type":"assistant","message":{"content":[{"type":"text","text":"录制的回复"}]}}
+{"type":"result","subtype":"success","session_id":"sess-rec","result":"录制的回复"}`
+	fake := claudetest.New(t).Replay(strings.Split(output, "\n")...)
+	recordDir := filepath.Join(t.TempDir(), "runs")
+
+	llm, err := New(WithCLIPath(fake.Path), WithRecordDir(recordDir), WithEnv(map[string]string{"API_TOKEN": "secret"}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := llm.Call(ctx, "机密的问题"); err != nil {
+			t.Fatalf("Call %d: %v", i, err)
+		}
+	}
+
+	entries, err := os.ReadDir(recordDir)
+	if err != nil {
+		t.Fatalf("read record dir: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 recorded runs, got %d", len(entries))
+	}
+	run := filepath.Join(recordDir, entries[0].Name())
+	if runtime.GOOS != "windows" {
+		for path, want := range map[string]os.FileMode{
+			recordDir:                                0o700,
+			run:                                      0o700,
+			filepath.Join(run, recordInvocationFile): 0o600,
+			filepath.Join(run, recordStdoutFile):     0o600,
+			filepath.Join(run, recordStderrFile):     0o600,
+			filepath.Join(run, recordExitFile):       0o600,
+		} {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("stat %s: %v", path, err)
+			}
+			if got := info.Mode().Perm(); got != want {
+				t.Fatalf("%s: mode %v, want %v", path, got, want)
+			}
+		}
+	}
+
+	stdout := readTestFile(t, filepath.Join(run, recordStdoutFile))
+	if strings.TrimSpace(stdout) != output {
+		t.Fatalf("stdout not recorded verbatim: %q", stdout)
+	}
+	var inv RecordedInvocation
+	if err := json.Unmarshal([]byte(readTestFile(t, filepath.Join(run, recordInvocationFile))), &inv); err != nil {
+		t.Fatalf("decode invocation: %v", err)
+	}
+	if inv.CLI != fake.Path || len(inv.Args) == 0 {
+		t.Fatalf("unexpected invocation: %+v", inv)
+	}
+	raw := strings.Join(append(inv.Args, inv.Env...), " ")
+	if strings.Contains(raw, "机密的问题") || strings.Contains(raw, "secret") {
+		t.Fatalf("invocation not redacted: %q", raw)
+	}
+	if !strings.HasPrefix(inv.Stdin, "[redacted ") {
+		t.Fatalf("stdin prompt not recorded redacted: %q", inv.Stdin)
+	}
+	var exit RecordedExit
+	if err := json.Unmarshal([]byte(readTestFile(t, filepath.Join(run, recordExitFile))), &exit); err != nil {
+		t.Fatalf("decode exit: %v", err)
+	}
+	if exit.ExitCode != 0 || exit.Error != "" {
+		t.Fatalf("unexpected exit: %+v", exit)
+	}
+
+	// 回放不需要 CLI，按录制顺序逐个提供，用尽后返回 ErrReplayExhausted。
+	replayer, err := New(WithCLIPath(filepath.Join(t.TempDir(), "missing")), WithReplayDir(recordDir))
+	if err != nil {
+		t.Fatalf("New replay: %v", err)
+	}
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "机密的问题")}
+	for i := 0; i < 2; i++ {
+		resp, err := replayer.GenerateContent(ctx, messages)
+		if err != nil {
+			t.Fatalf("replay %d: %v", i, err)
+		}
+		if got := resp.Choices[0].Content; got != "录制的回复" {
+			t.Fatalf("unexpected replayed content: %q", got)
+		}
+		if got := resp.Choices[0].GenerationInfo["SessionID"]; got != "sess-rec" {
+			t.Fatalf("unexpected replayed session id: %v", got)
+		}
+	}
+	if _, err := replayer.Call(ctx, "again"); !errors.Is(err, ErrReplayExhausted) {
+		t.Fatalf("expected ErrReplayExhausted, got %v", err)
+	}
+}
+
+func TestRecordCapturesStdinPrompt(t *testing.T) {
+	fake := claudetest.New(t)
+	recordDir := t.TempDir()
+	llm, err := New(WithCLIPath(fake.Path), WithRecordDir(recordDir), WithRedaction(0))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := llm.Call(context.Background(), "经 stdin 的问题"); err != nil {
+		t.Fatalf("Call: %v", err)
+	}
+	entries, err := os.ReadDir(recordDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected 1 recorded run: %v %v", entries, err)
+	}
+	var inv RecordedInvocation
+	if err := json.Unmarshal([]byte(readTestFile(t, filepath.Join(recordDir, entries[0].Name(), recordInvocationFile))), &inv); err != nil {
+		t.Fatalf("decode invocation: %v", err)
+	}
+	if inv.Stdin != fake.LastInvocation().Stdin || !strings.Contains(inv.Stdin, "经 stdin 的问题") {
+		t.Fatalf("stdin not recorded: %q", inv.Stdin)
+	}
+}
+
+func TestRecordWriterNeverFails(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatalf("CreateTemp: %v", err)
+	}
+	_ = file.Close()
+	w := &recordWriter{ctx: context.Background(), logger: (&LLM{}).logger(), file: file}
+	for i := 0; i < 2; i++ {
+		if n, err := w.Write([]byte("line\n")); n != 5 || err != nil {
+			t.Fatalf("Write: %d %v", n, err)
+		}
+	}
+	if w.err == nil {
+		t.Fatalf("expected the write error to be recorded")
+	}
+}
+
+func TestReplaySkipsLiveCallSetup(t *testing.T) {
+	limiter := NewLimiter(LimiterConfig{MaxRunning: 1})
+	release, err := limiter.Acquire(context.Background(), PriorityNormal)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	defer release()
+	llm, err := New(
+		WithCLIPath("claude"),
+		WithReplayDir(filepath.Join("testdata", "replay", "rate_limited")),
+		WithLimiter(limiter),
+		WithToolHandler(func(context.Context, llms.FunctionCall) (string, error) { return "", nil }),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	// Limiter 已满：回放不应排队等待名额。
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	tools := []llms.Tool{{Type: "function", Function: &llms.FunctionDefinition{Name: "lookup"}}}
+	if _, err := llm.Call(ctx, "hi", llms.WithTools(tools)); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected the recorded ErrRateLimited, got %v", err)
+	}
+}
+
+func TestReplayRecordedFailure(t *testing.T) {
+	llm, err := New(WithCLIPath("claude"), WithReplayDir(filepath.Join("testdata", "replay", "rate_limited")))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	_, err = llm.Call(context.Background(), "hi")
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("expected ErrRateLimited, got %v", err)
+	}
+	var cliErr *CLIError
+	if !errors.As(err, &cliErr) || !strings.Contains(cliErr.Stderr, "429") {
+		t.Fatalf("expected recorded stderr, got %#v", err)
+	}
+}
+
+// TestReplayGolden 回放 testdata/replay 下的录制并与各输出模式的 golden 文件比对，
+// 使用 go test -run TestReplayGolden -update 重新生成。
+func TestReplayGolden(t *testing.T) {
+	runs, err := filepath.Glob(filepath.Join("testdata", "replay", "*", recordStdoutFile))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	modes := []OutputMode{OutputModeText, OutputModeVerbose, OutputModeFull}
+	for _, stdout := range runs {
+		dir := filepath.Dir(stdout)
+		if _, err := os.Stat(filepath.Join(dir, recordExitFile)); err == nil {
+			// 失败的录制由 TestReplayRecordedFailure 覆盖。
+			continue
+		}
+		for _, mode := range modes {
+			t.Run(filepath.Base(dir)+"/"+mode.String(), func(t *testing.T) {
+				llm, err := New(WithCLIPath("claude"), WithReplayDir(dir), WithOutputMode(mode))
+				if err != nil {
+					t.Fatalf("New: %v", err)
+				}
+				got, err := llm.Call(context.Background(), "hi")
+				if err != nil {
+					t.Fatalf("Call: %v", err)
+				}
+				golden := filepath.Join(dir, mode.String()+".golden")
+				if *updateGolden {
+					if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+						t.Fatalf("write golden: %v", err)
+					}
+					return
+				}
+				if want := readTestFile(t, golden); got != want {
+					t.Fatalf("output mismatch for %s\n--- got ---\n%s\n--- want ---\n%s", golden, got, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package claudecode
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrSchemaValidation is the kind of errors returned when structured output does not match Options.JSONSchema.
+var ErrSchemaValidation = errors.New("claude code: structured output does not match schema")
+
+// SchemaError 描述结构化输出未通过 JSON Schema 校验的原因。
+type SchemaError struct {
+	// Errors 为各个违反项，形如 "$.priority: value must be one of [...]"。
+	Errors []string
+	// Output 为模型返回的原始输出，便于重试时反馈给模型。
+	Output string
+	// SessionID 为产生该输出的会话 ID，CLI 未上报时为空。
+	SessionID string
+}
+
+// Error implements error.
+func (e *SchemaError) Error() string {
+	return ErrSchemaValidation.Error() + ": " + strings.Join(e.Errors, "; ")
+}
+
+// Unwrap returns ErrSchemaValidation.
+func (e *SchemaError) Unwrap() error {
+	return ErrSchemaValidation
+}
+
+// encodeJSONSchema normalizes Options.JSONSchema into a decoded schema and its compact JSON.
+// 参数：schema 为 JSON 文本（string、[]byte、json.RawMessage）或可编码为 JSON 的值。
+// 返回：解码后的 schema、紧凑 JSON 文本与错误。
+func encodeJSONSchema(schema any) (map[string]any, string, error) {
+	var data []byte
+	switch s := schema.(type) {
+	case string:
+		data = []byte(s)
+	case []byte:
+		data = s
+	case json.RawMessage:
+		data = s
+	default:
+		var err error
+		if data, err = json.Marshal(schema); err != nil {
+			return nil, "", fmt.Errorf("claude code: encode json schema: %w", err)
+		}
+	}
+	var decoded map[string]any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil, "", fmt.Errorf("claude code: decode json schema: %w", err)
+	}
+	compact, err := json.Marshal(decoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("claude code: encode json schema: %w", err)
+	}
+	return decoded, string(compact), nil
+}
+
+// validateJSONSchema validates a decoded JSON value against a schema.
+// 支持 Claude 结构化输出常用的 JSON Schema 子集：type、enum、const、properties、required、
+// additionalProperties、items、prefixItems、min/max 系列、pattern、allOf/anyOf/oneOf/not
+// 以及指向 #/$defs 或 #/definitions 的 $ref；不认识的关键字被忽略。
+// 参数：schema 为解码后的 schema，value 为待校验的值。
+// 返回：违反项列表，为空表示通过。
+func validateJSONSchema(schema map[string]any, value any) []string {
+	v := &schemaValidator{root: schema}
+	v.validate(schema, value, "$")
+	return v.errs
+}
+
+// schemaValidator 收集校验过程中的违反项。
+type schemaValidator struct {
+	root  map[string]any
+	errs  []string
+	depth int
+}
+
+func (v *schemaValidator) fail(path, format string, args ...any) {
+	v.errs = append(v.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+// valid reports whether value matches schema without recording errors.
+func (v *schemaValidator) valid(schema any, value any, path string) bool {
+	sub := &schemaValidator{root: v.root, depth: v.depth}
+	sub.validate(schema, value, path)
+	return len(sub.errs) == 0
+}
+
+func (v *schemaValidator) validate(schemaValue any, value any, path string) {
+	switch s := schemaValue.(type) {
+	case bool:
+		if !s {
+			v.fail(path, "no value is allowed here")
+		}
+		return
+	case map[string]any:
+		v.validateObjectSchema(s, value, path)
+	}
+}
+
+func (v *schemaValidator) validateObjectSchema(schema map[string]any, value any, path string) {
+	if ref, ok := schema["$ref"].(string); ok {
+		// 防止自引用 schema 无限递归。
+		if v.depth > 64 {
+			v.fail(path, "schema $ref nesting too deep")
+			return
+		}
+		target, err := v.resolveRef(ref)
+		if err != nil {
+			v.fail(path, "%v", err)
+			return
+		}
+		v.depth++
+		v.validate(target, value, path)
+		v.depth--
+	}
+
+	if types := schemaTypes(schema["type"]); len(types) > 0 {
+		actual := jsonType(value)
+		matched := false
+		for _, t := range types {
+			if t == actual || (t == "number" && actual == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "expected %s, got %s", strings.Join(types, " or "), actual)
+			return
+		}
+	}
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, candidate := range enum {
+			if jsonEqual(candidate, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "value must be one of %s", compactJSON(enum))
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		v.fail(path, "value must be %s", compactJSON(c))
+	}
+
+	switch val := value.(type) {
+	case string:
+		v.validateString(schema, val, path)
+	case float64:
+		v.validateNumber(schema, val, path)
+	case []any:
+		v.validateArray(schema, val, path)
+	case map[string]any:
+		v.validateObject(schema, val, path)
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			v.validate(sub, value, path)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if v.valid(sub, value, path) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "value does not match any schema in anyOf")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if v.valid(sub, value, path) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(path, "value must match exactly one schema in oneOf, matched %d", matched)
+		}
+	}
+	if not, ok := schema["not"]; ok && v.valid(not, value, path) {
+		v.fail(path, "value must not match schema in not")
+	}
+}
+
+func (v *schemaValidator) validateString(schema map[string]any, s, path string) {
+	length := utf8.RuneCountInString(s)
+	if n, ok := schemaNumber(schema, "minLength"); ok && float64(length) < n {
+		v.fail(path, "string shorter than %v", n)
+	}
+	if n, ok := schemaNumber(schema, "maxLength"); ok && float64(length) > n {
+		v.fail(path, "string longer than %v", n)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			v.fail(path, "invalid pattern %q in schema", pattern)
+		} else if !re.MatchString(s) {
+			v.fail(path, "string does not match pattern %q", pattern)
+		}
+	}
+}
+
+func (v *schemaValidator) validateNumber(schema map[string]any, n float64, path string) {
+	if min, ok := schemaNumber(schema, "minimum"); ok && n < min {
+		v.fail(path, "value must be >= %v", min)
+	}
+	if max, ok := schemaNumber(schema, "maximum"); ok && n > max {
+		v.fail(path, "value must be <= %v", max)
+	}
+	if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && n <= min {
+		v.fail(path, "value must be > %v", min)
+	}
+	if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && n >= max {
+		v.fail(path, "value must be < %v", max)
+	}
+	if m, ok := schemaNumber(schema, "multipleOf"); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "value must be a multiple of %v", m)
+		}
+	}
+}
+
+func (v *schemaValidator) validateArray(schema map[string]any, items []any, path string) {
+	if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(items)) < n {
+		v.fail(path, "array must have at least %v items", n)
+	}
+	if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(items)) > n {
+		v.fail(path, "array must have at most %v items", n)
+	}
+	start := 0
+	if prefix, ok := schema["prefixItems"].([]any); ok {
+		for i := 0; i < len(prefix) && i < len(items); i++ {
+			v.validate(prefix[i], items[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+		start = len(prefix)
+	}
+	if itemSchema, ok := schema["items"]; ok {
+		for i := start; i < len(items); i++ {
+			v.validate(itemSchema, items[i], fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range items {
+			for j := i + 1; j < len(items); j++ {
+				if jsonEqual(items[i], items[j]) {
+					v.fail(path, "array items %d and %d are equal", i, j)
+				}
+			}
+		}
+	}
+}
+
+func (v *schemaValidator) validateObject(schema map[string]any, obj map[string]any, path string) {
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if key, ok := name.(string); ok {
+				if _, present := obj[key]; !present {
+					v.fail(path, "missing required property %q", key)
+				}
+			}
+		}
+	}
+	if n, ok := schemaNumber(schema, "minProperties"); ok && float64(len(obj)) < n {
+		v.fail(path, "object must have at least %v properties", n)
+	}
+	if n, ok := schemaNumber(schema, "maxProperties"); ok && float64(len(obj)) > n {
+		v.fail(path, "object must have at most %v properties", n)
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	// 按键排序，保证错误顺序稳定。
+	sort.Strings(keys)
+	for _, key := range keys {
+		child := path + "." + key
+		if propSchema, ok := properties[key]; ok {
+			v.validate(propSchema, obj[key], child)
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(child, "additional property is not allowed")
+			}
+		case map[string]any:
+			v.validate(additional, obj[key], child)
+		}
+	}
+}
+
+// resolveRef resolves a local JSON pointer such as #/$defs/Ticket.
+func (v *schemaValidator) resolveRef(ref string) (any, error) {
+	if ref == "#" {
+		return v.root, nil
+	}
+	pointer, ok := strings.CutPrefix(ref, "#/")
+	if !ok {
+		return nil, fmt.Errorf("unsupported $ref %q", ref)
+	}
+	var node any = v.root
+	for _, token := range strings.Split(pointer, "/") {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		obj, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		if node, ok = obj[token]; !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+	}
+	return node, nil
+}
+
+// schemaTypes normalizes the type keyword into a list.
+func schemaTypes(t any) []string {
+	switch typ := t.(type) {
+	case string:
+		return []string{typ}
+	case []any:
+		types := make([]string, 0, len(typ))
+		for _, item := range typ {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+// schemaNumber reads a numeric schema keyword.
+func schemaNumber(schema map[string]any, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+// jsonType returns the JSON Schema type name of a decoded value.
+func jsonType(value any) string {
+	switch val := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case float64:
+		if val == math.Trunc(val) && !math.IsInf(val, 0) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// jsonEqual compares two decoded JSON values.
+func jsonEqual(a, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+// compactJSON renders a value for error messages.
+func compactJSON(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
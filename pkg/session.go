@@ -0,0 +1,411 @@
+package claudecode
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ErrSessionClosed is returned when a turn is sent to a closed session.
+var ErrSessionClosed = errors.New("claude code: session closed")
+
+// ErrSessionTools is returned when llms.WithTools is passed to a Session turn.
+var ErrSessionTools = errors.New("claude code: session does not support llms.WithTools")
+
+// ErrSessionOptions is returned when a Session turn carries settings fixed at NewSession
+// (model, max tokens, JSON mode, WithCallOptions overrides or a different system prompt).
+var ErrSessionOptions = errors.New("claude code: session does not support per-call options")
+
+// Session is a long-lived Claude Code CLI process driven over
+// --input-format stream-json. It implements llms.Model; each GenerateContent
+// call is one user turn, and the CLI keeps the conversation history itself.
+//
+// 调用方工具（llms.WithTools）在会话中不受支持，传入时返回 ErrSessionTools；
+// 需要工具时使用 LLM.GenerateContent。模型、系统提示词等在 NewSession 时已固定，
+// 轮次中的 llms.WithModel、llms.WithMaxTokens、llms.WithJSONMode、WithCallOptions，
+// 以及与 Options.SystemPrompt 不同的系统消息返回 ErrSessionOptions；仅 llms.WithStreamingFunc 生效。
+// 取消某一轮会终止 CLI，会话随之关闭。
+type Session struct {
+	llm    *LLM
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	lines  chan string
+	stderr bytes.Buffer
+	// reap 代替 cmd.Wait 等待 CLI 退出并清理进程组。
+	reap func() error
+	// attachDir 存放无法以 content block 发送的附件，会话关闭时删除。
+	attachDir string
+	// releaseSlot 归还 Limiter 名额。
+	releaseSlot func()
+	// bridge 承载 PermissionHandler 的审批工具，未配置时为 nil。
+	bridge *toolBridge
+	// mcpConfigPath 为没有 bridge 时单独写入的 --mcp-config 文件，会话关闭时删除。
+	mcpConfigPath string
+
+	// turnMu 串行化各轮对话，stream-json 输出无法区分并发轮次。
+	turnMu sync.Mutex
+
+	mu        sync.Mutex
+	closed    bool
+	readErr   error
+	sessionID string
+	// mcpServers 为 CLI 上报的 MCP server 连接状态。
+	mcpServers []stream.MCPServerStatus
+
+	readerDone chan struct{}
+	stderrDone chan struct{}
+	closeOnce  sync.Once
+	closeErr   error
+}
+
+// NewSession starts a persistent CLI process using the LLM options.
+// 参数：ctx 控制子进程的整个生命周期，取消后进程会被终止。
+// 返回：*Session 与错误。
+func (l *LLM) NewSession(ctx context.Context) (*Session, error) {
+	if l == nil {
+		return nil, errors.New("claude code: nil receiver")
+	}
+
+	// 长会话在整个生命周期内占用一个 Limiter 名额。
+	releaseSlot, err := l.opts.Limiter.Acquire(ctx, l.opts.Priority)
+	if err != nil {
+		return nil, err
+	}
+
+	attachDir, err := os.MkdirTemp("", "claudecode-attachments-")
+	if err != nil {
+		releaseSlot()
+		return nil, fmt.Errorf("claude code: create attachment dir: %w", err)
+	}
+	// 会话进程内的调用方工具不经过桥接，桥接仅用于权限审批。
+	bridge, err := l.startToolBridge(ctx, nil, nil)
+	if err != nil {
+		_ = os.RemoveAll(attachDir)
+		releaseSlot()
+		return nil, err
+	}
+	mcpConfigPath := ""
+	if bridge == nil && len(l.opts.MCPServers) > 0 {
+		if mcpConfigPath, err = l.writeMCPServersConfig(); err != nil {
+			_ = os.RemoveAll(attachDir)
+			releaseSlot()
+			return nil, err
+		}
+	}
+	startErr := func(err error) (*Session, error) {
+		bridge.Close()
+		removeIfSet(mcpConfigPath)
+		_ = os.RemoveAll(attachDir)
+		releaseSlot()
+		return nil, err
+	}
+
+	inv := invocation{
+		systemPrompt: strings.TrimSpace(l.opts.SystemPrompt),
+		addDirs:      []string{attachDir},
+	}
+	if bridge != nil {
+		inv.mcpConfigPath = bridge.configPath
+		inv.permissionPromptTool = bridge.permissionTool
+	} else {
+		inv.mcpConfigPath = mcpConfigPath
+	}
+	if inv.agents, err = encodeAgents(l.opts.Agents); err != nil {
+		return startErr(err)
+	}
+	if l.useStdin(len(inv.systemPrompt)) {
+		// 写入附件目录，随会话关闭一并删除。
+		if inv.systemPromptFile, err = writeSystemPromptFile(attachDir, inv.systemPrompt); err != nil {
+			return startErr(err)
+		}
+	}
+	args := l.buildArgs(inv)
+	args = append(args, "--input-format", "stream-json", "--print")
+	l.logCommand(ctx, "claude code: session command", args)
+
+	cmd := exec.CommandContext(ctx, l.cliPath, args...)
+	reap := configureProcess(cmd, l.opts.CancelGracePeriod)
+	cmd.Env = mergeEnv(os.Environ(), l.opts.Env)
+	if l.opts.Cwd != "" {
+		cmd.Dir = l.opts.Cwd
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return startErr(fmt.Errorf("claude code: stdin pipe: %w", err))
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return startErr(fmt.Errorf("claude code: stdout pipe: %w", err))
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return startErr(fmt.Errorf("claude code: stderr pipe: %w", err))
+	}
+	if err := cmd.Start(); err != nil {
+		return startErr(fmt.Errorf("claude code: start cli: %w", err))
+	}
+
+	s := &Session{
+		llm:           l,
+		cmd:           cmd,
+		reap:          reap,
+		stdin:         stdin,
+		attachDir:     attachDir,
+		releaseSlot:   releaseSlot,
+		bridge:        bridge,
+		mcpConfigPath: mcpConfigPath,
+		lines:         make(chan string),
+		readerDone:    make(chan struct{}),
+		stderrDone:    make(chan struct{}),
+	}
+	go func() {
+		_, _ = io.Copy(&s.stderr, stderr)
+		close(s.stderrDone)
+	}()
+	go s.readLoop(stdout)
+
+	return s, nil
+}
+
+// readLoop forwards stdout lines to the active turn until the CLI exits.
+// 参数：stdout 为 CLI 标准输出。
+func (s *Session) readLoop(stdout io.Reader) {
+	defer close(s.readerDone)
+	defer close(s.lines)
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), s.llm.opts.MaxBufferSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		s.lines <- line
+	}
+	if err := scanner.Err(); err != nil {
+		s.mu.Lock()
+		s.readErr = fmt.Errorf("claude code: read stdout: %w", err)
+		s.mu.Unlock()
+	}
+}
+
+// SessionID returns the session ID reported by the CLI, empty before the first turn.
+func (s *Session) SessionID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessionID
+}
+
+// MCPServers returns the MCP server statuses reported by the CLI, nil before the first turn.
+func (s *Session) MCPServers() []stream.MCPServerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.mcpServers
+}
+
+// Call implements llms.Model.Call by delegating to GenerateFromSinglePrompt.
+// 参数：ctx 为上下文，prompt 为输入文本，options 为调用参数。
+// 返回：模型响应文本与错误。
+func (s *Session) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, s, prompt, options...)
+}
+
+// GenerateContent implements llms.Model.GenerateContent as one session turn.
+// 只发送最后一条 AI 消息之后的内容，之前的历史已由 CLI 会话保存；
+// system 消息在会话启动时已固定，此处忽略。
+// 参数：ctx 为上下文，messages 为对话消息，options 为调用参数。
+// 返回：统一的 ContentResponse 与错误。
+func (s *Session) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) { //nolint:lll
+	if s == nil {
+		return nil, errors.New("claude code: nil receiver")
+	}
+
+	callOpts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&callOpts)
+	}
+	if len(callOpts.Tools) > 0 {
+		return nil, ErrSessionTools
+	}
+	if err := sessionCallOptionsError(callOpts); err != nil {
+		return nil, err
+	}
+
+	system, nonSystem, err := splitSystemMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+	if system = strings.TrimSpace(system); system != "" && system != strings.TrimSpace(s.llm.opts.SystemPrompt) {
+		// 系统提示词在 CLI 启动时传递，之后无法修改。
+		return nil, fmt.Errorf("%w: system message differs from the session system prompt", ErrSessionOptions)
+	}
+	content, err := s.llm.newContentBuilder(s.attachDir).build(pendingTurn(nonSystem), false)
+	if err != nil {
+		return nil, err
+	}
+	if len(content) == 0 {
+		return nil, ErrEmptyPrompt
+	}
+
+	s.turnMu.Lock()
+	defer s.turnMu.Unlock()
+
+	if err := s.writeUserMessage(content); err != nil {
+		return nil, err
+	}
+
+	// 消费本轮输出，直到读到 result 消息。
+	parser := s.llm.newStreamParser(callOpts.StreamingFunc)
+	if s.bridge != nil {
+		parser.onSessionID = s.bridge.setSessionID
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			// 输出流已无法与轮次对齐，只能终止会话；不等待 CLI 完成本轮。
+			s.abort()
+			return nil, ctx.Err()
+		case line, ok := <-s.lines:
+			if !ok {
+				return nil, s.exitError()
+			}
+			done, err := parser.handleLine(ctx, line)
+			s.mu.Lock()
+			if parser.sessionID != "" {
+				s.sessionID = parser.sessionID
+			}
+			if parser.mcpServers != nil {
+				s.mcpServers = parser.mcpServers
+			}
+			s.mu.Unlock()
+			if err != nil {
+				s.abort()
+				return nil, err
+			}
+			if !done {
+				continue
+			}
+			if parser.resultErr != nil {
+				// 失败的轮次不影响会话本身，后续轮次仍可继续。
+				return nil, parser.resultErr
+			}
+			choice := &llms.ContentChoice{
+				Content:        parser.builder.String(),
+				GenerationInfo: parser.generationInfo,
+			}
+			return &llms.ContentResponse{Choices: []*llms.ContentChoice{choice}}, nil
+		}
+	}
+}
+
+// sessionCallOptionsError reports per-call options a running session cannot apply.
+// 参数：callOpts 为本轮调用参数。
+// 返回：包装 ErrSessionOptions 的错误，全部可用时为 nil。
+func sessionCallOptionsError(callOpts llms.CallOptions) error {
+	var unsupported []string
+	if callOpts.Model != "" {
+		unsupported = append(unsupported, "model")
+	}
+	if callOpts.MaxTokens > 0 {
+		unsupported = append(unsupported, "max tokens")
+	}
+	if callOpts.JSONMode || callOpts.ResponseMIMEType == "application/json" {
+		unsupported = append(unsupported, "json mode")
+	}
+	if overrides, _ := callOpts.Metadata[callOptionsMetadataKey].([]Option); len(overrides) > 0 {
+		unsupported = append(unsupported, "WithCallOptions")
+	}
+	if len(unsupported) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrSessionOptions, strings.Join(unsupported, ", "))
+}
+
+// writeUserMessage writes one stream-json user message to the CLI stdin.
+// 参数：content 为本轮 content blocks。
+// 返回：写入错误。
+func (s *Session) writeUserMessage(content []map[string]any) error {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return ErrSessionClosed
+	}
+
+	data, err := encodeUserMessage(content, s.SessionID())
+	if err != nil {
+		return err
+	}
+	if _, err := s.stdin.Write(data); err != nil {
+		return fmt.Errorf("claude code: write stdin: %w", err)
+	}
+	return nil
+}
+
+// exitError describes why the CLI stopped producing output.
+// 返回：包含 stderr 信息的错误。
+func (s *Session) exitError() error {
+	<-s.stderrDone
+	s.mu.Lock()
+	readErr := s.readErr
+	s.mu.Unlock()
+	if readErr != nil {
+		return readErr
+	}
+	errText := strings.TrimSpace(s.stderr.String())
+	if errText != "" {
+		return fmt.Errorf("%w: cli exited: %s", ErrSessionClosed, errText)
+	}
+	return fmt.Errorf("%w: cli exited", ErrSessionClosed)
+}
+
+// abort terminates the CLI process group and reaps it in the background.
+// 用于无法继续对齐输出的轮次（取消或解析失败），调用方无需等待进程退出。
+func (s *Session) abort() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	// cmd.Cancel 由 configureProcess 设置：先中断进程组，宽限期后强制终止。
+	if err := s.cmd.Cancel(); err != nil {
+		killProcess(s.cmd)
+	}
+	go func() { _ = s.Close() }()
+}
+
+// Close ends the session by closing stdin and waiting for the CLI to exit.
+// 返回：子进程退出错误。
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+
+		_ = s.stdin.Close()
+		// 丢弃未被消费的输出，避免 readLoop 阻塞导致进程无法退出。
+		go func() {
+			for range s.lines {
+			}
+		}()
+		<-s.readerDone
+		<-s.stderrDone
+		if err := s.reap(); err != nil {
+			s.closeErr = fmt.Errorf("claude code: session exit: %w", err)
+		}
+		s.bridge.Close()
+		removeIfSet(s.mcpConfigPath)
+		_ = os.RemoveAll(s.attachDir)
+		s.releaseSlot()
+	})
+	return s.closeErr
+}
@@ -0,0 +1,183 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestSessionMultipleTurns(t *testing.T) {
+	fake := claudetest.New(t).ReplayTurns(
+		[]string{
+			`{"type":"system","subtype":"init","session_id":"sess-1"}`,
+			`{"type":"assistant","message":{"content":[{"type":"text","text":"reply 1"}]}}`,
+			`{"type":"result","subtype":"success","session_id":"sess-1","result":"reply 1"}`,
+		},
+		[]string{
+			`{"type":"assistant","message":{"content":[{"type":"text","text":"reply 2"}]}}`,
+			`{"type":"result","subtype":"success","session_id":"sess-1","result":"reply 2"}`,
+		},
+	)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	ctx := context.Background()
+	session, err := llm.NewSession(ctx)
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	first, err := session.Call(ctx, "你好")
+	if err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+	if first != "reply 1" {
+		t.Fatalf("unexpected first reply: %q", first)
+	}
+
+	history := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeHuman, "你好"),
+		llms.TextParts(llms.ChatMessageTypeAI, first),
+		llms.TextParts(llms.ChatMessageTypeHuman, "继续"),
+	}
+	resp, err := session.GenerateContent(ctx, history)
+	if err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+	if got := resp.Choices[0].Content; got != "reply 2" {
+		t.Fatalf("unexpected second reply: %q", got)
+	}
+	if session.SessionID() != "sess-1" {
+		t.Fatalf("unexpected session id: %q", session.SessionID())
+	}
+
+	if err := session.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, err := session.Call(ctx, "again"); err == nil {
+		t.Fatalf("expected error after close")
+	}
+
+	lines := fake.LastInvocation().StdinLines()
+	if len(lines) != 2 {
+		t.Fatalf("unexpected stdin lines: %q", lines)
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Message struct {
+			Role    string `json:"role"`
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &msg); err != nil {
+		t.Fatalf("decode user message: %v", err)
+	}
+	if msg.Type != "user" || msg.Message.Role != "user" || len(msg.Message.Content) != 1 {
+		t.Fatalf("unexpected user message: %+v", msg)
+	}
+	if msg.Message.Content[0].Text != "继续" {
+		t.Fatalf("expected only the new turn, got %q", msg.Message.Content[0].Text)
+	}
+}
+
+func TestSessionCancelledTurnKillsCLI(t *testing.T) {
+	fake := claudetest.New(t).HangAfter(1).ReplayTurns([]string{
+		`{"type":"system","subtype":"init","session_id":"sess-1"}`,
+		`{"type":"result","subtype":"success","session_id":"sess-1","result":"never"}`,
+	})
+	llm, err := New(WithCLIPath(fake.Path), WithCancelGracePeriod(100*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session, err := llm.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := session.Call(ctx, "长任务"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancelled turn returned after %v", elapsed)
+	}
+	if _, err := session.Call(context.Background(), "继续"); !errors.Is(err, ErrSessionClosed) {
+		t.Fatalf("expected ErrSessionClosed, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_ = session.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close did not reap the killed CLI")
+	}
+}
+
+func TestSessionRejectsTools(t *testing.T) {
+	fake := claudetest.New(t)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session, err := llm.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	tools := []llms.Tool{{Type: "function", Function: &llms.FunctionDefinition{Name: "lookup"}}}
+	if _, err := session.Call(context.Background(), "查询", llms.WithTools(tools)); !errors.Is(err, ErrSessionTools) {
+		t.Fatalf("expected ErrSessionTools, got %v", err)
+	}
+}
+
+func TestSessionRejectsPerCallOptions(t *testing.T) {
+	fake := claudetest.New(t)
+	llm, err := New(WithCLIPath(fake.Path), WithSystemPrompt("你是助手"))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	session, err := llm.NewSession(context.Background())
+	if err != nil {
+		t.Fatalf("NewSession: %v", err)
+	}
+	defer session.Close()
+
+	ctx := context.Background()
+	for name, opt := range map[string]llms.CallOption{
+		"model":        llms.WithModel("claude-opus"),
+		"max tokens":   llms.WithMaxTokens(100),
+		"json mode":    llms.WithJSONMode(),
+		"call options": WithCallOptions(WithJSONSchema(`{"type":"object"}`)),
+	} {
+		if _, err := session.Call(ctx, "你好", opt); !errors.Is(err, ErrSessionOptions) {
+			t.Errorf("%s: expected ErrSessionOptions, got %v", name, err)
+		}
+	}
+
+	changed := []llms.MessageContent{
+		llms.TextParts(llms.ChatMessageTypeSystem, "你是翻译"),
+		llms.TextParts(llms.ChatMessageTypeHuman, "你好"),
+	}
+	if _, err := session.GenerateContent(ctx, changed); !errors.Is(err, ErrSessionOptions) {
+		t.Fatalf("expected ErrSessionOptions for a different system prompt, got %v", err)
+	}
+}
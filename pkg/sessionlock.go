@@ -0,0 +1,83 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrSessionBusy is returned when a session already has too many queued calls
+// or the queue timeout expires before the running call finishes.
+var ErrSessionBusy = errors.New("claude code: session busy")
+
+// sessionLocker 按会话 ID 串行化调用，不同会话之间互不阻塞。
+type sessionLocker struct {
+	mu    sync.Mutex
+	slots map[string]*sessionSlot
+}
+
+// sessionSlot 为单个会话的互斥量与排队计数。
+type sessionSlot struct {
+	sem  chan struct{}
+	refs int // 正在运行与排队中的调用数
+}
+
+func newSessionLocker() *sessionLocker {
+	return &sessionLocker{slots: make(map[string]*sessionSlot)}
+}
+
+// acquire waits until no other call is running for key.
+// 参数：ctx 为上下文，key 为会话 ID（为空时不串行化），depth 为允许排队的调用数，
+// timeout 为最长排队时间（0 表示仅受 ctx 限制）。
+// 返回：释放函数与错误；队列已满或排队超时时返回 ErrSessionBusy。
+func (s *sessionLocker) acquire(ctx context.Context, key string, depth int, timeout time.Duration) (func(), error) {
+	if s == nil || key == "" {
+		return func() {}, nil
+	}
+
+	s.mu.Lock()
+	slot, ok := s.slots[key]
+	if !ok {
+		slot = &sessionSlot{sem: make(chan struct{}, 1)}
+		s.slots[key] = slot
+	}
+	if slot.refs > depth {
+		// 已有 1 个运行中与 depth 个排队中的调用。
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%w: %s has %d queued calls", ErrSessionBusy, key, depth)
+	}
+	slot.refs++
+	s.mu.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case slot.sem <- struct{}{}:
+		return func() {
+			<-slot.sem
+			s.leave(key, slot)
+		}, nil
+	case <-ctx.Done():
+		s.leave(key, slot)
+		return nil, ctx.Err()
+	case <-expired:
+		s.leave(key, slot)
+		return nil, fmt.Errorf("%w: %s still running after %v", ErrSessionBusy, key, timeout)
+	}
+}
+
+// leave drops one reference and forgets idle slots.
+func (s *sessionLocker) leave(key string, slot *sessionSlot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slot.refs--
+	if slot.refs == 0 {
+		delete(s.slots, key)
+	}
+}
@@ -0,0 +1,102 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+)
+
+func TestSessionLockerQueuesAndRejects(t *testing.T) {
+	locker := newSessionLocker()
+	ctx := context.Background()
+
+	release, err := locker.acquire(ctx, "sess-1", 1, 0)
+	if err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	// 不同会话互不阻塞。
+	other, err := locker.acquire(ctx, "sess-2", 0, 0)
+	if err != nil {
+		t.Fatalf("acquire other session: %v", err)
+	}
+	other()
+
+	queued := make(chan error, 1)
+	go func() {
+		r, err := locker.acquire(ctx, "sess-1", 1, 0)
+		if err == nil {
+			r()
+		}
+		queued <- err
+	}()
+	// 等待排队的调用登记后，队列已满。
+	deadline := time.Now().Add(time.Second)
+	for {
+		locker.mu.Lock()
+		refs := locker.slots["sess-1"].refs
+		locker.mu.Unlock()
+		if refs == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("queued call not registered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := locker.acquire(ctx, "sess-1", 1, 0); !errors.Is(err, ErrSessionBusy) {
+		t.Fatalf("expected ErrSessionBusy for full queue, got %v", err)
+	}
+	if _, err := locker.acquire(ctx, "sess-1", 5, 20*time.Millisecond); !errors.Is(err, ErrSessionBusy) {
+		t.Fatalf("expected ErrSessionBusy after timeout, got %v", err)
+	}
+
+	release()
+	if err := <-queued; err != nil {
+		t.Fatalf("queued call: %v", err)
+	}
+	locker.mu.Lock()
+	defer locker.mu.Unlock()
+	if len(locker.slots) != 0 {
+		t.Fatalf("idle slots not released: %v", locker.slots)
+	}
+}
+
+func TestGenerateContentSerializesSameSession(t *testing.T) {
+	fake := claudetest.New(t).Delay(100 * time.Millisecond).Replay(`{"type":"result","subtype":"success","session_id":"sess-1","result":"ok"}`)
+	llm, err := New(WithCLIPath(fake.Path), WithSessionID("sess-1"), WithResume(true))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := llm.Call(context.Background(), "你好")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+	}
+	invocations := fake.Invocations()
+	if len(invocations) != 3 {
+		t.Fatalf("expected 3 invocations, got %d", len(invocations))
+	}
+	for i := 1; i < len(invocations); i++ {
+		if prev := invocations[i-1]; prev.ExitedAt.IsZero() || invocations[i].StartedAt.Before(prev.ExitedAt) {
+			t.Fatalf("calls overlapped: %v started before %v exited", invocations[i].StartedAt, prev.ExitedAt)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ErrSessionNotFound is returned when a session key has no stored session.
+var ErrSessionNotFound = errors.New("claude code: session not found")
+
+// SessionManager maps caller conversation keys (chat IDs, thread IDs) to
+// Claude Code session IDs. Each turn resumes the stored session, and the
+// session ID reported by the CLI is captured and persisted after the turn.
+type SessionManager struct {
+	llm   *LLM
+	store SessionStore
+	ttl   time.Duration
+	now   func() time.Time
+	// keys 按会话键串行化，避免首轮并发时各自创建新会话。
+	keys *sessionLocker
+}
+
+// SessionManagerOption configures a SessionManager.
+type SessionManagerOption func(*SessionManager)
+
+// WithSessionStore sets the store used to persist the key-to-session mapping.
+// 参数：store 为 SessionStore 实现，默认 MemorySessionStore。
+func WithSessionStore(store SessionStore) SessionManagerOption {
+	return func(m *SessionManager) {
+		if store != nil {
+			m.store = store
+		}
+	}
+}
+
+// WithSessionTTL expires sessions that have been idle for longer than ttl.
+// 参数：ttl 为空闲过期时间，0 表示永不过期。
+func WithSessionTTL(ttl time.Duration) SessionManagerOption {
+	return func(m *SessionManager) {
+		m.ttl = ttl
+	}
+}
+
+// NewSessionManager creates a manager that runs turns through llm.
+// 参数：llm 为底层 LLM，opts 为可选配置项。
+// 返回：*SessionManager。
+func NewSessionManager(llm *LLM, opts ...SessionManagerOption) *SessionManager {
+	m := &SessionManager{
+		llm:   llm,
+		store: NewMemorySessionStore(),
+		now:   time.Now,
+		keys:  newSessionLocker(),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// GenerateContent runs one turn of the conversation identified by key.
+// 已有未过期的会话时以 --resume 继续，否则开启新会话；成功后保存 CLI 上报的会话 ID。
+// 参数：ctx 为上下文，key 为会话键，messages 为对话消息，options 为调用参数。
+// 返回：统一的 ContentResponse 与错误。
+func (m *SessionManager) GenerateContent(ctx context.Context, key string, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) { //nolint:lll
+	release, err := m.keys.acquire(ctx, key, m.llm.opts.SessionQueueDepth, m.llm.opts.SessionQueueTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	record, ok, err := m.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 会话相关参数放在最后，覆盖调用方传入的同名设置。
+	// 恢复的会话已包含此前的轮次，HistoryDiff 只发送其中尚未包含的消息。
+	callOptions := append([]llms.CallOption{}, options...)
+	if ok {
+		callOptions = append(callOptions, WithCallOptions(
+			WithSessionID(record.SessionID),
+			WithResume(true),
+			WithForkSession(record.Fork),
+			WithHistoryStrategy(HistoryDiff),
+		))
+	} else {
+		callOptions = append(callOptions, WithCallOptions(WithSessionID(""), WithResume(false), WithForkSession(false)))
+	}
+
+	resp, err := m.llm.GenerateContent(ctx, messages, callOptions...)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionID := responseSessionID(resp)
+	if sessionID == "" {
+		return resp, nil
+	}
+	now := m.now()
+	if !ok || record.SessionID != sessionID {
+		record.CreatedAt = now
+	}
+	record.Key = key
+	record.SessionID = sessionID
+	record.Fork = false
+	record.UpdatedAt = now
+	if err := m.store.Save(ctx, record); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// Call runs a single-prompt turn of the conversation identified by key.
+// 参数：ctx 为上下文，key 为会话键，prompt 为输入文本，options 为调用参数。
+// 返回：模型响应文本与错误。
+func (m *SessionManager) Call(ctx context.Context, key, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m.Model(key), prompt, options...)
+}
+
+// Model returns an llms.Model bound to one conversation key.
+// 参数：key 为会话键。
+// 返回：可用于 langchaingo chain/agent 的 llms.Model。
+func (m *SessionManager) Model(key string) llms.Model {
+	return &conversationModel{manager: m, key: key}
+}
+
+// SessionID returns the stored session ID for key.
+// 参数：ctx 为上下文，key 为会话键。
+// 返回：会话 ID，不存在或已过期时返回 ErrSessionNotFound。
+func (m *SessionManager) SessionID(ctx context.Context, key string) (string, error) {
+	record, ok, err := m.load(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", ErrSessionNotFound
+	}
+	return record.SessionID, nil
+}
+
+// Fork branches the conversation at from into a new key.
+// to 的下一轮以 --fork-session 恢复 from 的会话，之后两者互不影响。
+// 参数：ctx 为上下文，from 为源会话键，to 为新会话键。
+// 返回：源会话不存在时返回 ErrSessionNotFound。
+func (m *SessionManager) Fork(ctx context.Context, from, to string) error {
+	record, ok, err := m.load(ctx, from)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSessionNotFound, from)
+	}
+	now := m.now()
+	return m.store.Save(ctx, SessionRecord{
+		Key:       to,
+		SessionID: record.SessionID,
+		Fork:      true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	})
+}
+
+// Reset forgets the session for key; the next turn starts a new session.
+// 参数：ctx 为上下文，key 为会话键。
+// 返回：存储错误。
+func (m *SessionManager) Reset(ctx context.Context, key string) error {
+	return m.store.Delete(ctx, key)
+}
+
+// load reads a record and drops it when expired.
+func (m *SessionManager) load(ctx context.Context, key string) (SessionRecord, bool, error) {
+	record, ok, err := m.store.Load(ctx, key)
+	if err != nil || !ok {
+		return SessionRecord{}, false, err
+	}
+	if m.ttl > 0 && m.now().Sub(record.UpdatedAt) > m.ttl {
+		if err := m.store.Delete(ctx, key); err != nil {
+			return SessionRecord{}, false, err
+		}
+		return SessionRecord{}, false, nil
+	}
+	return record, true, nil
+}
+
+// responseSessionID returns the session ID reported in GenerationInfo.
+func responseSessionID(resp *llms.ContentResponse) string {
+	if resp == nil || len(resp.Choices) == 0 || resp.Choices[0] == nil {
+		return ""
+	}
+	id, _ := resp.Choices[0].GenerationInfo["SessionID"].(string)
+	return id
+}
+
+// conversationModel adapts a SessionManager key to llms.Model.
+type conversationModel struct {
+	manager *SessionManager
+	key     string
+}
+
+// GenerateContent implements llms.Model.
+func (c *conversationModel) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) { //nolint:lll
+	return c.manager.GenerateContent(ctx, c.key, messages, options...)
+}
+
+// Call implements llms.Model.
+func (c *conversationModel) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, c, prompt, options...)
+}
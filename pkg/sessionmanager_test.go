@@ -0,0 +1,153 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+func TestSessionManagerResumesForksAndResets(t *testing.T) {
+	// 依次对应：新会话、恢复 new-1、分叉 new-1、重置后的新会话。
+	reply := func(id string) []string {
+		return []string{
+			`{"type":"system","subtype":"init","session_id":"` + id + `"}`,
+			`{"type":"result","subtype":"success","session_id":"` + id + `","result":"ok"}`,
+		}
+	}
+	fake := claudetest.New(t).ReplaySequence(reply("new-1"), reply("new-1"), reply("fork-3"), reply("new-4"))
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx := context.Background()
+	manager := NewSessionManager(llm)
+
+	if _, err := manager.SessionID(ctx, "chat-1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	if _, err := manager.Call(ctx, "chat-1", "你好"); err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+	if id, _ := manager.SessionID(ctx, "chat-1"); id != "new-1" {
+		t.Fatalf("unexpected captured id: %q", id)
+	}
+	if inv := fake.LastInvocation(); inv.HasFlag("--resume") {
+		t.Fatalf("first turn should not resume: %q", inv.Args)
+	}
+
+	if _, err := manager.Call(ctx, "chat-1", "继续"); err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+	if inv := fake.LastInvocation(); inv.Flag("--resume") != "new-1" || inv.HasFlag("--fork-session") {
+		t.Fatalf("second turn should resume: %q", inv.Args)
+	}
+
+	if err := manager.Fork(ctx, "chat-1", "chat-2"); err != nil {
+		t.Fatalf("Fork: %v", err)
+	}
+	if _, err := manager.Call(ctx, "chat-2", "分支"); err != nil {
+		t.Fatalf("fork turn: %v", err)
+	}
+	if inv := fake.LastInvocation(); inv.Flag("--resume") != "new-1" || !inv.HasFlag("--fork-session") {
+		t.Fatalf("fork turn should fork: %q", inv.Args)
+	}
+	if id, _ := manager.SessionID(ctx, "chat-2"); id != "fork-3" {
+		t.Fatalf("unexpected forked id: %q", id)
+	}
+	if id, _ := manager.SessionID(ctx, "chat-1"); id != "new-1" {
+		t.Fatalf("fork changed source session: %q", id)
+	}
+
+	if err := manager.Reset(ctx, "chat-1"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if _, err := manager.Call(ctx, "chat-1", "重新开始"); err != nil {
+		t.Fatalf("turn after reset: %v", err)
+	}
+	if id, _ := manager.SessionID(ctx, "chat-1"); id != "new-4" {
+		t.Fatalf("unexpected id after reset: %q", id)
+	}
+	if inv := fake.LastInvocation(); inv.HasFlag("--resume") {
+		t.Fatalf("turn after reset should not resume: %q", inv.Args)
+	}
+}
+
+func TestSessionManagerSendsOnlyNewMessagesOnResume(t *testing.T) {
+	reply := []string{
+		`{"type":"system","subtype":"init","session_id":"sess-1"}`,
+		`{"type":"result","subtype":"success","session_id":"sess-1","result":"你好，我是助手"}`,
+	}
+	fake := claudetest.New(t).ReplaySequence(reply, reply)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx := context.Background()
+	manager := NewSessionManager(llm)
+
+	history := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "第一轮问题")}
+	resp, err := manager.GenerateContent(ctx, "chat-1", history)
+	if err != nil {
+		t.Fatalf("first turn: %v", err)
+	}
+	history = append(history,
+		llms.TextParts(llms.ChatMessageTypeAI, resp.Choices[0].Content),
+		llms.TextParts(llms.ChatMessageTypeHuman, "第二轮问题"),
+	)
+	if _, err := manager.GenerateContent(ctx, "chat-1", history); err != nil {
+		t.Fatalf("second turn: %v", err)
+	}
+
+	inv := fake.LastInvocation()
+	if inv.Flag("--resume") != "sess-1" {
+		t.Fatalf("second turn should resume: %q", inv.Args)
+	}
+	if got := inv.Stdin; got != "第二轮问题" {
+		t.Fatalf("second turn should only send the new message, got stdin %q", got)
+	}
+}
+
+func TestSessionManagerExpiresIdleSessions(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemorySessionStore()
+	manager := NewSessionManager(nil, WithSessionStore(store), WithSessionTTL(time.Hour))
+	manager.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if err := store.Save(ctx, SessionRecord{Key: "chat-1", SessionID: "sess-1", UpdatedAt: now.Add(-2 * time.Hour)}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := manager.SessionID(ctx, "chat-1"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected expired session, got %v", err)
+	}
+	if _, ok, _ := store.Load(ctx, "chat-1"); ok {
+		t.Fatalf("expired record not deleted")
+	}
+}
+
+func TestFileSessionStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	ctx := context.Background()
+	record := SessionRecord{Key: "chat-1", SessionID: "sess-1", CreatedAt: time.Unix(1, 0).UTC(), UpdatedAt: time.Unix(2, 0).UTC()}
+	if err := NewFileSessionStore(path).Save(ctx, record); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	reopened := NewFileSessionStore(path)
+	got, ok, err := reopened.Load(ctx, "chat-1")
+	if err != nil || !ok || got != record {
+		t.Fatalf("unexpected record: %+v %v %v", got, ok, err)
+	}
+	if err := reopened.Delete(ctx, "chat-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, ok, _ := NewFileSessionStore(path).Load(ctx, "chat-1"); ok {
+		t.Fatalf("record not deleted")
+	}
+}
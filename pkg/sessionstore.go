@@ -0,0 +1,162 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SessionRecord 记录一个会话键（如聊天 ID）对应的 Claude 会话。
+type SessionRecord struct {
+	// Key 为调用方的会话键。
+	Key string `json:"key"`
+	// SessionID 为 CLI 上报的会话 ID。
+	SessionID string `json:"session_id"`
+	// Fork 表示下一轮以 --fork-session 从 SessionID 分叉出新会话。
+	Fork bool `json:"fork,omitempty"`
+	// CreatedAt 为记录创建时间。
+	CreatedAt time.Time `json:"created_at"`
+	// UpdatedAt 为最近一次对话时间，用于过期判断。
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SessionStore 持久化会话键到 Claude 会话的映射，实现需并发安全。
+type SessionStore interface {
+	// Load 读取记录，不存在时返回 false。
+	Load(ctx context.Context, key string) (SessionRecord, bool, error)
+	// Save 写入或覆盖记录。
+	Save(ctx context.Context, record SessionRecord) error
+	// Delete 删除记录，不存在时不报错。
+	Delete(ctx context.Context, key string) error
+}
+
+// MemorySessionStore 为进程内的 SessionStore 实现。
+type MemorySessionStore struct {
+	mu      sync.Mutex
+	records map[string]SessionRecord
+}
+
+// NewMemorySessionStore creates an empty in-memory store.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{records: make(map[string]SessionRecord)}
+}
+
+// Load implements SessionStore.
+func (s *MemorySessionStore) Load(_ context.Context, key string) (SessionRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.records[key]
+	return record, ok, nil
+}
+
+// Save implements SessionStore.
+func (s *MemorySessionStore) Save(_ context.Context, record SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.Key] = record
+	return nil
+}
+
+// Delete implements SessionStore.
+func (s *MemorySessionStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+// FileSessionStore 将全部记录保存在一个 JSON 文件中，适合单进程部署。
+type FileSessionStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileSessionStore creates a store backed by the JSON file at path.
+// 参数：path 为文件路径，不存在时在首次 Save 时创建。
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{path: path}
+}
+
+// Load implements SessionStore.
+func (s *FileSessionStore) Load(_ context.Context, key string) (SessionRecord, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.read()
+	if err != nil {
+		return SessionRecord{}, false, err
+	}
+	record, ok := records[key]
+	return record, ok, nil
+}
+
+// Save implements SessionStore.
+func (s *FileSessionStore) Save(_ context.Context, record SessionRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+	records[record.Key] = record
+	return s.write(records)
+}
+
+// Delete implements SessionStore.
+func (s *FileSessionStore) Delete(_ context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := records[key]; !ok {
+		return nil
+	}
+	delete(records, key)
+	return s.write(records)
+}
+
+// read loads all records; a missing file is an empty store.
+func (s *FileSessionStore) read() (map[string]SessionRecord, error) {
+	records := make(map[string]SessionRecord)
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("claude code: read session store: %w", err)
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("claude code: decode session store: %w", err)
+	}
+	return records, nil
+}
+
+// write replaces the file atomically via a temp file and rename.
+func (s *FileSessionStore) write(records map[string]SessionRecord) error {
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return fmt.Errorf("claude code: encode session store: %w", err)
+	}
+	file, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("claude code: write session store: %w", err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		_ = file.Close()
+		return fmt.Errorf("claude code: write session store: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("claude code: write session store: %w", err)
+	}
+	if err := os.Rename(file.Name(), s.path); err != nil {
+		return fmt.Errorf("claude code: write session store: %w", err)
+	}
+	return nil
+}
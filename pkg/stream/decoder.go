@@ -0,0 +1,98 @@
+package stream
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxLineSize is the default maximum size of a single stream-json line.
+const DefaultMaxLineSize = 1024 * 1024
+
+// Decoder reads stream-json lines from an io.Reader and yields typed events.
+type Decoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewDecoder returns a decoder reading from r.
+// 参数：r 为 CLI 标准输出或录制的 stream-json 文件。
+// 返回：*Decoder。
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), DefaultMaxLineSize)
+	return &Decoder{scanner: scanner}
+}
+
+// SetMaxLineSize sets the maximum line size. It must be called before the first Decode.
+// 参数：size 为字节数，非正数时忽略。
+func (d *Decoder) SetMaxLineSize(size int) {
+	if size > 0 {
+		d.scanner.Buffer(make([]byte, 0, min(size, 64*1024)), size)
+	}
+}
+
+// Decode returns the next event, skipping blank lines. It returns io.EOF when
+// the input is exhausted.
+// 返回：事件与错误。
+func (d *Decoder) Decode() (Event, error) {
+	for d.scanner.Scan() {
+		d.line++
+		line := bytes.TrimSpace(d.scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		event, err := Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("stream: line %d: %w", d.line, err)
+		}
+		return event, nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return nil, fmt.Errorf("stream: read: %w", err)
+	}
+	return nil, io.EOF
+}
+
+// Parse decodes a single stream-json line.
+// 参数：line 为一行 JSON。
+// 返回：具体类型的事件与错误。
+func Parse(line []byte) (Event, error) {
+	raw := make(json.RawMessage, len(line))
+	copy(raw, line)
+
+	var header Header
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+
+	var event Event
+	switch header.Type {
+	case TypeSystem:
+		event = &SystemEvent{}
+	case TypeAssistant:
+		event = &AssistantEvent{}
+	case TypeUser:
+		event = &UserEvent{}
+	case TypeResult:
+		event = &ResultEvent{}
+	case TypeStreamEvent:
+		event = &StreamEvent{}
+	case TypeControlRequest:
+		event = &ControlRequestEvent{}
+	case TypeControlResponse:
+		event = &ControlResponseEvent{}
+	case TypeToolResult:
+		event = &ToolResultEvent{}
+	default:
+		header.setRaw(raw)
+		return &UnknownEvent{Header: header}, nil
+	}
+	if err := json.Unmarshal(raw, event); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", header.Type, err)
+	}
+	event.(interface{ setRaw(json.RawMessage) }).setRaw(raw)
+	return event, nil
+}
@@ -0,0 +1,116 @@
+package stream
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+const transcript = `{"type":"system","subtype":"init","cwd":"/work","session_id":"sess-1","tools":["Bash","Read"],"mcp_servers":[{"name":"langchaingo","status":"connected"}],"model":"claude-sonnet-4-5","permissionMode":"bypassPermissions"}
+
+{"type":"stream_event","event":{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"你"}},"session_id":"sess-1","parent_tool_use_id":null}
+{"type":"assistant","message":{"id":"msg_1","role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"Bash","input":{"command":"ls"}}]},"parent_tool_use_id":null,"session_id":"sess-1"}
+{"type":"user","message":{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"a.txt"},{"type":"text","text":"b.txt"}],"is_error":false}]},"session_id":"sess-1"}
+{"type":"assistant","message":{"id":"msg_2","content":"完成"},"session_id":"sess-1"}
+{"type":"result","subtype":"success","is_error":false,"duration_ms":1200,"duration_api_ms":900,"num_turns":2,"result":"完成","session_id":"sess-1","total_cost_usd":0.01,"usage":{"input_tokens":10,"output_tokens":5,"cache_read_input_tokens":3},"modelUsage":{"claude-sonnet-4-5":{"inputTokens":10,"outputTokens":5,"costUSD":0.01}}}
+{"type":"control_request","request_id":"req_1","request":{"subtype":"can_use_tool","tool_name":"Bash"}}
+{"type":"future_type","foo":1}
+`
+
+func TestDecoderTypedEvents(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(transcript))
+	var events []Event
+	for {
+		event, err := dec.Decode()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		events = append(events, event)
+	}
+	if len(events) != 8 {
+		t.Fatalf("unexpected event count: %d", len(events))
+	}
+
+	system := events[0].(*SystemEvent)
+	if system.Subtype != "init" || system.SessionID != "sess-1" || system.CWD != "/work" || len(system.Tools) != 2 {
+		t.Fatalf("unexpected system event: %+v", system)
+	}
+	if system.MCPServers[0].Name != "langchaingo" || system.MCPServers[0].Status != "connected" {
+		t.Fatalf("unexpected mcp servers: %+v", system.MCPServers)
+	}
+
+	partial := events[1].(*StreamEvent)
+	if partial.Event.Type != "content_block_delta" || partial.Event.Delta.Text != "你" || partial.ParentToolUseID != nil {
+		t.Fatalf("unexpected stream event: %+v", partial)
+	}
+
+	toolUse := events[2].(*AssistantEvent).Message.Content[0]
+	if toolUse.Type != "tool_use" || toolUse.Name != "Bash" || string(toolUse.Input) != `{"command":"ls"}` {
+		t.Fatalf("unexpected tool_use block: %+v", toolUse)
+	}
+
+	toolResult := events[3].(*UserEvent).Message.Content[0]
+	if toolResult.ToolUseID != "toolu_1" || toolResult.ResultText() != "a.txt\nb.txt" {
+		t.Fatalf("unexpected tool_result block: %+v", toolResult)
+	}
+
+	text := events[4].(*AssistantEvent).Message.Content
+	if len(text) != 1 || text[0].Type != "text" || text[0].Text != "完成" {
+		t.Fatalf("string content not normalized: %+v", text)
+	}
+
+	result := events[5].(*ResultEvent)
+	if result.NumTurns != 2 || result.DurationMS != 1200 || result.Usage.CacheReadInputTokens != 3 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if result.ModelUsage["claude-sonnet-4-5"].OutputTokens != 5 {
+		t.Fatalf("unexpected model usage: %+v", result.ModelUsage)
+	}
+
+	control := events[6].(*ControlRequestEvent)
+	if control.RequestID != "req_1" || control.RequestSubtype() != "can_use_tool" {
+		t.Fatalf("unexpected control request: %+v", control)
+	}
+
+	unknown := events[7].(*UnknownEvent)
+	if unknown.EventType() != "future_type" || !strings.Contains(string(unknown.Raw()), `"foo":1`) {
+		t.Fatalf("unexpected unknown event: %+v", unknown)
+	}
+}
+
+func TestDecoderReportsLineNumber(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("{\"type\":\"system\"}\nnot json\n"))
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("first Decode: %v", err)
+	}
+	_, err := dec.Decode()
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected line number in error, got %v", err)
+	}
+}
+
+func TestParseToolResultStringContent(t *testing.T) {
+	event, err := Parse([]byte(`{"type":"user","message":{"content":[{"type":"tool_result","tool_use_id":"t","content":"ok","is_error":true}]}}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	block := event.(*UserEvent).Message.Content[0]
+	if !block.IsError || block.ResultText() != "ok" {
+		t.Fatalf("unexpected block: %+v", block)
+	}
+}
+
+func TestParseLegacyToolResult(t *testing.T) {
+	event, err := Parse([]byte(`{"type":"tool_result","tool_use_id":"t","content":[{"type":"text","text":"ok"}]}`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	block := event.(*ToolResultEvent).Block()
+	if block.ToolUseID != "t" || block.ResultText() != "ok" || block.IsError {
+		t.Fatalf("unexpected block: %+v", block)
+	}
+}
@@ -0,0 +1,304 @@
+// Package stream decodes the Claude Code CLI stream-json protocol
+// (--output-format stream-json) into typed Go events.
+package stream
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Message types reported in the top-level "type" field.
+const (
+	TypeSystem          = "system"
+	TypeAssistant       = "assistant"
+	TypeUser            = "user"
+	TypeResult          = "result"
+	TypeStreamEvent     = "stream_event"
+	TypeControlRequest  = "control_request"
+	TypeControlResponse = "control_response"
+	// TypeToolResult 为旧版 CLI 输出的顶层 tool_result 消息。
+	TypeToolResult = "tool_result"
+)
+
+// Event is a single decoded stream-json line. The concrete type is one of
+// *SystemEvent, *AssistantEvent, *UserEvent, *ResultEvent, *StreamEvent,
+// *ControlRequestEvent, *ControlResponseEvent, *ToolResultEvent or *UnknownEvent.
+type Event interface {
+	// EventType returns the top-level "type" field.
+	EventType() string
+	// Raw returns the original JSON line.
+	Raw() json.RawMessage
+	// EventHeader returns the fields shared by every message (type, subtype, session_id).
+	EventHeader() *Header
+}
+
+// Header holds the fields shared by every stream-json message.
+type Header struct {
+	Type      string `json:"type"`
+	Subtype   string `json:"subtype,omitempty"`
+	UUID      string `json:"uuid,omitempty"`
+	SessionID string `json:"session_id,omitempty"`
+
+	raw json.RawMessage
+}
+
+// EventType returns the top-level "type" field.
+func (h *Header) EventType() string { return h.Type }
+
+// Raw returns the original JSON line.
+func (h *Header) Raw() json.RawMessage { return h.raw }
+
+// EventHeader returns the shared header fields.
+func (h *Header) EventHeader() *Header { return h }
+
+// setRaw stores the original JSON line; used by Parse.
+func (h *Header) setRaw(raw json.RawMessage) { h.raw = raw }
+
+// MCPServerStatus is the connection status of one MCP server in system/init.
+type MCPServerStatus struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// SystemEvent is a "system" message; subtype "init" describes the CLI session.
+type SystemEvent struct {
+	Header
+	CWD               string            `json:"cwd,omitempty"`
+	Model             string            `json:"model,omitempty"`
+	PermissionMode    string            `json:"permissionMode,omitempty"`
+	APIKeySource      string            `json:"apiKeySource,omitempty"`
+	ClaudeCodeVersion string            `json:"claude_code_version,omitempty"`
+	OutputStyle       string            `json:"output_style,omitempty"`
+	Tools             []string          `json:"tools,omitempty"`
+	MCPServers        []MCPServerStatus `json:"mcp_servers,omitempty"`
+	SlashCommands     []string          `json:"slash_commands,omitempty"`
+	Agents            []string          `json:"agents,omitempty"`
+}
+
+// AssistantEvent is an "assistant" message emitted for each model content block.
+type AssistantEvent struct {
+	Header
+	Message         Message `json:"message"`
+	ParentToolUseID *string `json:"parent_tool_use_id,omitempty"`
+	// Error 为 API 调用失败时 CLI 附带的错误类别（如 rate_limit、authentication_failed）。
+	Error string `json:"error,omitempty"`
+}
+
+// UserEvent is a "user" message; the CLI uses it to report tool results.
+type UserEvent struct {
+	Header
+	Message         Message         `json:"message"`
+	ParentToolUseID *string         `json:"parent_tool_use_id,omitempty"`
+	ToolUseResult   json.RawMessage `json:"tool_use_result,omitempty"`
+}
+
+// ToolResultEvent is a top-level "tool_result" message emitted by older CLI versions;
+// current versions report tool results as tool_result blocks in UserEvent.
+type ToolResultEvent struct {
+	Header
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// Block returns the message as a tool_result content block.
+func (e *ToolResultEvent) Block() ContentBlock {
+	return ContentBlock{Type: TypeToolResult, ToolUseID: e.ToolUseID, Content: e.Content, IsError: e.IsError}
+}
+
+// ResultEvent is the final "result" message of a turn.
+type ResultEvent struct {
+	Header
+	IsError           bool                  `json:"is_error"`
+	DurationMS        int64                 `json:"duration_ms"`
+	DurationAPIMS     int64                 `json:"duration_api_ms"`
+	NumTurns          int                   `json:"num_turns"`
+	Result            string                `json:"result,omitempty"`
+	TotalCostUSD      float64               `json:"total_cost_usd"`
+	Usage             *Usage                `json:"usage,omitempty"`
+	ModelUsage        map[string]ModelUsage `json:"modelUsage,omitempty"`
+	PermissionDenials []PermissionDenial    `json:"permission_denials,omitempty"`
+	StructuredOutput  json.RawMessage       `json:"structured_output,omitempty"`
+	Errors            []string              `json:"errors,omitempty"`
+}
+
+// PermissionDenial records a tool call rejected by the permission system.
+type PermissionDenial struct {
+	ToolName  string          `json:"tool_name"`
+	ToolUseID string          `json:"tool_use_id"`
+	ToolInput json.RawMessage `json:"tool_input,omitempty"`
+}
+
+// StreamEvent wraps a raw Anthropic streaming event (--include-partial-messages).
+type StreamEvent struct {
+	Header
+	Event           PartialEvent `json:"event"`
+	ParentToolUseID *string      `json:"parent_tool_use_id,omitempty"`
+}
+
+// PartialEvent is an Anthropic Messages streaming event such as
+// message_start, content_block_start, content_block_delta or message_delta.
+type PartialEvent struct {
+	Type         string        `json:"type"`
+	Index        int           `json:"index"`
+	Message      *Message      `json:"message,omitempty"`
+	ContentBlock *ContentBlock `json:"content_block,omitempty"`
+	Delta        *Delta        `json:"delta,omitempty"`
+	Usage        *Usage        `json:"usage,omitempty"`
+}
+
+// Delta is the incremental payload of content_block_delta and message_delta events.
+type Delta struct {
+	Type        string `json:"type,omitempty"`
+	Text        string `json:"text,omitempty"`
+	Thinking    string `json:"thinking,omitempty"`
+	PartialJSON string `json:"partial_json,omitempty"`
+	Signature   string `json:"signature,omitempty"`
+	StopReason  string `json:"stop_reason,omitempty"`
+}
+
+// ControlRequestEvent is a "control_request" sent by the CLI (e.g. can_use_tool).
+type ControlRequestEvent struct {
+	Header
+	RequestID string          `json:"request_id"`
+	Request   json.RawMessage `json:"request"`
+}
+
+// RequestSubtype returns request.subtype of the control request.
+func (e *ControlRequestEvent) RequestSubtype() string {
+	var req struct {
+		Subtype string `json:"subtype"`
+	}
+	_ = json.Unmarshal(e.Request, &req)
+	return req.Subtype
+}
+
+// ControlResponseEvent is a "control_response" acknowledging a control request.
+type ControlResponseEvent struct {
+	Header
+	Response ControlResponse `json:"response"`
+}
+
+// ControlResponse is the body of a control_response message.
+type ControlResponse struct {
+	Subtype   string          `json:"subtype"`
+	RequestID string          `json:"request_id"`
+	Error     string          `json:"error,omitempty"`
+	Response  json.RawMessage `json:"response,omitempty"`
+}
+
+// UnknownEvent is any message whose type is not modelled by this package.
+// Lines without a "type" field (CLI error objects) also decode to UnknownEvent.
+type UnknownEvent struct {
+	Header
+}
+
+// Message is an Anthropic API message carried by assistant and user events.
+type Message struct {
+	ID         string  `json:"id,omitempty"`
+	Type       string  `json:"type,omitempty"`
+	Role       string  `json:"role,omitempty"`
+	Model      string  `json:"model,omitempty"`
+	Content    Content `json:"content"`
+	StopReason string  `json:"stop_reason,omitempty"`
+	Usage      *Usage  `json:"usage,omitempty"`
+}
+
+// Content is a list of content blocks. A plain JSON string decodes to a single text block.
+type Content []ContentBlock
+
+// UnmarshalJSON accepts both a string and an array of content blocks.
+func (c *Content) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		if text == "" {
+			*c = nil
+			return nil
+		}
+		*c = Content{{Type: "text", Text: text}}
+		return nil
+	}
+	var blocks []ContentBlock
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// ContentBlock is one text, thinking, tool_use, tool_result or image block.
+type ContentBlock struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	Thinking  string `json:"thinking,omitempty"`
+	Signature string `json:"signature,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+
+	// image / document
+	Source *Source `json:"source,omitempty"`
+}
+
+// ResultBlocks decodes the content of a tool_result block into blocks.
+// 字符串内容会被转换为单个 text block。
+func (b ContentBlock) ResultBlocks() (Content, error) {
+	if len(b.Content) == 0 {
+		return nil, nil
+	}
+	var content Content
+	if err := json.Unmarshal(b.Content, &content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// ResultText returns the concatenated text of a tool_result block.
+func (b ContentBlock) ResultText() string {
+	blocks, err := b.ResultBlocks()
+	if err != nil {
+		return string(b.Content)
+	}
+	texts := make([]string, 0, len(blocks))
+	for _, block := range blocks {
+		if block.Type == "text" {
+			texts = append(texts, block.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+// Source is the source of an image or document block.
+type Source struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	URL       string `json:"url,omitempty"`
+}
+
+// Usage is the token usage reported by the API.
+type Usage struct {
+	InputTokens              int    `json:"input_tokens"`
+	OutputTokens             int    `json:"output_tokens"`
+	CacheCreationInputTokens int    `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int    `json:"cache_read_input_tokens"`
+	ServiceTier              string `json:"service_tier,omitempty"`
+}
+
+// ModelUsage is the per-model usage summary in result.modelUsage.
+type ModelUsage struct {
+	InputTokens              int     `json:"inputTokens"`
+	OutputTokens             int     `json:"outputTokens"`
+	CacheReadInputTokens     int     `json:"cacheReadInputTokens"`
+	CacheCreationInputTokens int     `json:"cacheCreationInputTokens"`
+	WebSearchRequests        int     `json:"webSearchRequests"`
+	CostUSD                  float64 `json:"costUSD"`
+	ContextWindow            int     `json:"contextWindow,omitempty"`
+}
@@ -0,0 +1,158 @@
+package claudecode
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ErrNoJSONSchema is returned by GenerateJSON when no schema is configured.
+var ErrNoJSONSchema = errors.New("claude code: json schema is required")
+
+// StructuredOutput extracts the validated structured output from a response returned by this package.
+// 参数：resp 为配置了 JSONSchema 的 GenerateContent 返回值。
+// 返回：解码后的 JSON 值与是否存在。
+func StructuredOutput(resp *llms.ContentResponse) (any, bool) {
+	if resp == nil || len(resp.Choices) == 0 || resp.Choices[0] == nil {
+		return nil, false
+	}
+	v, ok := resp.Choices[0].GenerationInfo["StructuredOutput"]
+	return v, ok
+}
+
+// applyStructuredOutput validates the structured output and stores it on the choice.
+// CLI 未返回 structured_output 时（旧版本）退回解析最终回复文本。
+// 校验通过后 Content 替换为输出的 JSON 文本，便于 Call 直接使用。
+// 参数：choice 为本轮结果，schema 为解码后的 JSON Schema。
+// 返回：输出缺失、不是 JSON 或未通过校验时返回 *SchemaError。
+func applyStructuredOutput(choice *llms.ContentChoice, schema map[string]any) error {
+	output, ok := choice.GenerationInfo["StructuredOutput"]
+	if !ok || output == nil {
+		// result 为最终回复文本，不含 OutputModeFull 等模式追加的工具轨迹。
+		text, _ := choice.GenerationInfo["Result"].(string)
+		if strings.TrimSpace(text) == "" {
+			text = choice.Content
+		}
+		if err := json.Unmarshal([]byte(stripCodeFence(text)), &output); err != nil {
+			return &SchemaError{Errors: []string{"output is not valid JSON: " + err.Error()}, Output: text}
+		}
+	}
+	data, err := json.Marshal(output)
+	if err != nil {
+		return fmt.Errorf("claude code: encode structured output: %w", err)
+	}
+	if errs := validateJSONSchema(schema, output); len(errs) > 0 {
+		return &SchemaError{Errors: errs, Output: string(data)}
+	}
+	if choice.GenerationInfo == nil {
+		choice.GenerationInfo = make(map[string]any)
+	}
+	choice.GenerationInfo["StructuredOutput"] = output
+	choice.Content = string(data)
+	return nil
+}
+
+// stripCodeFence removes a surrounding Markdown code fence.
+func stripCodeFence(text string) string {
+	text = strings.TrimSpace(text)
+	body, ok := strings.CutPrefix(text, "```")
+	if !ok {
+		return text
+	}
+	// 去掉语言标记所在的第一行。
+	if i := strings.IndexByte(body, '\n'); i >= 0 {
+		body = body[i+1:]
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(body), "```"))
+}
+
+// GenerateJSON requests structured output and unmarshals it into T.
+// 输出未通过 JSON Schema 校验或无法解码为 T 时，把错误反馈给模型并重试，
+// 次数由 Options.StructuredOutputRetries 控制。重试恢复上一次尝试所在的会话，只发送反馈；
+// CLI 未上报会话 ID 时改为连同完整历史重新发送。
+// 参数：ctx 为上下文，l 为已配置 JSONSchema 的 LLM（也可经 WithCallOptions(WithJSONSchema(...)) 按次指定），
+// messages 为对话消息，options 为调用参数。
+// 返回：解码后的 T 与错误，重试用尽时返回最后一次的错误。
+func GenerateJSON[T any](ctx context.Context, l *LLM, messages []llms.MessageContent, options ...llms.CallOption) (T, error) {
+	var zero T
+	if l == nil {
+		return zero, errors.New("claude code: nil receiver")
+	}
+	callOpts := llms.CallOptions{}
+	for _, opt := range options {
+		opt(&callOpts)
+	}
+	resolved, err := l.withCallOptions(callOpts)
+	if err != nil {
+		return zero, err
+	}
+	if resolved.opts.JSONSchema == nil {
+		return zero, ErrNoJSONSchema
+	}
+
+	messages = append([]llms.MessageContent{}, messages...)
+	attemptOptions := options
+	var lastErr error
+	for attempt := 0; attempt <= max(resolved.opts.StructuredOutputRetries, 0); attempt++ {
+		resp, err := l.GenerateContent(ctx, messages, attemptOptions...)
+		var (
+			schemaErr *SchemaError
+			sessionID string
+		)
+		switch {
+		case errors.As(err, &schemaErr):
+			sessionID = schemaErr.SessionID
+		case err != nil:
+			return zero, err
+		default:
+			output := resp.Choices[0].Content
+			var result T
+			decodeErr := json.Unmarshal([]byte(output), &result)
+			if decodeErr == nil {
+				return result, nil
+			}
+			sessionID, _ = resp.Choices[0].GenerationInfo["SessionID"].(string)
+			schemaErr = &SchemaError{Errors: []string{"cannot decode output: " + decodeErr.Error()}, Output: output, SessionID: sessionID}
+		}
+		lastErr = schemaErr
+
+		if sessionID == "" && resolved.opts.SessionID != "" && !resolved.opts.Resume {
+			// 以 WithSessionID 新建的会话即使未上报 ID 也已存在，重试不能再次使用 --session-id。
+			sessionID = resolved.opts.SessionID
+		}
+		feedback := llms.TextParts(llms.ChatMessageTypeHuman, structuredOutputFeedback(schemaErr))
+		if sessionID == "" {
+			// CLI 未上报会话时无法恢复，把无效输出与错误作为新的一轮连同历史重新发送。
+			messages = append(messages, llms.TextParts(llms.ChatMessageTypeAI, schemaErr.Output), feedback)
+			continue
+		}
+		// 恢复上一次尝试所在的会话（其中已包含无效输出），只发送反馈这一轮；
+		// 会话参数放在最后，覆盖调用方的 WithSessionID / WithResume / WithForkSession。
+		messages = []llms.MessageContent{feedback}
+		attemptOptions = append(slices.Clip(options), WithCallOptions(
+			WithSessionID(sessionID),
+			WithResume(true),
+			WithForkSession(false),
+			WithHistoryStrategy(HistoryLastTurn),
+		))
+	}
+	return zero, lastErr
+}
+
+// structuredOutputFeedback describes validation errors to the model.
+func structuredOutputFeedback(err *SchemaError) string {
+	var b strings.Builder
+	b.WriteString("Your previous response did not match the required JSON schema:\n")
+	for _, e := range err.Errors {
+		b.WriteString("- ")
+		b.WriteString(e)
+		b.WriteString("\n")
+	}
+	b.WriteString("Respond again with corrected JSON only.")
+	return b.String()
+}
@@ -0,0 +1,188 @@
+package claudecode
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/claudetest"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// ticketSchema 为分诊机器人使用的工单 schema。
+const ticketSchema = `{
+  "type": "object",
+  "properties": {
+    "title": {"type": "string", "minLength": 1},
+    "priority": {"enum": ["low", "medium", "high"]},
+    "labels": {"type": "array", "items": {"$ref": "#/$defs/label"}, "maxItems": 3}
+  },
+  "required": ["title", "priority"],
+  "additionalProperties": false,
+  "$defs": {"label": {"type": "string", "pattern": "^[a-z-]+$"}}
+}`
+
+type ticket struct {
+	Title    string   `json:"title"`
+	Priority string   `json:"priority"`
+	Labels   []string `json:"labels"`
+}
+
+func TestValidateJSONSchema(t *testing.T) {
+	schema, _, err := encodeJSONSchema(ticketSchema)
+	if err != nil {
+		t.Fatalf("encodeJSONSchema: %v", err)
+	}
+	cases := []struct {
+		value any
+		want  []string
+	}{
+		{map[string]any{"title": "登录失败", "priority": "high", "labels": []any{"auth"}}, nil},
+		{map[string]any{"title": "", "priority": "urgent"}, []string{
+			`$.priority: value must be one of ["low","medium","high"]`,
+			"$.title: string shorter than 1",
+		}},
+		{map[string]any{"priority": "low", "extra": true}, []string{
+			`$: missing required property "title"`,
+			"$.extra: additional property is not allowed",
+		}},
+		{map[string]any{"title": "x", "priority": "low", "labels": []any{"Bug", 1.0}}, []string{
+			`$.labels[0]: string does not match pattern "^[a-z-]+$"`,
+			"$.labels[1]: expected string, got integer",
+		}},
+		{[]any{}, []string{"$: expected object, got array"}},
+	}
+	for _, tc := range cases {
+		got := validateJSONSchema(schema, tc.value)
+		if strings.Join(got, "\n") != strings.Join(tc.want, "\n") {
+			t.Errorf("validate %v:\ngot  %q\nwant %q", tc.value, got, tc.want)
+		}
+	}
+
+	combinators := map[string]any{
+		"oneOf": []any{
+			map[string]any{"type": "integer", "minimum": 0.0},
+			map[string]any{"type": "string"},
+		},
+		"not": map[string]any{"const": 7.0},
+	}
+	if errs := validateJSONSchema(combinators, 3.0); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if errs := validateJSONSchema(combinators, 7.0); len(errs) != 1 {
+		t.Fatalf("expected not violation, got %v", errs)
+	}
+	if errs := validateJSONSchema(combinators, 1.5); len(errs) != 1 {
+		t.Fatalf("expected oneOf violation, got %v", errs)
+	}
+}
+
+func TestGenerateContentStructuredOutput(t *testing.T) {
+	fake := claudetest.New(t).ReplaySequence(
+		[]string{`{"type":"result","subtype":"success","result":"已分诊","structured_output":{"title":"登录失败","priority":"high"}}`},
+		[]string{`{"type":"result","subtype":"success","result":"已分诊","structured_output":{"title":"登录失败","priority":"urgent"}}`},
+	)
+	llm, err := New(WithCLIPath(fake.Path), WithJSONSchema(ticketSchema))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx := context.Background()
+	resp, err := llm.GenerateContent(ctx, []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "无法登录")})
+	if err != nil {
+		t.Fatalf("GenerateContent: %v", err)
+	}
+	if got := resp.Choices[0].Content; got != `{"priority":"high","title":"登录失败"}` {
+		t.Fatalf("unexpected content: %q", got)
+	}
+	if out, ok := StructuredOutput(resp); !ok || out.(map[string]any)["priority"] != "high" {
+		t.Fatalf("unexpected structured output: %v", out)
+	}
+	if schema := fake.LastInvocation().Flag("--json-schema"); !strings.HasPrefix(schema, `{"$defs":`) {
+		t.Fatalf("missing --json-schema: %q", fake.LastInvocation().Args)
+	}
+
+	_, err = llm.Call(ctx, "无法登录")
+	var schemaErr *SchemaError
+	if !errors.Is(err, ErrSchemaValidation) || !errors.As(err, &schemaErr) || !strings.Contains(schemaErr.Output, "urgent") {
+		t.Fatalf("expected SchemaError, got %v", err)
+	}
+}
+
+func TestGenerateJSONRetriesInvalidOutput(t *testing.T) {
+	fake := claudetest.New(t).ReplaySequence(
+		[]string{`{"type":"result","subtype":"success","result":"{\"title\":\"登录失败\",\"priority\":\"P0\"}"}`},
+		[]string{"{\"type\":\"result\",\"subtype\":\"success\",\"result\":\"```json\\n{\\\"title\\\":\\\"登录失败\\\",\\\"priority\\\":\\\"high\\\",\\\"labels\\\":[\\\"auth\\\"]}\\n```\"}"},
+	)
+	llm, err := New(WithCLIPath(fake.Path))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx := context.Background()
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "无法登录")}
+
+	if _, err := GenerateJSON[ticket](ctx, llm, messages); !errors.Is(err, ErrNoJSONSchema) {
+		t.Fatalf("expected ErrNoJSONSchema, got %v", err)
+	}
+
+	got, err := GenerateJSON[ticket](ctx, llm, messages, WithCallOptions(WithJSONSchema(ticketSchema)))
+	if err != nil {
+		t.Fatalf("GenerateJSON: %v", err)
+	}
+	if got.Title != "登录失败" || got.Priority != "high" || len(got.Labels) != 1 {
+		t.Fatalf("unexpected ticket: %+v", got)
+	}
+	retry := fake.LastInvocation().Prompt()
+	if !strings.Contains(retry, "did not match the required JSON schema") || !strings.Contains(retry, "$.priority") {
+		t.Fatalf("retry prompt missing feedback: %s", retry)
+	}
+
+	_, err = GenerateJSON[ticket](ctx, llm, messages,
+		WithCallOptions(WithJSONSchema(ticketSchema), WithStructuredOutputRetries(0)))
+	if err == nil {
+		t.Fatalf("expected error once outputs are exhausted")
+	}
+}
+
+func TestGenerateJSONRetryResumesPreviousAttempt(t *testing.T) {
+	fake := claudetest.New(t).ReplaySequence(
+		[]string{
+			`{"type":"system","subtype":"init","session_id":"attempt-1"}`,
+			`{"type":"result","subtype":"success","session_id":"attempt-1","result":"{\"title\":\"登录失败\",\"priority\":\"P0\"}"}`,
+		},
+		[]string{
+			`{"type":"system","subtype":"init","session_id":"attempt-1"}`,
+			`{"type":"result","subtype":"success","session_id":"attempt-1","result":"{\"title\":\"登录失败\",\"priority\":\"high\"}"}`,
+		},
+	)
+	llm, err := New(WithCLIPath(fake.Path), WithJSONSchema(ticketSchema))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, "无法登录")}
+
+	got, err := GenerateJSON[ticket](context.Background(), llm, messages,
+		WithCallOptions(WithSessionID("fixed-id")))
+	if err != nil {
+		t.Fatalf("GenerateJSON: %v", err)
+	}
+	if got.Priority != "high" {
+		t.Fatalf("unexpected ticket: %+v", got)
+	}
+
+	invocations := fake.Invocations()
+	if len(invocations) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(invocations))
+	}
+	if first := invocations[0]; first.Flag("--session-id") != "fixed-id" || first.HasFlag("--resume") {
+		t.Fatalf("first attempt should start the requested session: %q", first.Args)
+	}
+	retry := invocations[1]
+	if retry.Flag("--resume") != "attempt-1" || retry.HasFlag("--session-id") || retry.HasFlag("--fork-session") {
+		t.Fatalf("retry should resume the previous attempt: %q", retry.Args)
+	}
+	prompt := retry.Prompt()
+	if strings.Contains(prompt, "无法登录") || !strings.HasPrefix(prompt, "Your previous response did not match") {
+		t.Fatalf("retry should only send the feedback turn, got %q", prompt)
+	}
+}
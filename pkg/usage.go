@@ -0,0 +1,90 @@
+package claudecode
+
+import (
+	"github.com/IMBotPlatform/LLMClaudeCode/pkg/stream"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// Usage 汇总一次调用的 token 用量与计费信息，来自 CLI 的 result 消息。
+// 以 GenerationInfo["Usage"] 形式返回，同时按 langchaingo 惯用键名展开。
+type Usage struct {
+	InputTokens              int                          // 未命中缓存的输入 token
+	OutputTokens             int                          // 输出 token
+	CacheCreationInputTokens int                          // 写入缓存的输入 token
+	CacheReadInputTokens     int                          // 命中缓存的输入 token
+	NumTurns                 int                          // CLI 内部的对话轮数
+	DurationMS               int                          // 总耗时（毫秒）
+	DurationAPIMS            int                          // API 耗时（毫秒）
+	TotalCostUSD             float64                      // CLI 估算的费用（美元）
+	SessionID                string                       // 会话 ID
+	ModelUsage               map[string]stream.ModelUsage // 按模型拆分的用量
+}
+
+// PromptTokens returns all input tokens, including cache creation and cache reads.
+func (u Usage) PromptTokens() int {
+	return u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// CompletionTokens returns the output tokens.
+func (u Usage) CompletionTokens() int {
+	return u.OutputTokens
+}
+
+// TotalTokens returns prompt plus completion tokens.
+func (u Usage) TotalTokens() int {
+	return u.PromptTokens() + u.CompletionTokens()
+}
+
+// ResponseUsage extracts the typed Usage from a response returned by this package.
+// 参数：resp 为 GenerateContent 的返回值。
+// 返回：Usage 与是否存在。
+func ResponseUsage(resp *llms.ContentResponse) (Usage, bool) {
+	if resp == nil || len(resp.Choices) == 0 || resp.Choices[0] == nil {
+		return Usage{}, false
+	}
+	usage, ok := resp.Choices[0].GenerationInfo["Usage"].(Usage)
+	return usage, ok
+}
+
+// usageFromResult builds Usage from a result message.
+// 参数：result 为 CLI result 消息。
+// 返回：Usage。
+func usageFromResult(result *stream.ResultEvent) Usage {
+	usage := Usage{
+		NumTurns:      result.NumTurns,
+		DurationMS:    int(result.DurationMS),
+		DurationAPIMS: int(result.DurationAPIMS),
+		TotalCostUSD:  result.TotalCostUSD,
+		SessionID:     result.SessionID,
+		ModelUsage:    result.ModelUsage,
+	}
+	if result.Usage != nil {
+		usage.InputTokens = result.Usage.InputTokens
+		usage.OutputTokens = result.Usage.OutputTokens
+		usage.CacheCreationInputTokens = result.Usage.CacheCreationInputTokens
+		usage.CacheReadInputTokens = result.Usage.CacheReadInputTokens
+	}
+	return usage
+}
+
+// setGenerationInfo writes usage under the conventional langchaingo keys.
+// 参数：info 为待写入的 GenerationInfo。
+func (u Usage) setGenerationInfo(info map[string]any) {
+	info["Usage"] = u
+	info["InputTokens"] = u.InputTokens
+	info["OutputTokens"] = u.OutputTokens
+	info["CacheCreationInputTokens"] = u.CacheCreationInputTokens
+	info["CacheReadInputTokens"] = u.CacheReadInputTokens
+	info["PromptTokens"] = u.PromptTokens()
+	info["CompletionTokens"] = u.CompletionTokens()
+	info["TotalTokens"] = u.TotalTokens()
+	info["NumTurns"] = u.NumTurns
+	info["DurationMS"] = u.DurationMS
+	info["DurationAPIMS"] = u.DurationAPIMS
+	if u.SessionID != "" {
+		info["SessionID"] = u.SessionID
+	}
+	if u.ModelUsage != nil {
+		info["ModelUsage"] = u.ModelUsage
+	}
+}
@@ -0,0 +1,47 @@
+package claudecode
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestReadStreamMapsResultUsage(t *testing.T) {
+	llm := &LLM{}
+	stdout := strings.NewReader(`{"type":"result","subtype":"success","session_id":"sess-1","result":"ok","num_turns":3,"duration_ms":1200,"duration_api_ms":900,"total_cost_usd":0.012,` +
+		`"usage":{"input_tokens":10,"output_tokens":20,"cache_creation_input_tokens":30,"cache_read_input_tokens":40},` +
+		`"modelUsage":{"claude-sonnet-4-5":{"inputTokens":10,"outputTokens":20,"costUSD":0.012}}}` + "\n")
+	_, info, err := llm.readStream(context.Background(), stdout, nil)
+	if err != nil {
+		t.Fatalf("readStream: %v", err)
+	}
+
+	want := map[string]int{
+		"InputTokens":              10,
+		"OutputTokens":             20,
+		"CacheCreationInputTokens": 30,
+		"CacheReadInputTokens":     40,
+		"PromptTokens":             80,
+		"CompletionTokens":         20,
+		"TotalTokens":              100,
+		"NumTurns":                 3,
+		"DurationMS":               1200,
+		"DurationAPIMS":            900,
+	}
+	for key, v := range want {
+		if info[key] != v {
+			t.Fatalf("%s: got %v, want %d", key, info[key], v)
+		}
+	}
+	if info["SessionID"] != "sess-1" {
+		t.Fatalf("unexpected session id: %v", info["SessionID"])
+	}
+
+	usage, ok := info["Usage"].(Usage)
+	if !ok {
+		t.Fatalf("expected typed usage, got %T", info["Usage"])
+	}
+	if usage.TotalCostUSD != 0.012 || usage.ModelUsage["claude-sonnet-4-5"].OutputTokens != 20 {
+		t.Fatalf("unexpected usage: %+v", usage)
+	}
+}